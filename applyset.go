@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// ApplySetLabel identifies all objects that have been applied for the same project and stage
+const ApplySetLabel = "crossplane-service.keptn.sh/apply-set"
+
+// applySetInventoryKey is the key of the inventory ConfigMap listing the kinds that belong to an apply set
+const applySetInventoryKey = "resources"
+
+// ApplySetID returns the identity of the apply set of a project and stage, which is a valid label value
+func ApplySetID(project string, stage string) string {
+	id := project + "." + stage
+	if len(id) > 63 {
+		id = fmt.Sprintf("%x", sha256.Sum256([]byte(id)))[:63]
+	}
+	return id
+}
+
+// applySetInventoryName returns the name of the ConfigMap that keeps track of the kinds of an apply set
+func applySetInventoryName(applySetID string) string {
+	return fmt.Sprintf("crossplane-applyset-%x", sha256.Sum256([]byte(applySetID)))[:40]
+}
+
+// LabelApplySet adds the apply set label to all objects of the manifest
+func LabelApplySet(objects []manifestObject, applySetID string) {
+	for _, object := range objects {
+		object.setLabel(ApplySetLabel, applySetID)
+	}
+}
+
+// pruneCandidate is a live object of an apply set that is not part of the manifest anymore
+type pruneCandidate struct {
+	resource string
+	object   manifestObject
+}
+
+// findPruneCandidates returns the live objects of the apply set that are not part of the manifest anymore, except for
+// the objects keep returns true for, if not nil. The kept objects are returned as well.
+func findPruneCandidates(ctx context.Context, applySetID string, objects []manifestObject, keep func(object manifestObject) bool) ([]pruneCandidate, []pruneCandidate, error) {
+	resources, err := getApplySetInventory(ctx, applySetID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	desired := map[string]bool{}
+	for _, object := range objects {
+		desired[applySetKey(object.resource(), object.namespace(), object.name())] = true
+		if object.namespace() == "" {
+			// namespaced objects without namespace are applied to the namespace of the service, cluster-scoped
+			// objects keep the empty namespace
+			desired[applySetKey(object.resource(), serviceNamespace, object.name())] = true
+		}
+		resources = appendUnique(resources, object.resource())
+	}
+
+	var candidates, kept []pruneCandidate
+	for _, resource := range resources {
+		live, err := ListObjects(ctx, resource, "", ApplySetLabel+"="+applySetID)
+		if err != nil {
+			if IsNotFoundError(err) {
+				// the kind is not known to the management cluster anymore, hence there is nothing left to prune
+				continue
+			}
+			return nil, nil, fmt.Errorf("could not list %s of apply set %s: %s", resource, applySetID, err.Error())
+		}
+
+		for _, object := range live {
+			if desired[applySetKey(resource, object.namespace(), object.name())] {
+				continue
+			}
+			if keep != nil && keep(object) {
+				kept = append(kept, pruneCandidate{resource: resource, object: object})
+				continue
+			}
+			candidates = append(candidates, pruneCandidate{resource: resource, object: object})
+		}
+	}
+	return candidates, kept, nil
+}
+
+// PlanPruneApplySet returns the objects of the apply set that PruneApplySet would delete for the manifest, without
+// deleting them
+func PlanPruneApplySet(ctx context.Context, applySetID string, objects []manifestObject, keep func(object manifestObject) bool) ([]string, error) {
+	candidates, _, err := findPruneCandidates(ctx, applySetID, objects, keep)
+	if err != nil {
+		return nil, err
+	}
+	pruned := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		pruned = append(pruned, candidate.object.String())
+	}
+	return pruned, nil
+}
+
+// PruneApplySet deletes all objects of the apply set that are not part of the manifest anymore and records the kinds
+// of the manifest in the inventory. It returns the objects that have been pruned. Passing no objects deletes the
+// whole apply set. Objects keep returns true for, e.g., protected environments, are not deleted and stay in the
+// apply set.
+func PruneApplySet(ctx context.Context, applySetID string, objects []manifestObject, keep func(object manifestObject) bool) ([]string, error) {
+	candidates, kept, err := findPruneCandidates(ctx, applySetID, objects, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []string
+	for _, candidate := range candidates {
+		object := candidate.object
+		log.Printf("Pruning %s of apply set %s", object, applySetID)
+		if err := DeleteObject(ctx, candidate.resource, object.name(), object.namespace()); err != nil {
+			return pruned, fmt.Errorf("could not prune %s: %s", object, err.Error())
+		}
+		pruned = append(pruned, object.String())
+	}
+
+	// only the kinds of the current manifest and of the kept objects can contain objects of the apply set from now on
+	var current []string
+	for _, object := range objects {
+		current = appendUnique(current, object.resource())
+	}
+	for _, candidate := range kept {
+		log.Printf("Keeping %s of apply set %s", candidate.object, applySetID)
+		current = appendUnique(current, candidate.resource)
+	}
+	if err := setApplySetInventory(ctx, applySetID, current); err != nil {
+		return pruned, err
+	}
+
+	return pruned, nil
+}
+
+// applySetKey identifies an object of an apply set, objects with the same name can exist in different namespaces
+func applySetKey(resource string, namespace string, name string) string {
+	return resource + "/" + namespace + "/" + name
+}
+
+// getApplySetInventory returns the kinds that have previously been applied for the apply set
+func getApplySetInventory(ctx context.Context, applySetID string) ([]string, error) {
+	inventory, err := GetObject(ctx, "configmap", applySetInventoryName(applySetID), serviceNamespace)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not get inventory of apply set %s: %s", applySetID, err.Error())
+	}
+
+	value := nestedString(inventory, "data", applySetInventoryKey)
+	if value == "" {
+		return nil, nil
+	}
+	return strings.Split(value, ","), nil
+}
+
+// setApplySetInventory stores the kinds that belong to the apply set, an empty apply set removes the inventory
+func setApplySetInventory(ctx context.Context, applySetID string, resources []string) error {
+	if len(resources) == 0 {
+		if err := DeleteObject(ctx, "configmap", applySetInventoryName(applySetID), serviceNamespace); err != nil {
+			return fmt.Errorf("could not delete inventory of apply set %s: %s", applySetID, err.Error())
+		}
+		return nil
+	}
+	sort.Strings(resources)
+
+	inventory := manifestObject{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      applySetInventoryName(applySetID),
+			"namespace": serviceNamespace,
+		},
+		"data": map[string]interface{}{
+			applySetInventoryKey: strings.Join(resources, ","),
+		},
+	}
+
+	if err := ApplyObjects(ctx, []manifestObject{inventory}); err != nil {
+		return fmt.Errorf("could not store inventory of apply set %s: %s", applySetID, err.Error())
+	}
+	return nil
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func testSecret(name string, namespace string, applySetID string) manifestObject {
+	secret := manifestObject{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+	}
+	secret.setLabel(ApplySetLabel, applySetID)
+	return secret
+}
+
+func TestPruneApplySet(t *testing.T) {
+	applySetID := ApplySetID("sockshop", "dev")
+	environment := loadTestManifest(t, "demo/cluster.yaml")[0]
+	LabelApplySet([]manifestObject{environment}, applySetID)
+
+	memory := useMemoryCluster(t,
+		environment,
+		testSecret("connection", "team-a", applySetID),
+		testSecret("connection", "team-b", applySetID),
+		testSecret("connection", "team-c", ApplySetID("sockshop", "production")),
+	)
+	memory.unknown["Bucket.storage.example.com"] = true
+	if err := setApplySetInventory(context.Background(), applySetID, []string{"Bucket.storage.example.com", "Secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := PruneApplySet(context.Background(), applySetID, []manifestObject{environment, testSecret("connection", "team-a", applySetID)}, nil)
+	if err != nil {
+		t.Fatalf("PruneApplySet() error = %v", err)
+	}
+	if want := []string{"Secret/team-b/connection"}; !reflect.DeepEqual(pruned, want) {
+		t.Errorf("PruneApplySet() pruned %v, want %v", pruned, want)
+	}
+	for _, kept := range []manifestObject{environment, testSecret("connection", "team-a", ""), testSecret("connection", "team-c", "")} {
+		if memory.object(kept.resource(), kept.name(), kept.namespace()) == nil {
+			t.Errorf("PruneApplySet() deleted %s", kept)
+		}
+	}
+
+	resources, err := getApplySetInventory(context.Background(), applySetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"CompositeCluster.devopstoolkitseries.com", "Secret"}; !reflect.DeepEqual(resources, want) {
+		t.Errorf("inventory after PruneApplySet() = %v, want %v", resources, want)
+	}
+}
+
+func TestPruneApplySetKeepsProtectedObjects(t *testing.T) {
+	applySetID := ApplySetID("sockshop", "dev")
+	environment := loadTestManifest(t, "demo/cluster.yaml")[0]
+	LabelApplySet([]manifestObject{environment}, applySetID)
+	environment.setAnnotation(ProtectedAnnotation, "true")
+	memory := useMemoryCluster(t, environment, testSecret("connection", "team-a", applySetID))
+	if err := setApplySetInventory(context.Background(), applySetID, []string{environment.resource(), "Secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := PruneApplySet(context.Background(), applySetID, []manifestObject{testSecret("connection", "team-a", applySetID)}, IsProtected)
+	if err != nil {
+		t.Fatalf("PruneApplySet() error = %v", err)
+	}
+	if len(pruned) > 0 || len(memory.deleted) > 0 {
+		t.Errorf("PruneApplySet() pruned %v, want the protected environment to be kept", pruned)
+	}
+
+	// the kept environment stays part of the apply set, so that a teardown deletes it
+	resources, err := getApplySetInventory(context.Background(), applySetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{environment.resource(), "Secret"}; !reflect.DeepEqual(resources, want) {
+		t.Errorf("inventory after PruneApplySet() = %v, want %v", resources, want)
+	}
+}
+
+func TestPruneApplySetWithoutObjects(t *testing.T) {
+	applySetID := ApplySetID("sockshop", "dev")
+	memory := useMemoryCluster(t, testSecret("connection", "team-a", applySetID))
+	if err := setApplySetInventory(context.Background(), applySetID, []string{"Secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := PruneApplySet(context.Background(), applySetID, nil, nil)
+	if err != nil {
+		t.Fatalf("PruneApplySet() error = %v", err)
+	}
+	if want := []string{"Secret/team-a/connection"}; !reflect.DeepEqual(pruned, want) {
+		t.Errorf("PruneApplySet() pruned %v, want %v", pruned, want)
+	}
+	if memory.object("configmap", applySetInventoryName(applySetID), serviceNamespace) != nil {
+		t.Errorf("PruneApplySet() without objects kept the inventory")
+	}
+}
+
+func TestApplySetInventory(t *testing.T) {
+	useMemoryCluster(t)
+	applySetID := ApplySetID("sockshop", "dev")
+
+	resources, err := getApplySetInventory(context.Background(), applySetID)
+	if err != nil || resources != nil {
+		t.Fatalf("getApplySetInventory() of a new apply set = %v, %v, want no resources", resources, err)
+	}
+
+	want := []string{"CompositeCluster.devopstoolkitseries.com", "ConfigMap", "Secret"}
+	if err := setApplySetInventory(context.Background(), applySetID, []string{"Secret", "CompositeCluster.devopstoolkitseries.com", "ConfigMap"}); err != nil {
+		t.Fatal(err)
+	}
+	if resources, err = getApplySetInventory(context.Background(), applySetID); err != nil || !reflect.DeepEqual(resources, want) {
+		t.Errorf("getApplySetInventory() = %v, %v, want %v", resources, err, want)
+	}
+
+	if err := setApplySetInventory(context.Background(), applySetID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if resources, err = getApplySetInventory(context.Background(), applySetID); err != nil || resources != nil {
+		t.Errorf("getApplySetInventory() after removing all resources = %v, %v, want no resources", resources, err)
+	}
+}
+
+func TestPruneApplySetWithoutNamespace(t *testing.T) {
+	applySetID := ApplySetID("sockshop", "dev")
+	memory := useMemoryCluster(t,
+		testSecret("connection", serviceNamespace, applySetID),
+		testSecret("connection", "team-a", applySetID),
+	)
+
+	// an object without namespace only stands for the object in the namespace of the service
+	manifest := []manifestObject{testSecret("connection", "", applySetID)}
+	planned, err := PlanPruneApplySet(context.Background(), applySetID, manifest, nil)
+	if err != nil {
+		t.Fatalf("PlanPruneApplySet() error = %v", err)
+	}
+	want := []string{"Secret/team-a/connection"}
+	if !reflect.DeepEqual(planned, want) {
+		t.Errorf("PlanPruneApplySet() = %v, want %v", planned, want)
+	}
+	if len(memory.deleted) != 0 {
+		t.Errorf("PlanPruneApplySet() deleted %v", memory.deleted)
+	}
+
+	pruned, err := PruneApplySet(context.Background(), applySetID, manifest, nil)
+	if err != nil {
+		t.Fatalf("PruneApplySet() error = %v", err)
+	}
+	if !reflect.DeepEqual(pruned, want) {
+		t.Errorf("PruneApplySet() pruned %v, want %v", pruned, want)
+	}
+	if memory.object("secret", "connection", serviceNamespace) == nil {
+		t.Errorf("PruneApplySet() deleted the object in the namespace of the service")
+	}
+}
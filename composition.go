@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CompositionProperties are the task properties selecting the composition of all composites and claims of the manifest
+type CompositionProperties struct {
+	// Composition is the name of the composition
+	Composition string `json:"composition,omitempty"`
+	// CompositionSelector are the labels of the composition
+	CompositionSelector map[string]string `json:"compositionSelector,omitempty"`
+}
+
+// SelectComposition injects the composition into all composites and claims of the manifest, so the same manifest can be
+// used across stages and providers. Task properties take precedence over the stage configuration of the service
+// config; if neither selects a composition, the manifest is left untouched.
+// It returns a description of the selected composition, or an empty string.
+func SelectComposition(objects []manifestObject, xrds []manifestObject, properties CompositionProperties, stageConfig StageConfig) string {
+	composition := properties.Composition
+	selector := properties.CompositionSelector
+	if composition == "" && len(selector) == 0 {
+		composition = stageConfig.Composition
+		selector = stageConfig.CompositionSelector
+	}
+	if composition == "" && len(selector) == 0 {
+		return ""
+	}
+
+	for _, object := range objects {
+		if findCompositeResourceDefinition(xrds, object) == nil {
+			continue
+		}
+
+		spec, _ := object["spec"].(map[string]interface{})
+		if spec == nil {
+			spec = map[string]interface{}{}
+			object["spec"] = spec
+		}
+
+		// a compositionRef always wins over a compositionSelector in Crossplane, hence only one of them is set
+		if composition != "" {
+			delete(spec, "compositionSelector")
+			spec["compositionRef"] = map[string]interface{}{"name": composition}
+		} else {
+			matchLabels := map[string]interface{}{}
+			for key, value := range selector {
+				matchLabels[key] = value
+			}
+			delete(spec, "compositionRef")
+			spec["compositionSelector"] = map[string]interface{}{"matchLabels": matchLabels}
+		}
+	}
+
+	if composition != "" {
+		return "composition " + composition
+	}
+	return "composition matching " + labelSelector(selector)
+}
+
+// labelSelector converts the labels into a kubectl label selector in a deterministic order
+func labelSelector(labels map[string]string) string {
+	selectors := make([]string, 0, len(labels))
+	for key, value := range labels {
+		selectors = append(selectors, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(selectors)
+	return strings.Join(selectors, ",")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelectComposition(t *testing.T) {
+	xrds := loadTestManifest(t, "demo/crossplane-resources/definition.yaml")
+
+	tests := []struct {
+		name            string
+		properties      CompositionProperties
+		stageConfig     StageConfig
+		want            string
+		wantRef         string
+		wantMatchLabels map[string]interface{}
+	}{
+		{
+			name:    "manifest is left untouched",
+			wantRef: "cluster-civo",
+		},
+		{
+			name:        "composition of the stage",
+			stageConfig: StageConfig{Composition: "cluster-kind"},
+			want:        "composition cluster-kind",
+			wantRef:     "cluster-kind",
+		},
+		{
+			name:            "task properties override the stage",
+			properties:      CompositionProperties{CompositionSelector: map[string]string{"provider": "civo", "cluster": "ck"}},
+			stageConfig:     StageConfig{Composition: "cluster-kind"},
+			want:            "composition matching cluster=ck,provider=civo",
+			wantMatchLabels: map[string]interface{}{"provider": "civo", "cluster": "ck"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := loadTestManifest(t, "demo/cluster.yaml")
+
+			if got := SelectComposition(objects, xrds, tt.properties, tt.stageConfig); got != tt.want {
+				t.Errorf("SelectComposition() = %s, want %s", got, tt.want)
+			}
+			if ref := nestedString(objects[0], "spec", "compositionRef", "name"); ref != tt.wantRef {
+				t.Errorf("SelectComposition() compositionRef = %s, want %s", ref, tt.wantRef)
+			}
+			matchLabels := nestedMap(objects[0], "spec", "compositionSelector", "matchLabels")
+			if len(matchLabels) != len(tt.wantMatchLabels) {
+				t.Errorf("SelectComposition() matchLabels = %v, want %v", matchLabels, tt.wantMatchLabels)
+			}
+			for key, value := range tt.wantMatchLabels {
+				if matchLabels[key] != value {
+					t.Errorf("SelectComposition() matchLabels = %v, want %v", matchLabels, tt.wantMatchLabels)
+				}
+			}
+		})
+	}
+}
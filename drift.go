@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
+	"github.com/google/uuid"
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+)
+
+// Drift policies of a stage, deciding what happens if the live environment differs from the crossplane files
+const (
+	// DriftPolicyIgnore does not check the environments of the stage
+	DriftPolicyIgnore = "ignore"
+	// DriftPolicyReport exposes the drift as metrics only (default)
+	DriftPolicyReport = "report"
+	// DriftPolicyEvent additionally triggers a Keptn sequence of the stage once per drift
+	DriftPolicyEvent = "event"
+	// DriftPolicyReconcile applies the crossplane files again, reverting any change made in the management cluster.
+	// Changed crossplane files are not applied, they trigger a Keptn sequence like the event policy instead.
+	DriftPolicyReconcile = "reconcile"
+)
+
+// DefaultDriftSequence is the sequence triggered for a drifted environment if the stage does not configure one
+const DefaultDriftSequence = "environment-drift"
+
+// driftIgnoredFields are top-level fields that are not compared, either because they are managed by the API server
+// or because they cannot be read back, such as the stringData of a Secret
+var driftIgnoredFields = map[string]bool{
+	"apiVersion": true,
+	"kind":       true,
+	"metadata":   true,
+	"status":     true,
+	"stringData": true,
+}
+
+// DriftConfig is the configuration of the drift check for a stage
+type DriftConfig struct {
+	// Policy is what happens to a drifted environment of the stage: ignore, report, event or reconcile
+	Policy string `yaml:"policy,omitempty"`
+	// Sequence is the sequence triggered by the event policy, environment-drift by default
+	Sequence string `yaml:"sequence,omitempty"`
+}
+
+// DriftPolicy returns the drift policy of the stage
+func DriftPolicy(stage StageConfig) (string, error) {
+	switch stage.Drift.Policy {
+	case "":
+		return DriftPolicyReport, nil
+	case DriftPolicyIgnore, DriftPolicyReport, DriftPolicyEvent, DriftPolicyReconcile:
+		return stage.Drift.Policy, nil
+	}
+	return "", fmt.Errorf("unknown drift policy %s, supported policies are %s, %s, %s and %s", stage.Drift.Policy, DriftPolicyIgnore, DriftPolicyReport, DriftPolicyEvent, DriftPolicyReconcile)
+}
+
+// DriftSequence returns the sequence triggered for a drifted environment of the stage
+func DriftSequence(stage StageConfig) string {
+	if stage.Drift.Sequence == "" {
+		return DefaultDriftSequence
+	}
+	return stage.Drift.Sequence
+}
+
+// DriftReport describes how the live environment of a stage differs from the crossplane files in the Keptn git repo
+type DriftReport struct {
+	Project string `json:"project"`
+	Stage   string `json:"stage"`
+	// Changed are the fields of live objects that differ from the crossplane files, e.g., KindCluster/dev: spec.parameters.nodeSize
+	Changed []string `json:"changed,omitempty"`
+	// Missing are the objects of the crossplane files that do not exist in the management cluster
+	Missing []string `json:"missing,omitempty"`
+	// Extra are the objects of the apply set that are not part of the crossplane files, which a setup would prune
+	Extra []string `json:"extra,omitempty"`
+	// RepositoryChanged is true if the crossplane files changed since the environment has been set up
+	RepositoryChanged bool `json:"repositoryChanged,omitempty"`
+	// Reconciled is true if the crossplane files have been applied again by the reconcile policy
+	Reconciled bool `json:"reconciled,omitempty"`
+	// Error describes why the environment could not be checked or reconciled
+	Error string `json:"error,omitempty"`
+	// Checked is the time of the check
+	Checked time.Time `json:"checked"`
+}
+
+// Drifted returns true if the live environment differs from the crossplane files
+func (r DriftReport) Drifted() bool {
+	return len(r.Changed) > 0 || len(r.Missing) > 0 || len(r.Extra) > 0 || r.RepositoryChanged
+}
+
+// String summarizes the drift
+func (r DriftReport) String() string {
+	var findings []string
+	if len(r.Changed) > 0 {
+		findings = append(findings, "changed "+strings.Join(r.Changed, ", "))
+	}
+	if len(r.Missing) > 0 {
+		findings = append(findings, "missing "+strings.Join(r.Missing, ", "))
+	}
+	if len(r.Extra) > 0 {
+		findings = append(findings, "not part of the crossplane files "+strings.Join(r.Extra, ", "))
+	}
+	if r.RepositoryChanged {
+		findings = append(findings, "the crossplane files changed since the environment has been set up")
+	}
+	if len(findings) == 0 {
+		return fmt.Sprintf("The environment of stage %s in project %s matches the crossplane files", r.Stage, r.Project)
+	}
+	return fmt.Sprintf("The environment of stage %s in project %s drifted from the crossplane files: %s", r.Stage, r.Project, strings.Join(findings, "; "))
+}
+
+// fingerprint identifies the drift, so that the same drift is only reported once by the event policy
+func (r DriftReport) fingerprint() string {
+	content, _ := json.Marshal(DriftReport{Changed: r.Changed, Missing: r.Missing, Extra: r.Extra, RepositoryChanged: r.RepositoryChanged})
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// trackedEnvironment is an environment the service has set up, identified by the apply set (i.e., project and
+// stage) its objects have been applied for
+type trackedEnvironment struct {
+	applySetID string
+	owner      ownership
+}
+
+// FindTrackedEnvironments returns the environments set up by the service, i.e., the apply sets of the composites and
+// claims managed by the service, with the Keptn sequence that set them up. Available environments of a pool do not
+// belong to an apply set and are not tracked.
+func FindTrackedEnvironments(ctx context.Context, xrds []manifestObject) ([]trackedEnvironment, error) {
+	tracked := map[string]trackedEnvironment{}
+	selector := ManagedByLabel + "=" + ServiceName + "," + ApplySetLabel
+	for _, xrd := range xrds {
+		group := nestedString(xrd, "spec", "group")
+		for _, kind := range []string{nestedString(xrd, "spec", "names", "kind"), nestedString(xrd, "spec", "claimNames", "kind")} {
+			if kind == "" {
+				continue
+			}
+			objects, err := ListObjects(ctx, kind+"."+group, "", selector)
+			if err != nil {
+				return nil, fmt.Errorf("could not list %s.%s: %s", kind, group, err.Error())
+			}
+			for _, object := range objects {
+				applySetID := nestedString(object, "metadata", "labels", ApplySetLabel)
+				if _, ok := tracked[applySetID]; ok || applySetID == "" {
+					continue
+				}
+				owner := ownerOf(object)
+				if owner.Project == "" || owner.Stage == "" {
+					continue
+				}
+				tracked[applySetID] = trackedEnvironment{applySetID: applySetID, owner: owner}
+			}
+		}
+	}
+
+	environments := make([]trackedEnvironment, 0, len(tracked))
+	for _, environment := range tracked {
+		environments = append(environments, environment)
+	}
+	sort.Slice(environments, func(i, j int) bool {
+		return environments[i].applySetID < environments[j].applySetID
+	})
+	return environments, nil
+}
+
+// ownerOf returns the Keptn sequence the object has been applied for, the annotations hold the full values
+func ownerOf(object manifestObject) ownership {
+	value := func(key string) string {
+		if annotation := nestedString(object, "metadata", "annotations", key); annotation != "" {
+			return annotation
+		}
+		return nestedString(object, "metadata", "labels", key)
+	}
+	return ownership{
+		Project:      value(ProjectLabel),
+		Stage:        value(StageLabel),
+		Service:      value(ServiceLabel),
+		KeptnContext: value(KeptnContextLabel),
+		TriggeredID:  value(TriggeredIDLabel),
+		ManifestHash: value(ManifestHashLabel),
+		Render:       nestedString(object, "metadata", "annotations", RenderAnnotation),
+	}
+}
+
+// DiffObject returns the paths of the fields of the desired object whose value differs in the live object, e.g.,
+// spec.parameters.nodeSize. Fields only set in the live object, e.g., defaults or references set by Crossplane, are
+// not reported. Labels and annotations are compared, the remaining metadata and the status are not.
+func DiffObject(desired manifestObject, live manifestObject) []string {
+	var paths []string
+	for _, field := range []string{"labels", "annotations"} {
+		if values := nestedMap(desired, "metadata", field); values != nil {
+			paths = append(paths, diffValue("metadata."+field, values, nestedValue(live, "metadata", field))...)
+		}
+	}
+
+	fields := make([]string, 0, len(desired))
+	for field := range desired {
+		if !driftIgnoredFields[field] {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		paths = append(paths, diffValue(field, desired[field], live[field])...)
+	}
+	return paths
+}
+
+// diffValue compares the desired value at the path with the live value, maps are compared by the keys of the
+// desired map and lists element by element
+func diffValue(path string, desired interface{}, live interface{}) []string {
+	switch typed := desired.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		liveMap, ok := live.(map[string]interface{})
+		if !ok {
+			return []string{path}
+		}
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var paths []string
+		for _, key := range keys {
+			paths = append(paths, diffValue(path+"."+key, typed[key], liveMap[key])...)
+		}
+		return paths
+	case []interface{}:
+		liveList, ok := live.([]interface{})
+		if !ok || len(liveList) != len(typed) {
+			return []string{path}
+		}
+		var paths []string
+		for index, item := range typed {
+			paths = append(paths, diffValue(fmt.Sprintf("%s[%d]", path, index), item, liveList[index])...)
+		}
+		return paths
+	}
+
+	if desiredNumber, ok := toFloat(desired); ok {
+		if liveNumber, ok := toFloat(live); ok && liveNumber == desiredNumber {
+			return nil
+		}
+		return []string{path}
+	}
+	if desired != live {
+		return []string{path}
+	}
+	return nil
+}
+
+// asPoolMember returns a copy of the environment of the manifest as it has been applied after it was claimed from
+// the pool as the live member: under the name of the member, with its connection secret and its pool labels
+func asPoolMember(environment manifestObject, member manifestObject) manifestObject {
+	claimed := manifestObject(convertYAMLValue(map[string]interface{}(environment)).(map[string]interface{}))
+	claimPoolMember(claimed, member)
+	return claimed
+}
+
+// CompareEnvironment compares the objects of the manifest with the live objects of the apply set, including the
+// objects of the apply set a setup would prune. An environment claimed from a pool is compared with the claimed
+// member. It returns the report and the manifest as it is applied by a reconciliation.
+func CompareEnvironment(ctx context.Context, manifest []manifestObject, xrds []manifestObject, applySetID string, manifestHash string) (DriftReport, []manifestObject, error) {
+	report := DriftReport{}
+	applied := make([]manifestObject, 0, len(manifest))
+	for _, object := range manifest {
+		live, err := GetObject(ctx, object.resource(), object.name(), object.namespace())
+		if err != nil && IsNotFoundError(err) {
+			if xrd := findCompositeResourceDefinition(xrds, object); xrd != nil {
+				environment := &environmentResource{object: object, claim: nestedString(xrd, "spec", "claimNames", "kind") == object.kind()}
+				if member, memberErr := FindAppliedEnvironment(ctx, environment, applySetID); memberErr == nil {
+					object, live, err = asPoolMember(object, member.object), member.object, nil
+				}
+			}
+		}
+		applied = append(applied, object)
+		if err != nil {
+			if IsNotFoundError(err) {
+				report.Missing = append(report.Missing, object.String())
+				continue
+			}
+			return report, nil, fmt.Errorf("could not get %s: %s", object, err.Error())
+		}
+
+		for _, path := range DiffObject(object, live) {
+			report.Changed = append(report.Changed, fmt.Sprintf("%s: %s", object, path))
+		}
+		if hash := nestedString(live, "metadata", "annotations", ManifestHashLabel); hash != "" && hash != manifestHash {
+			report.RepositoryChanged = true
+		}
+	}
+
+	extra, err := PlanPruneApplySet(ctx, applySetID, applied, nil)
+	if err != nil {
+		return report, nil, err
+	}
+	report.Extra = extra
+	return report, applied, nil
+}
+
+// reportedDrift remembers the drift reported per apply set by the event policy, so that a drift triggers one sequence
+// instead of one per check. It is only used by the loop of the drift checks.
+var reportedDrift = map[string]string{}
+
+// RunDriftChecks checks all tracked environments for drift in the interval until the context is done. It is meant to
+// be run by the leader of the replicas, the metrics of the checks are removed once it returns.
+func RunDriftChecks(ctx context.Context, interval time.Duration) {
+	defer driftMetrics.reset()
+	for {
+		CheckDrift(ctx)
+		if err := sleepContext(ctx, interval); err != nil {
+			return
+		}
+	}
+}
+
+// CheckDrift checks all environments tracked by the service that match the event filter once
+func CheckDrift(ctx context.Context) {
+	xrds, err := ListCompositeResourceDefinitions(ctx)
+	var environments []trackedEnvironment
+	if err == nil {
+		environments, err = FindTrackedEnvironments(ctx, xrds)
+	}
+	if err != nil {
+		log.Printf("Could not check environments for drift: %s", err.Error())
+		driftMetrics.failed()
+		return
+	}
+
+	checked := map[string]bool{}
+	for _, environment := range environments {
+		if ctx.Err() != nil {
+			return
+		}
+		owner := environment.owner
+		if !eventFilter.Matches(owner.Project, owner.Stage, owner.Service) {
+			continue
+		}
+		checked[environment.applySetID] = true
+		checkEnvironmentDrift(ctx, environment, xrds)
+	}
+	driftMetrics.retain(checked)
+	for applySetID := range reportedDrift {
+		if !checked[applySetID] {
+			delete(reportedDrift, applySetID)
+		}
+	}
+}
+
+// checkEnvironmentDrift renders the crossplane files of the environment, compares them to the live objects and
+// applies the drift policy of its stage. The check is skipped if another operation is running on the environment.
+func checkEnvironmentDrift(ctx context.Context, environment trackedEnvironment, xrds []manifestObject) {
+	owner := environment.owner
+	busyCtx, busy := context.WithCancel(ctx)
+	defer busy()
+	lock, err := LockEnvironment(busyCtx, environment.applySetID, DriftCheckOperation, busy)
+	if err != nil {
+		if ctx.Err() == nil && busyCtx.Err() != nil {
+			log.Printf("Skipping drift check of stage %s in project %s, another operation is running on its environment", owner.Stage, owner.Project)
+			return
+		}
+		log.Printf("Could not lock environment of stage %s in project %s for the drift check: %s", owner.Stage, owner.Project, err.Error())
+		return
+	}
+	defer lock.Unlock()
+	if lock.Err() != nil {
+		return
+	}
+
+	report := DriftReport{Project: owner.Project, Stage: owner.Stage, Checked: time.Now()}
+	myKeptn, err := newDriftKeptn(owner, DefaultDriftSequence, keptnv2.EventData{Project: owner.Project, Stage: owner.Stage, Service: owner.Service})
+	// render the crossplane files with the task properties of the setup
+	var inputs renderInputs
+	if err == nil {
+		inputs, err = parseRenderInputs(owner.Render)
+	}
+	var content []byte
+	if err == nil {
+		content, _, err = LoadCrossplaneManifest(myKeptn, inputs.HelmChartProperties)
+	}
+	var serviceConfig *ServiceConfig
+	if err == nil {
+		serviceConfig, err = GetServiceConfig(myKeptn)
+	}
+	var policy string
+	if err == nil {
+		policy, err = DriftPolicy(serviceConfig.Stage(owner.Stage))
+	}
+	if err != nil {
+		report.Error = fmt.Sprintf("Could not render the crossplane files: %s", err.Error())
+		log.Printf("Could not check environment of stage %s in project %s for drift: %s", owner.Stage, owner.Project, report.Error)
+		driftMetrics.record(environment.applySetID, report)
+		return
+	}
+	if policy == DriftPolicyIgnore {
+		driftMetrics.forget(environment.applySetID)
+		return
+	}
+	stageConfig := serviceConfig.Stage(owner.Stage)
+
+	manifest, err := parseManifest(content)
+	var applied []manifestObject
+	if err == nil {
+		SelectComposition(manifest, xrds, inputs.CompositionProperties, stageConfig)
+		AssignClaimNamespace(manifest, xrds, owner.Project)
+
+		var compared DriftReport
+		compared, applied, err = CompareEnvironment(lock.Context(), manifest, xrds, environment.applySetID, ManifestHash(content))
+		report.Changed, report.Missing, report.Extra, report.RepositoryChanged = compared.Changed, compared.Missing, compared.Extra, compared.RepositoryChanged
+	}
+	if err != nil {
+		report.Error = fmt.Sprintf("Could not compare the environment: %s", err.Error())
+		log.Printf("Could not check environment of stage %s in project %s for drift: %s", owner.Stage, owner.Project, report.Error)
+		driftMetrics.record(environment.applySetID, report)
+		return
+	}
+
+	if !report.Drifted() {
+		delete(reportedDrift, environment.applySetID)
+		driftMetrics.record(environment.applySetID, report)
+		return
+	}
+	log.Printf(report.String())
+
+	switch driftReaction(policy, report) {
+	case DriftPolicyEvent:
+		fingerprint := report.fingerprint()
+		if reportedDrift[environment.applySetID] == fingerprint {
+			break
+		}
+		if err := sendDriftEvent(owner, DriftSequence(stageConfig), report); err != nil {
+			report.Error = fmt.Sprintf("Could not trigger sequence %s: %s", DriftSequence(stageConfig), err.Error())
+			log.Printf(report.Error)
+			break
+		}
+		reportedDrift[environment.applySetID] = fingerprint
+	case DriftPolicyReconcile:
+		if lock.Err() != nil {
+			break
+		}
+		if err := reconcileEnvironment(lock.Context(), applied, xrds, environment, ManifestHash(content), stageConfig); err != nil {
+			report.Error = fmt.Sprintf("Could not reconcile the environment: %s", err.Error())
+			log.Printf("Could not reconcile environment of stage %s in project %s: %s", owner.Stage, owner.Project, err.Error())
+			break
+		}
+		report.Reconciled = true
+		log.Printf("Reconciled environment of stage %s in project %s with the crossplane files", owner.Stage, owner.Project)
+	}
+	driftMetrics.record(environment.applySetID, report)
+}
+
+// driftReaction returns how the policy reacts to the drift: DriftPolicyEvent to trigger the drift sequence,
+// DriftPolicyReconcile to reconcile the environment or DriftPolicyReport to only report it. Changed crossplane files are
+// only applied by a sequence of the stage, hence the reconcile policy triggers the drift sequence for them and only
+// reverts changes made in the management cluster itself.
+func driftReaction(policy string, report DriftReport) string {
+	switch {
+	case policy == DriftPolicyEvent || (policy == DriftPolicyReconcile && report.RepositoryChanged):
+		return DriftPolicyEvent
+	case policy == DriftPolicyReconcile:
+		return DriftPolicyReconcile
+	}
+	return DriftPolicyReport
+}
+
+// reconcileEnvironment applies the manifest again and prunes the objects of the apply set that are not part of it like
+// a setup, protected environments are kept. The manifest has to be the one the environment has been set up with, the
+// objects stay linked to the Keptn sequence that set them up.
+func reconcileEnvironment(ctx context.Context, manifest []manifestObject, xrds []manifestObject, environment trackedEnvironment, manifestHash string, stageConfig StageConfig) error {
+	if err := ValidateManifest(ctx, manifest, xrds); err != nil {
+		return fmt.Errorf("the crossplane files are invalid: %s", err.Error())
+	}
+	protected, err := FindProtectedEnvironments(ctx, manifest, xrds, environment.applySetID)
+	if err != nil {
+		return err
+	}
+
+	owner := environment.owner
+	owner.ManifestHash = manifestHash
+	LabelApplySet(manifest, environment.applySetID)
+	AddOwnership(manifest, owner)
+	if err := ApplyObjects(ctx, manifest); err != nil {
+		return err
+	}
+
+	pruned, err := PruneApplySet(ctx, environment.applySetID, manifest, keepProtectedEnvironments(xrds, owner.Stage, stageConfig, protected))
+	if len(pruned) > 0 {
+		log.Printf("Pruned objects of stage %s in project %s that are not part of the crossplane files: %s", owner.Stage, owner.Project, strings.Join(pruned, ", "))
+	}
+	return err
+}
+
+// newDriftKeptn returns a Keptn handler for the triggered event of the drift sequence of the stage the environment
+// has been set up for, which starts a new Keptn context. The handler loads the resources of the service and stage.
+func newDriftKeptn(owner ownership, sequence string, data interface{}) (*keptnv2.Keptn, error) {
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.New().String())
+	event.SetType(keptnv2.GetTriggeredEventType(owner.Stage + "." + sequence))
+	event.SetSource(ServiceName)
+	event.SetExtension("shkeptncontext", uuid.New().String())
+	if err := event.SetData(cloudevents.ApplicationJSON, data); err != nil {
+		return nil, err
+	}
+
+	myKeptn, err := keptnv2.NewKeptn(&event, keptnOptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Keptn handler: %s", err.Error())
+	}
+	// in pull mode, the resources are fetched through the Keptn API as well
+	if keptnAPI != nil {
+		myKeptn.ResourceHandler = keptnAPI.ResourceHandler()
+	}
+	return myKeptn, nil
+}
+
+// sendDriftEvent triggers the drift sequence of the stage with the report
+func sendDriftEvent(owner ownership, sequence string, report DriftReport) error {
+	myKeptn, err := newDriftKeptn(owner, sequence, EnvironmentDriftTriggeredEventData{
+		EventData: keptnv2.EventData{
+			Project: owner.Project,
+			Stage:   owner.Stage,
+			Service: owner.Service,
+			Message: report.String(),
+		},
+		EnvironmentDrift: report,
+	})
+	if err != nil {
+		return err
+	}
+	return myKeptn.SendCloudEvent(*myKeptn.CloudEvent)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+)
+
+func TestDriftPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  StageConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			config: StageConfig{},
+			want:   DriftPolicyReport,
+		},
+		{
+			name:   "reconcile",
+			config: StageConfig{Drift: DriftConfig{Policy: DriftPolicyReconcile}},
+			want:   DriftPolicyReconcile,
+		},
+		{
+			name:    "unknown policy",
+			config:  StageConfig{Drift: DriftConfig{Policy: "revert"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DriftPolicy(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DriftPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DriftPolicy() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffObject(t *testing.T) {
+	manifest, err := parseManifest([]byte(`apiVersion: devopstoolkitseries.com/v1alpha1
+kind: CompositeCluster
+metadata:
+  name: dev
+  labels:
+    team: platform
+spec:
+  id: dev
+  parameters:
+    nodeSize: small
+    minNodeCount: 1
+    zones:
+    - eu-1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := manifest[0]
+
+	tests := []struct {
+		name string
+		live string
+		want []string
+	}{
+		{
+			name: "unchanged with fields set by Crossplane",
+			live: `{"apiVersion": "devopstoolkitseries.com/v1alpha1", "kind": "CompositeCluster",
+				"metadata": {"name": "dev", "labels": {"team": "platform", "keptn.sh/project": "sockshop"}, "generation": 3},
+				"spec": {"id": "dev", "compositionRef": {"name": "cluster-kind"}, "parameters": {"nodeSize": "small", "minNodeCount": 1.0, "zones": ["eu-1"]}},
+				"status": {"conditions": []}}`,
+			want: nil,
+		},
+		{
+			name: "edited in the cluster",
+			live: `{"apiVersion": "devopstoolkitseries.com/v1alpha1", "kind": "CompositeCluster", "metadata": {"name": "dev", "labels": {"team": "data"}},
+				"spec": {"id": "dev", "parameters": {"nodeSize": "large", "minNodeCount": 3, "zones": ["eu-1", "eu-2"]}}}`,
+			want: []string{"metadata.labels.team", "spec.parameters.minNodeCount", "spec.parameters.nodeSize", "spec.parameters.zones"},
+		},
+		{
+			name: "parameters removed",
+			live: `{"apiVersion": "devopstoolkitseries.com/v1alpha1", "kind": "CompositeCluster", "metadata": {"name": "dev", "labels": {"team": "platform"}}, "spec": {"id": "dev"}}`,
+			want: []string{"spec.parameters"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live, err := parseManifest([]byte(tt.live))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := DiffObject(desired, live[0]); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffObject() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAsPoolMember(t *testing.T) {
+	environment := manifestObject{
+		"apiVersion": "devopstoolkitseries.com/v1alpha1",
+		"kind":       "CompositeCluster",
+		"metadata":   map[string]interface{}{"name": "perf-test"},
+		"spec": map[string]interface{}{
+			"id":                         "perf-test",
+			"writeConnectionSecretToRef": map[string]interface{}{"name": "perf-test", "namespace": "crossplane-system"},
+			"parameters":                 map[string]interface{}{"nodeSize": "small"},
+		},
+	}
+	member := manifestObject{
+		"metadata": map[string]interface{}{
+			"name":   "perf-test-pool-a1b2c3",
+			"labels": map[string]interface{}{PoolLabel: "0123456789abcdef", PoolStateLabel: PoolStateClaimed},
+		},
+		"spec": map[string]interface{}{
+			"id":                         "perf-test-pool-a1b2c3",
+			"writeConnectionSecretToRef": map[string]interface{}{"name": "perf-test-pool-a1b2c3", "namespace": "crossplane-system"},
+			"parameters":                 map[string]interface{}{"nodeSize": "small"},
+		},
+	}
+
+	claimed := asPoolMember(environment, member)
+	if claimed.name() != member.name() {
+		t.Errorf("asPoolMember() name = %s, want %s", claimed.name(), member.name())
+	}
+	if diff := DiffObject(claimed, member); len(diff) > 0 {
+		t.Errorf("asPoolMember() differs from the member in %v", diff)
+	}
+	if environment.name() != "perf-test" || nestedString(environment, "spec", "id") != "perf-test" {
+		t.Errorf("asPoolMember() modified the environment of the manifest")
+	}
+}
+
+func TestDriftReport(t *testing.T) {
+	report := DriftReport{
+		Project: "sockshop",
+		Stage:   "dev",
+		Changed: []string{"CompositeCluster/dev: spec.parameters.nodeSize"},
+		Checked: time.Now(),
+	}
+	if !report.Drifted() {
+		t.Errorf("Drifted() = false, want true")
+	}
+	if got := report.String(); !strings.Contains(got, "CompositeCluster/dev: spec.parameters.nodeSize") {
+		t.Errorf("String() = %q, want it to name the changed field", got)
+	}
+
+	later := report
+	later.Checked = report.Checked.Add(time.Hour)
+	later.Error = "Could not trigger sequence"
+	if later.fingerprint() != report.fingerprint() {
+		t.Errorf("fingerprint() differs for the same drift")
+	}
+	later.RepositoryChanged = true
+	if later.fingerprint() == report.fingerprint() {
+		t.Errorf("fingerprint() is the same for a different drift")
+	}
+
+	if (DriftReport{}).Drifted() {
+		t.Errorf("Drifted() of an empty report = true, want false")
+	}
+}
+
+func TestCheckEnvironmentDriftSkipsLockedEnvironment(t *testing.T) {
+	useMemoryLeases(t)
+	driftMetrics.reset()
+	defer driftMetrics.reset()
+
+	lock, err := LockEnvironment(context.Background(), "sockshop.dev", UpdateOperation, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		checkEnvironmentDrift(context.Background(), trackedEnvironment{
+			applySetID: "sockshop.dev",
+			owner:      ownership{Project: "sockshop", Stage: "dev"},
+		}, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("checkEnvironmentDrift() waited for the running operation")
+	}
+	if len(driftMetrics.reports) != 0 {
+		t.Errorf("checkEnvironmentDrift() recorded %v for a locked environment", driftMetrics.reports)
+	}
+}
+
+func TestSendDriftEvent(t *testing.T) {
+	sender := useFakeEventSender(t)
+
+	report := DriftReport{Project: "sockshop", Stage: "production", Missing: []string{"CompositeCluster/production"}}
+	if err := sendDriftEvent(ownership{Project: "sockshop", Stage: "production", Service: "carts"}, "infrastructure-drift", report); err != nil {
+		t.Fatalf("sendDriftEvent() error = %v", err)
+	}
+	if len(sender.SentEvents) != 1 {
+		t.Fatalf("sendDriftEvent() sent %d events, want 1", len(sender.SentEvents))
+	}
+
+	event := sender.SentEvents[0]
+	if event.Type() != "sh.keptn.event.production.infrastructure-drift.triggered" {
+		t.Errorf("sendDriftEvent() sent %s, want sh.keptn.event.production.infrastructure-drift.triggered", event.Type())
+	}
+	if keptnContext, _ := event.Extensions()["shkeptncontext"].(string); keptnContext == "" {
+		t.Errorf("sendDriftEvent() sent an event without Keptn context")
+	}
+	data := &EnvironmentDriftTriggeredEventData{}
+	if err := event.DataAs(data); err != nil {
+		t.Fatal(err)
+	}
+	want := keptnv2.EventData{Project: "sockshop", Stage: "production", Service: "carts", Message: report.String()}
+	if !reflect.DeepEqual(data.EventData, want) || !reflect.DeepEqual(data.EnvironmentDrift.Missing, report.Missing) {
+		t.Errorf("sendDriftEvent() sent %+v, want %+v with the report", data, want)
+	}
+}
+
+func TestDriftReaction(t *testing.T) {
+	changed := DriftReport{Changed: []string{"CompositeCluster/keptn-crossplane: spec.parameters.nodeSize"}}
+	repositoryChanged := DriftReport{Changed: changed.Changed, RepositoryChanged: true}
+
+	tests := []struct {
+		policy string
+		report DriftReport
+		want   string
+	}{
+		{policy: DriftPolicyReport, report: changed, want: DriftPolicyReport},
+		{policy: DriftPolicyEvent, report: changed, want: DriftPolicyEvent},
+		{policy: DriftPolicyEvent, report: repositoryChanged, want: DriftPolicyEvent},
+		{policy: DriftPolicyReconcile, report: changed, want: DriftPolicyReconcile},
+		// changed crossplane files are applied by a sequence, not by a reconciliation
+		{policy: DriftPolicyReconcile, report: repositoryChanged, want: DriftPolicyEvent},
+	}
+	for _, tt := range tests {
+		if got := driftReaction(tt.policy, tt.report); got != tt.want {
+			t.Errorf("driftReaction(%s, %+v) = %s, want %s", tt.policy, tt.report, got, tt.want)
+		}
+	}
+}
+
+func TestCompareEnvironmentReportsExtraObjects(t *testing.T) {
+	xrds := loadTestManifest(t, "demo/crossplane-resources/definition.yaml")[:1]
+	applySetID := ApplySetID("sockshop", "dev")
+	environment := loadTestManifest(t, "demo/cluster.yaml")[0]
+	LabelApplySet([]manifestObject{environment}, applySetID)
+	useMemoryCluster(t, environment, testSecret("connection", "team-a", applySetID))
+	if err := setApplySetInventory(context.Background(), applySetID, []string{environment.resource(), "Secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, _, err := CompareEnvironment(context.Background(), []manifestObject{environment}, xrds, applySetID, "")
+	if err != nil {
+		t.Fatalf("CompareEnvironment() error = %v", err)
+	}
+	if want := []string{"Secret/team-a/connection"}; !reflect.DeepEqual(report.Extra, want) || !report.Drifted() {
+		t.Errorf("CompareEnvironment() extra = %v, want %v", report.Extra, want)
+	}
+}
+
+func TestReconcileEnvironment(t *testing.T) {
+	definitions := loadTestManifest(t, "demo/crossplane-resources/definition.yaml")
+	xrds := definitions[:1]
+	applySetID := ApplySetID("sockshop", "dev")
+	environment := loadTestManifest(t, "demo/cluster.yaml")[0]
+	LabelApplySet([]manifestObject{environment}, applySetID)
+	shared := loadTestManifest(t, "demo/cluster.yaml")[0]
+	renameEnvironment(shared, "shared-cluster")
+	LabelApplySet([]manifestObject{shared}, applySetID)
+	shared.setAnnotation(ProtectedAnnotation, "true")
+	memory := useMemoryCluster(t, append(definitions, shared, testSecret("connection", "team-a", applySetID))...)
+	if err := setApplySetInventory(context.Background(), applySetID, []string{environment.resource(), "Secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tracked := trackedEnvironment{applySetID: applySetID, owner: ownership{Project: "sockshop", Stage: "dev", Service: "carts"}}
+	if err := reconcileEnvironment(context.Background(), []manifestObject{environment}, xrds, tracked, "a-hash", StageConfig{}); err != nil {
+		t.Fatalf("reconcileEnvironment() error = %v", err)
+	}
+	if memory.object(environment.resource(), environment.name(), "") == nil {
+		t.Errorf("reconcileEnvironment() did not apply %s", environment)
+	}
+	// objects that are not part of the crossplane files are pruned like by a setup, protected environments are kept
+	if want := []string{"Secret/team-a/connection"}; !reflect.DeepEqual(memory.deleted, want) {
+		t.Errorf("reconcileEnvironment() deleted %v, want %v", memory.deleted, want)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// DefaultConnectionSecretName is the connection secret used if the manifest does not specify one
+const DefaultConnectionSecretName = "kubeconfig-keptn-crossplane"
+
+// DefaultConnectionSecretNamespace is the namespace of the connection secret used if the manifest does not specify one
+const DefaultConnectionSecretNamespace = "crossplane-system"
+
+// environmentResource is the composite resource or claim of the manifest that represents the environment
+type environmentResource struct {
+	object manifestObject
+	claim  bool
+}
+
+// FindEnvironmentResource returns the first composite resource or claim of the manifest defined by one of the XRDs,
+// or nil if the manifest does not contain any
+func FindEnvironmentResource(objects []manifestObject, xrds []manifestObject) *environmentResource {
+	for _, object := range objects {
+		xrd := findCompositeResourceDefinition(xrds, object)
+		if xrd == nil {
+			continue
+		}
+		return &environmentResource{
+			object: object,
+			claim:  nestedString(xrd, "spec", "claimNames", "kind") == object.kind(),
+		}
+	}
+	return nil
+}
+
+// ListCompositeResourceDefinitions lists all XRDs installed in the management cluster
+func ListCompositeResourceDefinitions(ctx context.Context) ([]manifestObject, error) {
+	xrds, err := ListObjects(ctx, CompositeResourceDefinitionResource, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("could not list CompositeResourceDefinitions: %s", err.Error())
+	}
+	return xrds, nil
+}
+
+// ClaimNamespace returns the namespace claims of a project are applied to
+func ClaimNamespace(project string) string {
+	return "crossplane-" + project
+}
+
+// AssignClaimNamespace moves all claims without namespace into the namespace of the project.
+// It returns the namespace, or an empty string if the manifest does not contain any claims.
+func AssignClaimNamespace(objects []manifestObject, xrds []manifestObject, project string) string {
+	namespace := ClaimNamespace(project)
+
+	hasClaims := false
+	for _, object := range objects {
+		xrd := findCompositeResourceDefinition(xrds, object)
+		if xrd == nil || nestedString(xrd, "spec", "claimNames", "kind") != object.kind() {
+			continue
+		}
+		hasClaims = true
+		if object.namespace() == "" {
+			setNestedValue(object, namespace, "metadata", "namespace")
+		}
+	}
+	if !hasClaims {
+		return ""
+	}
+	return namespace
+}
+
+// EnsureClaimNamespace creates the namespace for the claims of the project if it does not exist yet
+func EnsureClaimNamespace(ctx context.Context, namespace string, project string) error {
+	ns := manifestObject{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]interface{}{
+			"name": namespace,
+		},
+	}
+	ns.setLabel(ProjectLabel, project)
+	ns.setLabel(ManagedByLabel, ServiceName)
+	if err := ApplyObjects(ctx, []manifestObject{ns}); err != nil {
+		return fmt.Errorf("could not create namespace %s for claims: %s", namespace, err.Error())
+	}
+	return nil
+}
+
+// ConnectionSecret returns the name and namespace of the secret the connection details (i.e., the kubeconfig) of the
+// environment are written to. Claims write to writeConnectionSecretToRef in their own namespace, composites to
+// writeConnectionSecretToRef with an explicit namespace.
+func (e *environmentResource) ConnectionSecret() (string, string) {
+	if e == nil {
+		return DefaultConnectionSecretName, DefaultConnectionSecretNamespace
+	}
+
+	name := nestedString(e.object, "spec", "writeConnectionSecretToRef", "name")
+	if name == "" {
+		return DefaultConnectionSecretName, DefaultConnectionSecretNamespace
+	}
+	if e.claim {
+		return name, e.object.namespace()
+	}
+
+	namespace := nestedString(e.object, "spec", "writeConnectionSecretToRef", "namespace")
+	if namespace == "" {
+		namespace = DefaultConnectionSecretNamespace
+	}
+	return name, namespace
+}
+
+// BoundComposite returns the name of the composite resource a claim is bound to, as tracked by spec.resourceRef.
+// For composites, the name of the composite itself is returned. An empty name means the claim is not bound yet.
+func (e *environmentResource) BoundComposite(ctx context.Context) (string, error) {
+	if !e.claim {
+		return e.object.name(), nil
+	}
+
+	live, err := GetObject(ctx, e.object.resource(), e.object.name(), e.object.namespace())
+	if err != nil {
+		return "", err
+	}
+	return nestedString(live, "spec", "resourceRef", "name"), nil
+}
+
+// String returns a human readable identifier of the environment resource
+func (e *environmentResource) String() string {
+	if e.claim {
+		return "claim " + e.object.String()
+	}
+	return "composite " + e.object.String()
+}
+
+// IsReady returns true if the Ready condition of the Crossplane resource is True
+func IsReady(object manifestObject) bool {
+	conditions, _ := nestedValue(object, "status", "conditions").([]interface{})
+	for _, item := range conditions {
+		condition, _ := item.(map[string]interface{})
+		if nestedString(condition, "type") == "Ready" {
+			return nestedString(condition, "status") == "True"
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEnvironmentResourceConnectionSecret(t *testing.T) {
+	xrds := loadTestManifest(t, "demo/crossplane-resources/definition.yaml")
+
+	tests := []struct {
+		name          string
+		manifestFile  string
+		wantClaim     bool
+		wantNamespace string
+		wantSecret    string
+		wantSecretNs  string
+	}{
+		{
+			name:         "composite without connection secret",
+			manifestFile: "demo/cluster.yaml",
+			wantSecret:   DefaultConnectionSecretName,
+			wantSecretNs: DefaultConnectionSecretNamespace,
+		},
+		{
+			name:          "claim is moved into the namespace of the project",
+			manifestFile:  "demo/cluster-claim.yaml",
+			wantClaim:     true,
+			wantNamespace: "crossplane-sockshop",
+			wantSecret:    "kubeconfig-keptn-crossplane",
+			wantSecretNs:  "crossplane-sockshop",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := loadTestManifest(t, tt.manifestFile)
+
+			namespace := AssignClaimNamespace(objects, xrds, "sockshop")
+			if namespace != tt.wantNamespace {
+				t.Errorf("AssignClaimNamespace() = %s, want %s", namespace, tt.wantNamespace)
+			}
+
+			environment := FindEnvironmentResource(objects, xrds)
+			if environment == nil {
+				t.Fatalf("FindEnvironmentResource() = nil")
+			}
+			if environment.claim != tt.wantClaim {
+				t.Errorf("FindEnvironmentResource() claim = %t, want %t", environment.claim, tt.wantClaim)
+			}
+
+			secret, secretNamespace := environment.ConnectionSecret()
+			if secret != tt.wantSecret || secretNamespace != tt.wantSecretNs {
+				t.Errorf("ConnectionSecret() = %s/%s, want %s/%s", secretNamespace, secret, tt.wantSecretNs, tt.wantSecret)
+			}
+		})
+	}
+}
+
+func TestIsReady(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []interface{}
+		want       bool
+	}{
+		{
+			name: "no conditions",
+		},
+		{
+			name: "ready",
+			conditions: []interface{}{
+				map[string]interface{}{"type": "Synced", "status": "True"},
+				map[string]interface{}{"type": "Ready", "status": "True"},
+			},
+			want: true,
+		},
+		{
+			name: "creating",
+			conditions: []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "False", "reason": "Creating"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := manifestObject{}
+			if tt.conditions != nil {
+				setNestedValue(object, tt.conditions, "status", "conditions")
+			}
+			if got := IsReady(object); got != tt.want {
+				t.Errorf("IsReady() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
 
 	"github.com/keptn/go-utils/pkg/lib/v0_2_0/fake"
 
@@ -38,3 +42,186 @@ func initializeTestObjects(eventFileName string) (*keptnv2.Keptn, *cloudevents.E
 
 	return myKeptn, incomingEvent, err
 }
+
+// newTestEvent returns a triggered event of the type with the raw JSON payload
+func newTestEvent(t *testing.T, eventType string, payload string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID("6de83495-4f83-481c-8dbe-fcceb2e0243b")
+	event.SetType(eventType)
+	event.SetSource("test-events")
+	event.SetExtension("shkeptncontext", "08735340-6f9e-4b32-97ff-3b6c292bc50i")
+	if err := event.SetData(cloudevents.ApplicationJSON, []byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// useFakeEventSender replaces the event sender of the Keptn handlers for the test
+func useFakeEventSender(t *testing.T) *fake.EventSender {
+	sender := &fake.EventSender{}
+	previous := keptnOptions.EventSender
+	keptnOptions.EventSender = sender
+	t.Cleanup(func() {
+		keptnOptions.EventSender = previous
+	})
+	return sender
+}
+
+func TestProcessKeptnCloudEventRejectsInvalidPayload(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        func(t *testing.T) cloudevents.Event
+		wantFinished bool
+	}{
+		{
+			name: "addressable environment-setup",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, EnvironmentsetupEventTriggeredType, `{"project": "sockshop", "stage": "dev", "service": "carts", "environment-setup": "create"}`)
+			},
+			wantFinished: true,
+		},
+		{
+			name: "addressable environment-update",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, EnvironmentUpdateTriggeredEventType, `{"project": "sockshop", "stage": "dev", "service": "carts", "environment-update": {"parameters": ["nodes"]}}`)
+			},
+			wantFinished: true,
+		},
+		{
+			name: "environment-setup without stage",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, EnvironmentsetupEventTriggeredType, `{"project": "sockshop", "environment-setup": "create"}`)
+			},
+			wantFinished: false,
+		},
+		{
+			name: "action of another remediation service",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, keptnv2.GetTriggeredEventType(keptnv2.ActionTaskName), `{"project": "sockshop", "stage": "dev", "service": "carts", "action": "scale-environment"}`)
+			},
+			wantFinished: false,
+		},
+		{
+			name: "payload that is not an object",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, EnvironmentsetupEventTriggeredType, `"sockshop"`)
+			},
+			wantFinished: false,
+		},
+		{
+			name: "no Keptn context",
+			event: func(t *testing.T) cloudevents.Event {
+				event := newTestEvent(t, EnvironmentsetupEventTriggeredType, `{"project": "sockshop", "stage": "dev", "service": "carts"}`)
+				delete(event.Context.AsV1().Extensions, "shkeptncontext")
+				return event
+			},
+			wantFinished: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := useFakeEventSender(t)
+
+			err := processKeptnCloudEvent(context.Background(), tt.event(t))
+
+			if !tt.wantFinished {
+				if err == nil {
+					t.Errorf("processKeptnCloudEvent() error = nil, want an error")
+				}
+				if len(sender.SentEvents) != 0 {
+					t.Errorf("processKeptnCloudEvent() sent %d events, want none", len(sender.SentEvents))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("processKeptnCloudEvent() error = %v", err)
+			}
+			if len(sender.SentEvents) != 2 {
+				t.Fatalf("processKeptnCloudEvent() sent %d events, want started and finished", len(sender.SentEvents))
+			}
+			finished := sender.SentEvents[1]
+			if !strings.HasSuffix(finished.Type(), ".finished") {
+				t.Errorf("processKeptnCloudEvent() sent %s, want a finished event", finished.Type())
+			}
+			data := &keptnv2.EventData{}
+			if err := finished.DataAs(data); err != nil {
+				t.Fatal(err)
+			}
+			if data.Status != keptnv2.StatusErrored || data.Result != keptnv2.ResultFailed || !strings.Contains(data.Message, "invalid payload") {
+				t.Errorf("processKeptnCloudEvent() finished with status %s, result %s and message %q, want an errored event for the invalid payload", data.Status, data.Result, data.Message)
+			}
+		})
+	}
+}
+
+func TestPlanEnvironmentSetup(t *testing.T) {
+	applySetID := ApplySetID("sockshop", "dev")
+	environment := loadTestManifest(t, "demo/cluster.yaml")[0]
+	LabelApplySet([]manifestObject{environment}, applySetID)
+	memory := useMemoryCluster(t, environment, testSecret("removed", "team-a", applySetID))
+	if err := setApplySetInventory(context.Background(), applySetID, []string{"Secret"}); err != nil {
+		t.Fatal(err)
+	}
+	memory.applied = nil
+	sender := useFakeEventSender(t)
+	useKubectlScript(t, "echo '+    nodeSize: large'; exit 1")
+
+	event := newTestEvent(t, EnvironmentsetupEventTriggeredType, `{"project": "sockshop", "stage": "dev", "service": "carts"}`)
+	myKeptn, err := keptnv2.NewKeptn(&event, keptnOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := planEnvironmentSetup(context.Background(), myKeptn, []manifestObject{environment}, applySetID, ownership{Project: "sockshop", Stage: "dev", Service: "carts"}, nil); err != nil {
+		t.Fatalf("planEnvironmentSetup() error = %v", err)
+	}
+	if len(memory.applied) != 0 || len(memory.deleted) != 0 {
+		t.Errorf("planEnvironmentSetup() applied %v and deleted %v, want no changes", memory.applied, memory.deleted)
+	}
+
+	finished := sender.SentEvents[len(sender.SentEvents)-1]
+	data := &EnvironmentsetupFinishedEventData{}
+	if err := finished.DataAs(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Status != keptnv2.StatusSucceeded || data.EnvironmentSetup.Mode != EnvironmentSetupModePlan {
+		t.Errorf("planEnvironmentSetup() finished with status %s and mode %s, want succeeded plan", data.Status, data.EnvironmentSetup.Mode)
+	}
+	if !strings.Contains(data.EnvironmentSetup.Diff, "nodeSize: large") {
+		t.Errorf("planEnvironmentSetup() diff = %q, want the output of kubectl diff", data.EnvironmentSetup.Diff)
+	}
+	if want := []string{"Secret/team-a/removed"}; !reflect.DeepEqual(data.EnvironmentSetup.Pruned, want) {
+		t.Errorf("planEnvironmentSetup() pruned %v, want %v", data.EnvironmentSetup.Pruned, want)
+	}
+	if !strings.Contains(data.Message, "Secret/team-a/removed") {
+		t.Errorf("planEnvironmentSetup() message = %q, want the objects the apply would prune", data.Message)
+	}
+}
+
+func TestPlanEnvironmentSetupFailedDiff(t *testing.T) {
+	environment := loadTestManifest(t, "demo/cluster.yaml")[0]
+	memory := useMemoryCluster(t)
+	sender := useFakeEventSender(t)
+	useKubectlScript(t, "echo 'error: the server could not be reached' >&2; exit 2")
+
+	event := newTestEvent(t, EnvironmentsetupEventTriggeredType, `{"project": "sockshop", "stage": "dev", "service": "carts"}`)
+	myKeptn, err := keptnv2.NewKeptn(&event, keptnOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := planEnvironmentSetup(context.Background(), myKeptn, []manifestObject{environment}, ApplySetID("sockshop", "dev"), ownership{Project: "sockshop", Stage: "dev", Service: "carts"}, nil); err != nil {
+		t.Fatalf("planEnvironmentSetup() error = %v", err)
+	}
+	if len(memory.applied) != 0 {
+		t.Errorf("planEnvironmentSetup() applied %v, want no changes", memory.applied)
+	}
+	data := &keptnv2.EventData{}
+	if err := sender.SentEvents[len(sender.SentEvents)-1].DataAs(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Status != keptnv2.StatusErrored {
+		t.Errorf("planEnvironmentSetup() finished with status %s, want errored", data.Status)
+	}
+}
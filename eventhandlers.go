@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -41,13 +43,164 @@ func HandleEnvironmentSetupTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent
 		return err
 	}
 
-	log.Printf("Looking for Crossplane cluster %s file in Keptn git repo...", CrossPlaneFilename)
+	// operations on the same environment are serialized across all replicas of the service
+	lock, err := lockEnvironment(myKeptn, data.Project, data.Stage, SetupOperation)
+	if errors.Is(err, ErrOperationCancelled) {
+		return abortEnvironmentSetup(myKeptn, err, EnvironmentSetupFinishedDetails{})
+	}
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not lock environment: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	defer lock.Unlock()
+
+	log.Printf("Looking for Crossplane resources in directory %s of Keptn git repo...", CrossPlaneDirectory)
+
+	// load crossplane files
+	var keptnResourceContent []byte
+	var files []string
+	err = retryInteraction(lock.Context(), myKeptn, "load the crossplane files", func() error {
+		var err error
+		keptnResourceContent, files, err = LoadCrossplaneManifest(myKeptn, data.EnvironmentSetup.HelmChartProperties)
+		return err
+	})
+
+	if err != nil {
+		logMessage := fmt.Sprintf("No crossplane resources found in %s for service %s in stage %s in project %s: %s", CrossPlaneDirectory, data.Service, data.Stage, data.Project, err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	log.Printf("Crossplane files found: %s", strings.Join(files, ", "))
+
+	var serviceConfig *ServiceConfig
+	err = retryInteraction(lock.Context(), myKeptn, "load "+ServiceConfigFilename, func() error {
+		var err error
+		serviceConfig, err = GetServiceConfig(myKeptn)
+		return err
+	})
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not load %s: %s", ServiceConfigFilename, err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+
+	// select the composition of the stage and validate the manifest against the installed XRDs before touching any infrastructure
+	manifest, err := parseManifest(keptnResourceContent)
+	var xrds []manifestObject
+	if err == nil {
+		err = retryInteraction(lock.Context(), myKeptn, "list the CompositeResourceDefinitions", func() error {
+			var err error
+			xrds, err = ListCompositeResourceDefinitions(lock.Context())
+			return err
+		})
+	}
+	if err == nil {
+		if composition := SelectComposition(manifest, xrds, data.EnvironmentSetup.CompositionProperties, serviceConfig.Stage(data.Stage)); composition != "" {
+			log.Printf("Using %s for stage %s", composition, data.Stage)
+		}
+		err = ValidateManifest(lock.Context(), manifest, xrds)
+	}
+	if err != nil {
+		logMessage := fmt.Sprintf("Crossplane files %s are invalid: %s", strings.Join(files, ", "), err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	log.Printf("Crossplane manifest is valid.")
+
+	onFailure, err := OnFailurePolicy(data.EnvironmentSetup.OnFailure, serviceConfig.Stage(data.Stage))
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not set up environment: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
 
-	// load crossplane file
-	keptnResourceContent, err := myKeptn.GetKeptnResource(CrossPlaneFilename)
+		return err
+	}
+
+	// claims are namespaced, hence they are applied into a namespace per project
+	environment := FindEnvironmentResource(manifest, xrds)
+	claimNamespace := AssignClaimNamespace(manifest, xrds, data.Project)
+
+	// label all objects so that objects removed from the crossplane file can be pruned later on
+	applySetID := ApplySetID(data.Project, data.Stage)
+	LabelApplySet(manifest, applySetID)
 
+	// the Keptn sequence the objects are linked back to
+	owner := ownership{
+		Project:      data.Project,
+		Stage:        data.Stage,
+		Service:      data.Service,
+		KeptnContext: myKeptn.KeptnContext,
+		TriggeredID:  incomingEvent.ID(),
+		ManifestHash: ManifestHash(keptnResourceContent),
+		Render:       renderInputs{data.EnvironmentSetup.HelmChartProperties, data.EnvironmentSetup.CompositionProperties}.String(),
+	}
+
+	// protected environments are neither replaced nor pruned by a setup, only a teardown may delete them
+	var protected []string
+	err = retryInteraction(lock.Context(), myKeptn, "check whether the environment is protected", func() error {
+		var err error
+		protected, err = FindProtectedEnvironments(lock.Context(), manifest, xrds, applySetID)
+		return err
+	})
 	if err != nil {
-		logMessage := fmt.Sprintf("No %s file found for service %s in stage %s in project %s", CrossPlaneFilename, data.Service, data.Stage, data.Project)
+		logMessage := fmt.Sprintf("Could not check whether the environment is protected: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	keepProtected := keepProtectedEnvironments(xrds, data.Stage, serviceConfig.Stage(data.Stage), protected)
+
+	// nothing has been changed yet, hence a cancelled setup can stop right away
+	if err := lock.Err(); err != nil {
+		return abortEnvironmentSetup(myKeptn, err, EnvironmentSetupFinishedDetails{})
+	}
+
+	switch data.EnvironmentSetup.Mode {
+	case "", EnvironmentSetupModeApply:
+	case EnvironmentSetupModePlan:
+		return planEnvironmentSetup(lock.Context(), myKeptn, manifest, applySetID, owner, keepProtected)
+	default:
+		logMessage := fmt.Sprintf("Unknown environment-setup mode %s, supported modes are %s and %s", data.EnvironmentSetup.Mode, EnvironmentSetupModeApply, EnvironmentSetupModePlan)
 		log.Printf(logMessage)
 
 		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
@@ -58,11 +211,136 @@ func HandleEnvironmentSetupTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent
 
 		return err
 	}
-	log.Printf("Crossplane file found.")
+
+	// take a ready environment from the pool of the stage instead of waiting for a new one
+	pool := serviceConfig.Stage(data.Stage).Pool
+	var poolTemplate manifestObject
+	var pooled string
+	if pool.Enabled() && environment != nil {
+		if environment.claim {
+			log.Printf("Pools are only supported for composites, creating %s", environment)
+		} else {
+			poolTemplate = manifestObject(convertYAMLValue(map[string]interface{}(environment.object)).(map[string]interface{}))
+
+			// a stage set up again keeps its environment, claiming another one would prune the running environment
+			var hasEnvironment bool
+			err = retryInteraction(lock.Context(), myKeptn, "look up the environment of the stage", func() error {
+				var err error
+				pooled, hasEnvironment, err = ReuseAppliedEnvironment(lock.Context(), environment, applySetID)
+				return err
+			})
+			if err != nil {
+				logMessage := fmt.Sprintf("Could not set up environment: %s", err.Error())
+				log.Printf(logMessage)
+
+				_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+					Status:  keptnv2.StatusErrored,
+					Result:  keptnv2.ResultFailed,
+					Message: logMessage,
+				}, ServiceName)
+
+				return err
+			}
+
+			if pooled != "" {
+				log.Printf("Keeping environment %s claimed from pool by a previous setup", pooled)
+			} else if hasEnvironment {
+				log.Printf("Keeping the environment of stage %s, which has not been claimed from the pool", data.Stage)
+			} else if pooled, err = ClaimFromPool(lock.Context(), environment); err != nil {
+				log.Printf("Could not claim environment from pool, creating a new one: %s", err.Error())
+			} else if pooled != "" {
+				logMessage := fmt.Sprintf("Claimed environment %s from pool", pooled)
+				log.Printf(logMessage)
+
+				_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+					Message: logMessage,
+				}, ServiceName)
+				if err != nil {
+					log.Printf("Error: %s", err)
+				}
+			} else {
+				log.Printf("No environment of the pool is ready, creating %s", environment)
+			}
+		}
+	}
+
+	// link all objects back to the Keptn sequence that applies them
+	AddOwnership(manifest, owner)
+
+	if claimNamespace != "" {
+		err = retryInteraction(lock.Context(), myKeptn, "prepare namespace "+claimNamespace, func() error {
+			return EnsureClaimNamespace(lock.Context(), claimNamespace, data.Project)
+		})
+		if err != nil {
+			logMessage := fmt.Sprintf("Error while preparing namespace for claims: %s", err.Error())
+			log.Printf(logMessage)
+
+			_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: logMessage,
+			}, ServiceName)
+
+			return err
+		}
+	}
+
+	// apply the policy of the task to an environment that already exists, environments of the pool are claimed already
+	var existing string
+	if environment != nil && pooled == "" {
+		protection := EnvironmentProtection(data.Stage, serviceConfig.Stage(data.Stage), environment.String(), protected)
+		existing, err = PrepareExistingEnvironment(lock.Context(), environment, data.EnvironmentSetup.Existing, protection)
+		if err != nil {
+			logMessage := fmt.Sprintf("Could not set up environment: %s", err.Error())
+			log.Printf(logMessage)
+
+			_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: logMessage,
+			}, ServiceName)
+
+			return err
+		}
+
+		logMessage := fmt.Sprintf("The %s will be %s", environment, existing)
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+			Message: logMessage,
+		}, ServiceName)
+		if err != nil {
+			log.Printf("Error: %s", err)
+		}
+	}
+
+	// an adopted environment keeps its spec, it is only linked to the apply set and the Keptn sequence
+	applied := manifest
+	if existing == EnvironmentAdopted {
+		err = retryInteraction(lock.Context(), myKeptn, "adopt the "+environment.String(), func() error {
+			return AdoptEnvironment(lock.Context(), environment, applySetID, owner)
+		})
+		if err != nil {
+			logMessage := fmt.Sprintf("Could not set up environment: %s", err.Error())
+			log.Printf(logMessage)
+
+			_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: logMessage,
+			}, ServiceName)
+
+			return err
+		}
+		applied = withoutEnvironment(manifest, environment)
+	}
 
 	// store crossplane file locally
-	_ = os.Mkdir("crossplane", 0644)
-	err = ioutil.WriteFile(CrossPlaneFilename, []byte(keptnResourceContent), 0644)
+	var manifestFilename string
+	renderedManifest, err := marshalManifest(applied)
+	if err == nil {
+		manifestFilename, err = WriteTempFile(RenderedManifestPattern, renderedManifest)
+	}
 	if err != nil {
 		logMessage := fmt.Sprintf("Could not store crossplane file locally: %s", err.Error())
 		log.Printf(logMessage)
@@ -74,75 +352,234 @@ func HandleEnvironmentSetupTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent
 
 		return err
 	}
-	log.Printf("Crossplane file stored locally.")
+	defer os.Remove(manifestFilename)
+	log.Printf("Crossplane manifest stored locally.")
+
+	// remember what this attempt creates, so that it can be rolled back if the setup fails
+	rollback := newSetupRollback(lock.Context(), onFailure, manifest)
 
 	log.Printf("Now applying crossplane file.")
 	// now execute crossplane
-	_, err = ExecuteCommand("kubectl", []string{"apply", "-f", CrossPlaneFilename})
+	if len(applied) > 0 {
+		err = retryInteraction(lock.Context(), myKeptn, "apply the crossplane file", func() error {
+			_, err := ExecuteCommand(lock.Context(), kubectlCommand, []string{"apply", "-f", manifestFilename})
+			return err
+		})
+	}
 
 	if err != nil {
 		logMessage := fmt.Sprintf("Error while applying crossplane cluster manifest: %s", err.Error())
+		return failEnvironmentSetup(myKeptn, logMessage, EnvironmentSetupFinishedDetails{Mode: EnvironmentSetupModeApply}, rollback)
+	}
+	log.Printf("Crossplane manifest applied.")
+
+	// delete objects of this project and stage that have been removed from the crossplane file
+	var pruned []string
+	err = retryInteraction(lock.Context(), myKeptn, "prune objects removed from the crossplane file", func() error {
+		prunedNow, err := PruneApplySet(lock.Context(), applySetID, manifest, keepProtected)
+		pruned = append(pruned, prunedNow...)
+		return err
+	})
+	if err != nil {
+		logMessage := fmt.Sprintf("Error while pruning objects removed from the crossplane cluster manifest: %s", err.Error())
+		return failEnvironmentSetup(myKeptn, logMessage, EnvironmentSetupFinishedDetails{
+			Mode:   EnvironmentSetupModeApply,
+			Pruned: pruned,
+		}, rollback)
+	}
+	if len(pruned) > 0 {
+		logMessage := fmt.Sprintf("Pruned objects removed from the crossplane file: %s", strings.Join(pruned, ", "))
 		log.Printf(logMessage)
 
-		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
-			Status:  keptnv2.StatusErrored,
-			Result:  keptnv2.ResultFailed,
+		_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
 			Message: logMessage,
 		}, ServiceName)
+		if err != nil {
+			log.Printf("Error: %s", err)
+		}
+	}
 
-		return err
+	// replenish the pool in the background, the claimed environment is not part of it anymore
+	if poolTemplate != nil {
+		go ReplenishPool(poolTemplate, pool.Size)
 	}
-	log.Printf("Crossplane file applied.")
 
 	// waiting for cluster to be ready
 	// wait for secret
 	var secretName string
-	secretDefaultName := "kubeconfig-keptn-crossplane"
-	secretNamespace := "crossplane-system"
-	// wait as usually the secret is not immediately available
-	time.Sleep(10 * time.Second)
+	secretDefaultName, secretNamespace := environment.ConnectionSecret()
+	var composite string
+	if environment != nil && !environment.claim {
+		composite = environment.object.name()
+	}
+	// wait as usually the secret is not immediately available, environments of the pool and adopted ones are ready already
+	appliedDetails := EnvironmentSetupFinishedDetails{
+		Mode:     EnvironmentSetupModeApply,
+		Pruned:   pruned,
+		Pooled:   pooled != "",
+		Existing: existing,
+	}
+	if pooled == "" && existing != EnvironmentAdopted {
+		if err := sleepContext(lock.Context(), 10*time.Second); err != nil {
+			return abortEnvironmentSetup(myKeptn, lock.Err(), appliedDetails)
+		}
+	}
+	waitingSince := time.Now()
 	for secretName != secretDefaultName {
+		// claims are bound to a composite resource by Crossplane, which is tracked in spec.resourceRef
+		if environment != nil && environment.claim && composite == "" {
+			composite, err = environment.BoundComposite(lock.Context())
+			if err != nil {
+				log.Printf("Could not get composite bound to %s: %s", environment, err.Error())
+			} else if composite != "" {
+				logMessage := fmt.Sprintf("The %s is bound to composite %s", environment, composite)
+				log.Printf(logMessage)
+
+				_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+					Message: logMessage,
+				}, ServiceName)
+				if err != nil {
+					log.Printf("Error: %s", err)
+				}
+			}
+		}
+
 		log.Printf("Checking availability of secret %s in namespace %s", secretDefaultName, secretNamespace)
-		secretName, err = CheckAvailabilityOfSecret(secretDefaultName, secretNamespace)
+		secretName, err = CheckAvailabilityOfSecret(lock.Context(), secretDefaultName, secretNamespace)
 		log.Printf("Retrieved secret name: %s", secretName)
 
-		if err != nil {
-			logMessage := fmt.Sprintf("Could not retrieve secret %s yet - waiting for 30 seconds", secretDefaultName)
-			log.Printf(logMessage)
+		if err == nil && secretName == secretDefaultName {
+			break
+		}
 
-			// we will consider this a
-			_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
-				Message: logMessage,
-			}, ServiceName)
-			if err != nil {
-				log.Printf("Error: %s", err)
-			}
-			// interval before we check the chaosengine status again
-			time.Sleep(30 * time.Second)
+		// the timeout applies to every check that did not find the secret, not only to failed ones
+		if time.Since(waitingSince) > EnvironmentSetupTimeout {
+			logMessage := fmt.Sprintf("Timed out after %s waiting for secret %s in namespace %s", EnvironmentSetupTimeout, secretDefaultName, secretNamespace)
+			appliedDetails.Composite = composite
+			return failEnvironmentSetup(myKeptn, logMessage, appliedDetails, rollback)
 		}
 
+		logMessage := fmt.Sprintf("Could not retrieve secret %s yet - waiting for 30 seconds", secretDefaultName)
+		log.Printf(logMessage)
+
+		// we will consider this a
+		_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+			Message: logMessage,
+		}, ServiceName)
+		if err != nil {
+			log.Printf("Error: %s", err)
+		}
+		// interval before we check the chaosengine status again
+		if err := sleepContext(lock.Context(), 30*time.Second); err != nil {
+			appliedDetails.Composite = composite
+			return abortEnvironmentSetup(myKeptn, lock.Err(), appliedDetails)
+		}
 	}
 	log.Printf("Secret found. Continuing...")
+	appliedDetails.Composite = composite
 
 	// first getting the kubeconfig
 	// kubectl get secrets cluster-details-keptn-crossplane -n default -o jsonpath={'.data.kubeconfig'} | base64 -d > kubeconfig
-	kubeconfigEncoded, err := ExecuteCommand("kubectl", []string{"get", "secrets", secretName, "-n", secretNamespace, "-o", "jsonpath={.data.kubeconfig}"})
+	var kubeconfigEncoded string
+	err = retryInteraction(lock.Context(), myKeptn, "get the kubeconfig from secret "+secretName, func() error {
+		var err error
+		kubeconfigEncoded, err = ExecuteCommand(lock.Context(), kubectlCommand, []string{"get", "secrets", secretName, "-n", secretNamespace, "-o", "jsonpath={.data.kubeconfig}"})
+		return err
+	})
 	if err != nil {
 		logMessage := fmt.Sprintf("Error while getting kubeconfig: %s", err.Error())
-		log.Printf(logMessage)
+		return failEnvironmentSetup(myKeptn, logMessage, appliedDetails, rollback)
 	}
-	//log.Printf(kubeconfigEncoded)
 
 	kubeconfig, err := base64.StdEncoding.DecodeString(kubeconfigEncoded)
 	if err != nil {
 		logMessage := fmt.Sprintf("Could not base64 decode the Kubeconfig: %s", err.Error())
-		log.Printf(logMessage)
-		return err
+		return failEnvironmentSetup(myKeptn, logMessage, appliedDetails, rollback)
 	}
-	err = ioutil.WriteFile("kubeconfig", kubeconfig, 0644)
+	if len(kubeconfig) == 0 {
+		logMessage := fmt.Sprintf("The kubeconfig in secret %s in namespace %s is empty", secretName, secretNamespace)
+		return failEnvironmentSetup(myKeptn, logMessage, appliedDetails, rollback)
+	}
+	kubeconfigFilename, err := WriteTempFile(KubeconfigPattern, kubeconfig)
 	if err != nil {
 		logMessage := fmt.Sprintf("Could not store kubeconfig file locally: %s", err.Error())
+		return failEnvironmentSetup(myKeptn, logMessage, appliedDetails, rollback)
+	}
+	defer os.Remove(kubeconfigFilename)
+
+	// k get nodes --kubeconfig kubeconfig
+	var nodes string
+	err = retryInteraction(lock.Context(), myKeptn, "get the nodes of the environment", func() error {
+		var err error
+		nodes, err = ExecuteCommand(lock.Context(), kubectlCommand, []string{"get", "nodes", "--kubeconfig", kubeconfigFilename})
+		return err
+	})
+	if err != nil {
+		logMessage := fmt.Sprintf("Error while getting the nodes of the environment: %s", err.Error())
+		return failEnvironmentSetup(myKeptn, logMessage, appliedDetails, rollback)
+	}
+	logMessage := nodes
+	log.Printf(logMessage)
+
+	_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+		Message: logMessage,
+	}, ServiceName)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+
+	_, err = myKeptn.SendTaskFinishedEvent(&EnvironmentsetupFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status: keptnv2.StatusSucceeded,
+			Result: keptnv2.ResultPass,
+		},
+		EnvironmentSetup: EnvironmentSetupFinishedDetails{
+			Mode:      EnvironmentSetupModeApply,
+			Pruned:    pruned,
+			Composite: composite,
+			Pooled:    pooled != "",
+			Existing:  existing,
+		},
+	}, ServiceName)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task finished CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	return nil
+}
+
+// planEnvironmentSetup performs a server-side dry-run of the crossplane file and reports the diff against the
+// live objects, as well as the objects of the apply set the apply would prune, without changing anything in the
+// management cluster. Objects keep returns true for are not pruned.
+func planEnvironmentSetup(ctx context.Context, myKeptn *keptnv2.Keptn, manifest []manifestObject, applySetID string, owner ownership, keep func(object manifestObject) bool) error {
+	log.Printf("Planning crossplane file (server-side dry-run).")
+
+	// the keys identifying the sequence change with every run, hence they are kept as applied to not show up in the diff
+	PlanOwnership(ctx, manifest, owner)
+
+	var diff string
+	var changed bool
+	renderedManifest, err := marshalManifest(manifest)
+	if err == nil {
+		var manifestFilename string
+		manifestFilename, err = WriteTempFile(RenderedManifestPattern, renderedManifest)
+		if err == nil {
+			defer os.Remove(manifestFilename)
+			diff, changed, err = DiffManifest(ctx, manifestFilename)
+		}
+	}
+	// objects removed from the crossplane file are deleted by the apply, which kubectl diff does not show
+	var pruned []string
+	if err == nil {
+		pruned, err = PlanPruneApplySet(ctx, applySetID, manifest, keep)
+	}
+	if err != nil {
+		logMessage := fmt.Sprintf("Error while planning crossplane cluster manifest: %s", err.Error())
 		log.Printf(logMessage)
+
 		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
 			Status:  keptnv2.StatusErrored,
 			Result:  keptnv2.ResultFailed,
@@ -152,18 +589,18 @@ func HandleEnvironmentSetupTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent
 		return err
 	}
 
-	if string(kubeconfig) == "" {
-		logMessage := "KubeConfig is empty"
-		log.Printf(logMessage)
+	logMessage := "Plan: no changes, the environment is up-to-date"
+	if changed {
+		logMessage = "Plan: applying the crossplane file would change the following objects:\n" + diff
 	}
-
-	// k get nodes --kubeconfig kubeconfig
-	nodes, err := ExecuteCommand("kubectl", []string{"get", "nodes", "--kubeconfig", "kubeconfig"})
-	if err != nil {
-		logMessage := fmt.Sprintf("Error while getting kubeconfig: %s", err.Error())
-		log.Printf(logMessage)
+	if len(pruned) > 0 {
+		prunedMessage := "Plan: applying the crossplane file would delete the following objects removed from it: " + strings.Join(pruned, ", ")
+		if changed {
+			logMessage += "\n" + prunedMessage
+		} else {
+			logMessage = prunedMessage
+		}
 	}
-	logMessage := nodes
 	log.Printf(logMessage)
 
 	_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
@@ -173,9 +610,17 @@ func HandleEnvironmentSetupTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent
 		log.Printf("Error: %s", err)
 	}
 
-	_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
-		Status: keptnv2.StatusSucceeded,
-		Result: keptnv2.ResultPass,
+	_, err = myKeptn.SendTaskFinishedEvent(&EnvironmentsetupFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusSucceeded,
+			Result:  keptnv2.ResultPass,
+			Message: logMessage,
+		},
+		EnvironmentSetup: EnvironmentSetupFinishedDetails{
+			Mode:   EnvironmentSetupModePlan,
+			Diff:   diff,
+			Pruned: pruned,
+		},
 	}, ServiceName)
 
 	if err != nil {
@@ -187,6 +632,49 @@ func HandleEnvironmentSetupTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent
 	return nil
 }
 
+// failEnvironmentSetup reports a setup that failed after applying the crossplane file, the objects created by the
+// failed attempt are kept or deleted according to the on-failure policy
+func failEnvironmentSetup(myKeptn *keptnv2.Keptn, logMessage string, details EnvironmentSetupFinishedDetails, rollback *setupRollback) error {
+	details.Rollback = rollback.run(context.Background())
+	logMessage = fmt.Sprintf("%s (%s)", logMessage, details.Rollback)
+	log.Printf(logMessage)
+
+	_, err := myKeptn.SendTaskFinishedEvent(&EnvironmentsetupFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		},
+		EnvironmentSetup: details,
+	}, ServiceName)
+
+	return err
+}
+
+// abortEnvironmentSetup reports a setup that has been cancelled by another operation on the environment, e.g., a
+// teardown, as aborted. A setup interrupted by a shutdown of the service is reported as errored, since nobody asked
+// for it to stop.
+func abortEnvironmentSetup(myKeptn *keptnv2.Keptn, cancelled error, details EnvironmentSetupFinishedDetails) error {
+	status := StatusAborted
+	logMessage := fmt.Sprintf("Environment setup aborted: %s", cancelled.Error())
+	if errors.Is(cancelled, ErrServiceShutdown) {
+		status = keptnv2.StatusErrored
+		logMessage = fmt.Sprintf("Environment setup interrupted because the %s shut down before it finished, the environment may be incomplete, please trigger the environment-setup again", ServiceName)
+	}
+	log.Printf(logMessage)
+
+	_, err := myKeptn.SendTaskFinishedEvent(&EnvironmentsetupFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  status,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		},
+		EnvironmentSetup: details,
+	}, ServiceName)
+
+	return err
+}
+
 func HandleEnvironmentTeardownTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *EnvironmentTeardownTriggeredEventData) error {
 	log.Printf("Handling environment-teardown.triggered Event: %s", incomingEvent.Context.GetID())
 
@@ -197,13 +685,19 @@ func HandleEnvironmentTeardownTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEve
 		return err
 	}
 
-	log.Printf("Looking for Crossplane cluster %s file in Keptn git repo...", CrossPlaneFilename)
+	log.Printf("Looking for Crossplane resources in directory %s of Keptn git repo...", CrossPlaneDirectory)
 
-	// load crossplane file
-	keptnResourceContent, err := myKeptn.GetKeptnResource(CrossPlaneFilename)
+	// load crossplane files
+	var keptnResourceContent []byte
+	var files []string
+	err = retryInteraction(context.Background(), myKeptn, "load the crossplane files", func() error {
+		var err error
+		keptnResourceContent, files, err = LoadCrossplaneManifest(myKeptn, data.EnvironmentTeardown.HelmChartProperties)
+		return err
+	})
 
 	if err != nil {
-		logMessage := fmt.Sprintf("No %s file found for service %s in stage %s in project %s", CrossPlaneFilename, data.Service, data.Stage, data.Project)
+		logMessage := fmt.Sprintf("No crossplane resources found in %s for service %s in stage %s in project %s: %s", CrossPlaneDirectory, data.Service, data.Stage, data.Project, err.Error())
 		log.Printf(logMessage)
 
 		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
@@ -214,14 +708,38 @@ func HandleEnvironmentTeardownTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEve
 
 		return err
 	}
-	log.Printf("Crossplane file found.")
+	log.Printf("Crossplane files found: %s", strings.Join(files, ", "))
+
+	// claims have been applied into the namespace of the project, hence they have to be deleted from there as well
+	manifest, err := parseManifest(keptnResourceContent)
+	var xrds []manifestObject
+	if err == nil {
+		err = retryInteraction(context.Background(), myKeptn, "list the CompositeResourceDefinitions", func() error {
+			var err error
+			xrds, err = ListCompositeResourceDefinitions(context.Background())
+			return err
+		})
+	}
+	var serviceConfig *ServiceConfig
+	if err == nil {
+		err = retryInteraction(context.Background(), myKeptn, "load "+ServiceConfigFilename, func() error {
+			var err error
+			serviceConfig, err = GetServiceConfig(myKeptn)
+			return err
+		})
+	}
+	var renderedManifest []byte
+	if err == nil {
+		// the composition is part of the identity of pooled environments, hence it is selected like on setup
+		SelectComposition(manifest, xrds, data.EnvironmentTeardown.CompositionProperties, serviceConfig.Stage(data.Stage))
+		AssignClaimNamespace(manifest, xrds, data.Project)
+		renderedManifest, err = marshalManifest(manifest)
+	}
 
-	// store crossplane file locally
-	_ = os.Mkdir("crossplane", 0644)
-	err = ioutil.WriteFile(CrossPlaneFilename, []byte(keptnResourceContent), 0644)
 	if err != nil {
-		logMessage := fmt.Sprintf("Could not store crossplane file locally: %s", err.Error())
+		logMessage := fmt.Sprintf("Could not prepare crossplane file: %s", err.Error())
 		log.Printf(logMessage)
+
 		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
 			Status:  keptnv2.StatusErrored,
 			Result:  keptnv2.ResultFailed,
@@ -230,14 +748,18 @@ func HandleEnvironmentTeardownTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEve
 
 		return err
 	}
-	log.Printf("Crossplane file stored locally.")
 
-	log.Printf("Now starting to delete cluster based on crossplane file.")
-	// now execute crossplane
-	kubectlresult, err := ExecuteCommand("kubectl", []string{"delete", "-f", CrossPlaneFilename})
-	log.Printf(kubectlresult)
+	// protected stages and environments are only torn down if the task overrides the protection explicitly, this is
+	// checked before locking the environment so that a refused teardown does not cancel a running setup
+	applySetID := ApplySetID(data.Project, data.Stage)
+	var protected []string
+	err = retryInteraction(context.Background(), myKeptn, "check whether the environment is protected", func() error {
+		var err error
+		protected, err = FindProtectedEnvironments(context.Background(), manifest, xrds, applySetID)
+		return err
+	})
 	if err != nil {
-		logMessage := fmt.Sprintf("Error while deleting crossplane cluster manifest: %s", err.Error())
+		logMessage := fmt.Sprintf("Could not check whether the environment is protected: %s", err.Error())
 		log.Printf(logMessage)
 
 		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
@@ -248,25 +770,693 @@ func HandleEnvironmentTeardownTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEve
 
 		return err
 	}
-	log.Printf("Crossplane cluster deleted.")
+	stageConfig := serviceConfig.Stage(data.Stage)
+	if refusal := TeardownRefusal(data.Stage, stageConfig, protected, data.EnvironmentTeardown.OverrideProtection); refusal != "" {
+		log.Printf(refusal)
 
-	_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
-		Status: keptnv2.StatusSucceeded,
-		Result: keptnv2.ResultPass,
-	}, ServiceName)
+		_, err = myKeptn.SendTaskFinishedEvent(&EnvironmentTeardownFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: refusal,
+			},
+			EnvironmentTeardown: EnvironmentTeardownFinishedDetails{
+				Protected: protected,
+				Refused:   true,
+			},
+		}, ServiceName)
 
-	if err != nil {
-		errMsg := fmt.Sprintf("Failed to send task finished CloudEvent (%s), aborting...", err.Error())
-		log.Println(errMsg)
 		return err
 	}
+	if stageConfig.Protected || len(protected) > 0 {
+		logMessage := fmt.Sprintf("Overriding the protection of the environment of stage %s as requested by the task", data.Stage)
+		log.Printf(logMessage)
 
-	return nil
+		_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+			Message: logMessage,
+		}, ServiceName)
+		if err != nil {
+			log.Printf("Error: %s", err)
+		}
+	}
+
+	// operations on the same environment are serialized across all replicas of the service
+	lock, err := lockEnvironment(myKeptn, data.Project, data.Stage, TeardownOperation)
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not lock environment: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	defer lock.Unlock()
+
+	// store crossplane file locally
+	manifestFilename, err := WriteTempFile(RenderedManifestPattern, renderedManifest)
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not store crossplane file locally: %s", err.Error())
+		log.Printf(logMessage)
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	defer os.Remove(manifestFilename)
+	log.Printf("Crossplane manifest stored locally.")
+
+	// environments claimed from the pool are put back into the pool instead of being deleted with the apply set
+	var recycled []string
+	if environment := FindEnvironmentResource(manifest, xrds); environment != nil && stageConfig.Pool.Enabled() {
+		recycled, err = RecyclePoolEnvironments(lock.Context(), environment, applySetID, stageConfig.Pool)
+		if err != nil {
+			logMessage := fmt.Sprintf("Error while recycling environments of the pool: %s", err.Error())
+			log.Printf(logMessage)
+
+			_, err = myKeptn.SendTaskFinishedEvent(&EnvironmentTeardownFinishedEventData{
+				EventData: keptnv2.EventData{
+					Status:  keptnv2.StatusErrored,
+					Result:  keptnv2.ResultFailed,
+					Message: logMessage,
+				},
+				EnvironmentTeardown: EnvironmentTeardownFinishedDetails{
+					Recycled: recycled,
+				},
+			}, ServiceName)
+
+			return err
+		}
+		if len(recycled) > 0 {
+			log.Printf("Recycled environments: %s", strings.Join(recycled, ", "))
+		}
+	}
+
+	log.Printf("Now starting to delete cluster based on crossplane file.")
+	// now execute crossplane, objects that do not exist (e.g., environments claimed from the pool under a different name) are ignored
+	err = retryInteraction(lock.Context(), myKeptn, "delete the crossplane file", func() error {
+		kubectlresult, err := ExecuteCommand(lock.Context(), kubectlCommand, []string{"delete", "-f", manifestFilename, "--ignore-not-found", "--timeout", EnvironmentTeardownTimeout.String()})
+		log.Printf(kubectlresult)
+		return err
+	})
+	if err != nil {
+		logMessage := fmt.Sprintf("Error while deleting crossplane cluster manifest: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	log.Printf("Crossplane cluster deleted.")
+
+	// delete everything else that has been applied for this project and stage
+	var pruned []string
+	err = retryInteraction(lock.Context(), myKeptn, "delete the remaining objects of the crossplane file", func() error {
+		prunedNow, err := PruneApplySet(lock.Context(), applySetID, nil, nil)
+		pruned = append(pruned, prunedNow...)
+		return err
+	})
+	if err != nil {
+		logMessage := fmt.Sprintf("Error while deleting remaining objects of the crossplane cluster manifest: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&EnvironmentTeardownFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: logMessage,
+			},
+			EnvironmentTeardown: EnvironmentTeardownFinishedDetails{
+				Pruned:   pruned,
+				Recycled: recycled,
+			},
+		}, ServiceName)
+
+		return err
+	}
+
+	_, err = myKeptn.SendTaskFinishedEvent(&EnvironmentTeardownFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status: keptnv2.StatusSucceeded,
+			Result: keptnv2.ResultPass,
+		},
+		EnvironmentTeardown: EnvironmentTeardownFinishedDetails{
+			Pruned:    pruned,
+			Recycled:  recycled,
+			Protected: protected,
+		},
+	}, ServiceName)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task finished CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	return nil
+}
+
+func HandleEnvironmentUpdateTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *EnvironmentUpdateTriggeredEventData) error {
+	log.Printf("Handling environment-update.triggered Event: %s", incomingEvent.Context.GetID())
+
+	_, err := myKeptn.SendTaskStartedEvent(data, ServiceName)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task started CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	// operations on the same environment are serialized across all replicas of the service
+	lock, err := lockEnvironment(myKeptn, data.Project, data.Stage, UpdateOperation)
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not lock environment: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	defer lock.Unlock()
+
+	if len(data.EnvironmentUpdate.Parameters) == 0 {
+		logMessage := "No parameters to update, please set the parameters property of the environment-update task"
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+
+	log.Printf("Looking for Crossplane resources in directory %s of Keptn git repo...", CrossPlaneDirectory)
+
+	// the crossplane files identify the environment to update
+	var keptnResourceContent []byte
+	var files []string
+	err = retryInteraction(lock.Context(), myKeptn, "load the crossplane files", func() error {
+		var err error
+		keptnResourceContent, files, err = LoadCrossplaneManifest(myKeptn, data.EnvironmentUpdate.HelmChartProperties)
+		return err
+	})
+
+	if err != nil {
+		logMessage := fmt.Sprintf("No crossplane resources found in %s for service %s in stage %s in project %s: %s", CrossPlaneDirectory, data.Service, data.Stage, data.Project, err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	log.Printf("Crossplane files found: %s", strings.Join(files, ", "))
+
+	manifest, err := parseManifest(keptnResourceContent)
+	var xrds []manifestObject
+	if err == nil {
+		err = retryInteraction(lock.Context(), myKeptn, "list the CompositeResourceDefinitions", func() error {
+			var err error
+			xrds, err = ListCompositeResourceDefinitions(lock.Context())
+			return err
+		})
+	}
+	var serviceConfig *ServiceConfig
+	if err == nil {
+		err = retryInteraction(lock.Context(), myKeptn, "load "+ServiceConfigFilename, func() error {
+			var err error
+			serviceConfig, err = GetServiceConfig(myKeptn)
+			return err
+		})
+	}
+	var environment *environmentResource
+	if err == nil {
+		SelectComposition(manifest, xrds, data.EnvironmentUpdate.CompositionProperties, serviceConfig.Stage(data.Stage))
+		AssignClaimNamespace(manifest, xrds, data.Project)
+		environment = FindEnvironmentResource(manifest, xrds)
+		if environment == nil {
+			err = fmt.Errorf("the crossplane files do not contain a composite resource or claim")
+		}
+	}
+	// the environment is found via its apply set, as it may have been claimed from a pool under another name
+	if err == nil {
+		template := environment
+		err = retryInteraction(lock.Context(), myKeptn, "find the "+template.String(), func() error {
+			var err error
+			environment, err = FindAppliedEnvironment(lock.Context(), template, ApplySetID(data.Project, data.Stage))
+			return err
+		})
+	}
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not find the environment to update: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+
+	// validate the updated parameters against the XRD before touching the environment
+	before, after := MergeParameters(environment.object, data.EnvironmentUpdate.Parameters)
+	updated := manifestObject(convertYAMLValue(map[string]interface{}(environment.object)).(map[string]interface{}))
+	setNestedValue(updated, after, "spec", "parameters")
+	err = ValidateManifest(lock.Context(), []manifestObject{updated}, xrds)
+	if err != nil {
+		logMessage := fmt.Sprintf("The parameters of the %s are invalid: %s", environment, err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+
+	log.Printf("Now updating the parameters of the %s.", environment)
+	changed := time.Now()
+	err = retryInteraction(lock.Context(), myKeptn, "update the "+environment.String(), func() error {
+		return UpdateEnvironment(lock.Context(), environment, data.EnvironmentUpdate.Parameters, ownership{
+			Project:      data.Project,
+			Stage:        data.Stage,
+			Service:      data.Service,
+			KeptnContext: myKeptn.KeptnContext,
+			TriggeredID:  incomingEvent.ID(),
+		})
+	})
+	if err != nil {
+		logMessage := fmt.Sprintf("Error while updating the environment: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+
+	// wait for Crossplane to reconcile the change
+	err = waitForReconciledEnvironment(lock, myKeptn, environment, changed, EnvironmentUpdateTimeout)
+	if err != nil {
+		logMessage := fmt.Sprintf("Error while waiting for the updated environment: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&EnvironmentUpdateFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: logMessage,
+			},
+			EnvironmentUpdate: EnvironmentUpdateFinishedDetails{
+				Environment: environment.object.String(),
+				Before:      before,
+				After:       after,
+			},
+		}, ServiceName)
+
+		return err
+	}
+	log.Printf("The %s is Ready.", environment)
+
+	_, err = myKeptn.SendTaskFinishedEvent(&EnvironmentUpdateFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status: keptnv2.StatusSucceeded,
+			Result: keptnv2.ResultPass,
+		},
+		EnvironmentUpdate: EnvironmentUpdateFinishedDetails{
+			Environment: environment.object.String(),
+			Before:      before,
+			After:       after,
+		},
+	}, ServiceName)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task finished CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	return nil
+}
+
+// HandleActionTriggeredEvent handles the remediation actions scale-environment and recreate-environment for the
+// environment of the project and stage. Other actions are left to other remediation services.
+func HandleActionTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *keptnv2.ActionTriggeredEventData) error {
+	if !IsEnvironmentAction(data.Action.Action) {
+		log.Printf("Ignoring action %s, it is not handled by %s", data.Action.Action, ServiceName)
+		return nil
+	}
+	log.Printf("Handling action.triggered Event for action %s: %s", data.Action.Action, incomingEvent.Context.GetID())
+
+	_, err := myKeptn.SendTaskStartedEvent(data, ServiceName)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task started CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	// operations on the same environment are serialized across all replicas of the service
+	lock, err := lockEnvironment(myKeptn, data.Project, data.Stage, RemediationOperation)
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not lock environment: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	defer lock.Unlock()
+
+	var parameters map[string]interface{}
+	if data.Action.Action == ScaleEnvironmentAction {
+		parameters, err = ScaleParameters(data.Action.Value)
+		if err != nil {
+			logMessage := fmt.Sprintf("Could not scale environment: %s", err.Error())
+			log.Printf(logMessage)
+
+			_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: logMessage,
+			}, ServiceName)
+
+			return err
+		}
+	}
+
+	// the environment is taken from the management cluster via its apply set, the crossplane files are not rendered
+	// as the action does not know the task properties (e.g., the Helm chart) the environment has been set up with
+	var xrds []manifestObject
+	err = retryInteraction(lock.Context(), myKeptn, "list the CompositeResourceDefinitions", func() error {
+		var err error
+		xrds, err = ListCompositeResourceDefinitions(lock.Context())
+		return err
+	})
+	var serviceConfig *ServiceConfig
+	if err == nil {
+		err = retryInteraction(lock.Context(), myKeptn, "load "+ServiceConfigFilename, func() error {
+			var err error
+			serviceConfig, err = GetServiceConfig(myKeptn)
+			return err
+		})
+	}
+	var environment *environmentResource
+	if err == nil {
+		err = retryInteraction(lock.Context(), myKeptn, "find the environment", func() error {
+			var err error
+			environment, err = FindApplySetEnvironment(lock.Context(), xrds, ApplySetID(data.Project, data.Stage))
+			return err
+		})
+	}
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not find the environment of stage %s in project %s: %s", data.Stage, data.Project, err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+
+	var logMessage string
+	changed := time.Now()
+	switch data.Action.Action {
+	case ScaleEnvironmentAction:
+		before, after := MergeParameters(environment.object, parameters)
+		updated := manifestObject(convertYAMLValue(map[string]interface{}(environment.object)).(map[string]interface{}))
+		setNestedValue(updated, after, "spec", "parameters")
+		err = ValidateManifest(lock.Context(), []manifestObject{updated}, xrds)
+		if err == nil {
+			log.Printf("Now scaling the %s.", environment)
+			// the environment stays linked to the sequence that created it
+			err = retryInteraction(lock.Context(), myKeptn, "scale the "+environment.String(), func() error {
+				return UpdateEnvironment(lock.Context(), environment, parameters, ownership{})
+			})
+		}
+		logMessage = fmt.Sprintf("Scaled the %s from %v to %v", environment, before, after)
+	case RecreateEnvironmentAction:
+		// the environment is created again with the composition of the stage, which is validated before deleting it
+		object := environment.object
+		recreated := recreatableCopy(object)
+		SelectComposition([]manifestObject{recreated}, xrds, CompositionProperties{}, serviceConfig.Stage(data.Stage))
+		err = ValidateManifest(lock.Context(), []manifestObject{recreated}, xrds)
+		var protected []string
+		if err == nil {
+			err = retryInteraction(lock.Context(), myKeptn, "check whether the environment is protected", func() error {
+				var err error
+				protected, err = FindProtectedEnvironments(lock.Context(), []manifestObject{object}, xrds, ApplySetID(data.Project, data.Stage))
+				return err
+			})
+		}
+		if err == nil {
+			if protection := EnvironmentProtection(data.Stage, serviceConfig.Stage(data.Stage), object.String(), protected); protection != "" {
+				err = fmt.Errorf("the %s is protected and can not be recreated: %s", environment, protection)
+			}
+		}
+		if err == nil {
+			log.Printf("Now recreating the %s.", environment)
+			err = retryInteraction(lock.Context(), myKeptn, "delete the "+environment.String(), func() error {
+				return DeleteObject(lock.Context(), object.resource(), object.name(), object.namespace())
+			})
+		}
+		if err == nil {
+			// the environment is created again once Crossplane deleted it, applying it before would update the
+			// environment that is being deleted
+			err = WaitForDeletion(lock.Context(), object.resource(), object.name(), object.namespace(), EnvironmentRemediationTimeout)
+		}
+		if err == nil {
+			err = retryInteraction(lock.Context(), myKeptn, "create the "+environment.String(), func() error {
+				return ApplyObjects(lock.Context(), []manifestObject{recreated})
+			})
+		}
+		logMessage = fmt.Sprintf("Recreated the %s", environment)
+	}
+	if err == nil {
+		err = waitForReconciledEnvironment(lock, myKeptn, environment, changed, EnvironmentRemediationTimeout)
+	}
+	if err != nil {
+		logMessage := fmt.Sprintf("Error while executing action %s: %s", data.Action.Action, err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: logMessage,
+		}, ServiceName)
+
+		return err
+	}
+	log.Printf(logMessage)
+
+	_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.ActionFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusSucceeded,
+			Result:  keptnv2.ResultPass,
+			Message: logMessage,
+		},
+	}, ServiceName)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task finished CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	return nil
+}
+
+// HandleGetSLITriggeredEvent provides infrastructure SLIs of the environment of the Keptn context
+func HandleGetSLITriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *keptnv2.GetSLITriggeredEventData) error {
+	if data.GetSLI.SLIProvider != ServiceName {
+		log.Printf("Ignoring get-sli.triggered Event for SLI provider %s", data.GetSLI.SLIProvider)
+		return nil
+	}
+	log.Printf("Handling get-sli.triggered Event: %s", incomingEvent.Context.GetID())
+
+	_, err := myKeptn.SendTaskStartedEvent(data, ServiceName)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task started CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	var xrds []manifestObject
+	err = retryInteraction(context.Background(), myKeptn, "list the CompositeResourceDefinitions", func() error {
+		var err error
+		xrds, err = ListCompositeResourceDefinitions(context.Background())
+		return err
+	})
+	var environment *environmentResource
+	if err == nil {
+		err = retryInteraction(context.Background(), myKeptn, "find the environment of the Keptn context", func() error {
+			var err error
+			environment, err = FindContextEnvironment(context.Background(), xrds, myKeptn.KeptnContext, ApplySetID(data.Project, data.Stage))
+			return err
+		})
+	}
+	if err != nil {
+		logMessage := fmt.Sprintf("Could not find the environment to retrieve SLIs for: %s", err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.GetSLIFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: logMessage,
+			},
+			GetSLI: keptnv2.GetSLIFinished{
+				Start: data.GetSLI.Start,
+				End:   data.GetSLI.End,
+			},
+		}, ServiceName)
+
+		return err
+	}
+
+	log.Printf("Retrieving SLIs %s of the %s", strings.Join(data.GetSLI.Indicators, ", "), environment)
+	indicatorValues := GetSLIValues(context.Background(), environment, data.GetSLI.Indicators, time.Now())
+
+	result := keptnv2.ResultPass
+	var failed []string
+	for _, value := range indicatorValues {
+		if !value.Success {
+			log.Printf("Could not retrieve SLI %s: %s", value.Metric, value.Message)
+			failed = append(failed, value.Metric)
+			result = keptnv2.ResultFailed
+		}
+	}
+	var logMessage string
+	if len(failed) > 0 {
+		logMessage = fmt.Sprintf("Could not retrieve SLIs %s", strings.Join(failed, ", "))
+	}
+
+	_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.GetSLIFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusSucceeded,
+			Result:  result,
+			Message: logMessage,
+		},
+		GetSLI: keptnv2.GetSLIFinished{
+			Start:           data.GetSLI.Start,
+			End:             data.GetSLI.End,
+			IndicatorValues: indicatorValues,
+		},
+	}, ServiceName)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task finished CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	return nil
+}
+
+// waitForReconciledEnvironment waits until Crossplane has reconciled the environment back to Ready and reports the
+// progress in status.changed events. It usually takes a moment until the Ready condition reflects a change. Waiting
+// stops if the operation holding the lock of the environment is cancelled.
+func waitForReconciledEnvironment(lock *EnvironmentLock, myKeptn *keptnv2.Keptn, environment *environmentResource, changed time.Time, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if err := sleepContext(lock.Context(), 10*time.Second); err != nil {
+		return lock.Err()
+	}
+	for {
+		live, err := GetObject(lock.Context(), environment.object.resource(), environment.object.name(), environment.object.namespace())
+		if err != nil {
+			log.Printf("Could not get %s: %s", environment, err.Error())
+		} else if IsReconciled(live, changed) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the %s did not become Ready within %s", environment, timeout)
+		}
+
+		logMessage := fmt.Sprintf("The %s is not Ready yet - waiting for 30 seconds", environment)
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+			Message: logMessage,
+		}, ServiceName)
+		if err != nil {
+			log.Printf("Error: %s", err)
+		}
+		if err := sleepContext(lock.Context(), 30*time.Second); err != nil {
+			return lock.Err()
+		}
+	}
+}
+
+// lockEnvironment locks the environment of the project and stage for the operation, waiting for another operation on
+// it is reported in a status.changed event
+func lockEnvironment(myKeptn *keptnv2.Keptn, project string, stage string, operation EnvironmentOperation) (*EnvironmentLock, error) {
+	return LockEnvironment(context.Background(), ApplySetID(project, stage), operation, func() {
+		logMessage := fmt.Sprintf("Waiting for another operation on the environment of stage %s in project %s to finish", stage, project)
+		if operation.Preempting {
+			logMessage = fmt.Sprintf("Cancelling a running environment setup or waiting for another operation on the environment of stage %s in project %s to finish", stage, project)
+		}
+		log.Printf(logMessage)
+
+		_, err := myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+			Message: logMessage,
+		}, ServiceName)
+		if err != nil {
+			log.Printf("Error: %s", err)
+		}
+	})
+}
+
+// retryInteraction runs an interaction of the handler with the management cluster or Keptn and retries it according
+// to the DefaultRetryPolicy if it fails with a transient error, every retry is reported in a status.changed event
+func retryInteraction(ctx context.Context, myKeptn *keptnv2.Keptn, description string, interaction func() error) error {
+	return Retry(ctx, DefaultRetryPolicy, interaction, func(attempt int, err error, backoff time.Duration) {
+		logMessage := fmt.Sprintf("Attempt %d of %d to %s failed, retrying in %s: %s", attempt, DefaultRetryPolicy.Attempts, description, backoff, err.Error())
+		log.Printf(logMessage)
+
+		_, err = myKeptn.SendTaskStatusChangedEvent(&keptnv2.EventData{
+			Message: logMessage,
+		}, ServiceName)
+		if err != nil {
+			log.Printf("Error: %s", err)
+		}
+	})
 }
 
-// ExecuteCommand exectues the command using the args
-func ExecuteCommand(command string, args []string) (string, error) {
-	cmd := exec.Command(command, args...)
+// ExecuteCommand exectues the command using the args, the command is killed once the context is done
+func ExecuteCommand(ctx context.Context, command string, args []string) (string, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return string(out), fmt.Errorf("Error executing command %s %s: %s\n%s", command, strings.Join(args, " "), err.Error(), string(out))
@@ -295,8 +1485,8 @@ func DownloadFile(filepath string, url string) error {
 	return err
 }
 
-func CheckAvailabilityOfSecret(secretname string, namespace string) (string, error) {
-	secretname, err := ExecuteCommand("kubectl", []string{"get", "secrets", secretname, "-n", namespace, "-o", "jsonpath='{.metadata.name}'"})
+func CheckAvailabilityOfSecret(ctx context.Context, secretname string, namespace string) (string, error) {
+	secretname, err := ExecuteCommand(ctx, kubectlCommand, []string{"get", "secrets", secretname, "-n", namespace, "-o", "jsonpath='{.metadata.name}'"})
 
 	if err != nil {
 		return "", err
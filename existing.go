@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Policies for an environment that already exists in the management cluster, set by the existing task property
+const (
+	// ExistingPolicyCreateOnly fails the setup if the environment already exists
+	ExistingPolicyCreateOnly = "create-only"
+	// ExistingPolicyAdopt reuses the environment if it is Ready and labels it for the Keptn sequence
+	ExistingPolicyAdopt = "adopt"
+	// ExistingPolicyReplace deletes the environment and creates it again
+	ExistingPolicyReplace = "replace"
+)
+
+// Outcomes of the setup for the environment, as reported in the environment-setup.finished event
+const (
+	EnvironmentCreated  = "created"
+	EnvironmentUpdated  = "updated"
+	EnvironmentAdopted  = "adopted"
+	EnvironmentReplaced = "replaced"
+)
+
+// PrepareExistingEnvironment applies the policy to the environment if it already exists in the management cluster.
+// Without a policy, an existing environment is updated by applying the manifest. It returns the outcome for the
+// environment, or an error if the policy does not allow to continue. protection tells why the environment must not be
+// deleted, if it is protected, in which case it is not replaced.
+func PrepareExistingEnvironment(ctx context.Context, environment *environmentResource, policy string, protection string) (string, error) {
+	switch policy {
+	case "", ExistingPolicyCreateOnly, ExistingPolicyAdopt, ExistingPolicyReplace:
+	default:
+		return "", fmt.Errorf("unknown policy %s for existing environments, supported policies are %s, %s and %s", policy, ExistingPolicyCreateOnly, ExistingPolicyAdopt, ExistingPolicyReplace)
+	}
+
+	object := environment.object
+	live, err := GetObject(ctx, object.resource(), object.name(), object.namespace())
+	if err != nil {
+		if IsNotFoundError(err) {
+			return EnvironmentCreated, nil
+		}
+		return "", fmt.Errorf("could not look up %s: %s", environment, err.Error())
+	}
+
+	switch policy {
+	case ExistingPolicyCreateOnly:
+		return "", fmt.Errorf("the %s already exists%s", environment, describeOwner(live))
+	case ExistingPolicyAdopt:
+		if !IsReady(live) {
+			return "", fmt.Errorf("the %s exists but is not Ready and can not be adopted", environment)
+		}
+		log.Printf("Adopting %s%s", environment, describeOwner(live))
+		return EnvironmentAdopted, nil
+	case ExistingPolicyReplace:
+		if protection != "" {
+			return "", fmt.Errorf("the %s is protected and can not be replaced: %s", environment, protection)
+		}
+		log.Printf("Deleting %s%s to replace it", environment, describeOwner(live))
+		if err := DeleteObject(ctx, object.resource(), object.name(), object.namespace()); err != nil {
+			return "", fmt.Errorf("could not delete %s to replace it: %s", environment, err.Error())
+		}
+		if err := WaitForDeletion(ctx, object.resource(), object.name(), object.namespace(), EnvironmentSetupTimeout); err != nil {
+			return "", fmt.Errorf("could not replace %s: %w", environment, err)
+		}
+		return EnvironmentReplaced, nil
+	}
+	return EnvironmentUpdated, nil
+}
+
+// AdoptEnvironment links the live environment to the apply set and the Keptn sequence by setting the apply set and
+// ownership labels and annotations. Apart from them, the adopted environment is left untouched.
+func AdoptEnvironment(ctx context.Context, environment *environmentResource, applySetID string, owner ownership) error {
+	labels := map[string]interface{}{ApplySetLabel: applySetID}
+	for key, value := range owner.labels() {
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	annotations := map[string]interface{}{}
+	for key, value := range owner.annotations() {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+
+	object := environment.object
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	}
+	if err := PatchObject(ctx, object.resource(), object.name(), object.namespace(), patch); err != nil {
+		return fmt.Errorf("could not adopt %s: %s", environment, err.Error())
+	}
+	return nil
+}
+
+// withoutEnvironment returns the objects of the manifest except for the environment
+func withoutEnvironment(objects []manifestObject, environment *environmentResource) []manifestObject {
+	remaining := make([]manifestObject, 0, len(objects))
+	for _, object := range objects {
+		if object.resource() == environment.object.resource() && object.name() == environment.object.name() && object.namespace() == environment.object.namespace() {
+			continue
+		}
+		remaining = append(remaining, object)
+	}
+	return remaining
+}
+
+// describeOwner returns a description of the Keptn sequence the live object has been applied for, if any
+func describeOwner(live manifestObject) string {
+	owner := ownerOf(live)
+	if owner.KeptnContext == "" {
+		return " and is not managed by Keptn"
+	}
+	return fmt.Sprintf(" and belongs to Keptn context %s of project %s, stage %s", owner.KeptnContext, owner.Project, owner.Stage)
+}
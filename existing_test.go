@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPrepareExistingEnvironmentUnknownPolicy(t *testing.T) {
+	environment := &environmentResource{object: loadTestManifest(t, "demo/cluster.yaml")[0]}
+
+	_, err := PrepareExistingEnvironment(context.Background(), environment, "overwrite", "")
+	if err == nil || !strings.Contains(err.Error(), "unknown policy overwrite") {
+		t.Errorf("PrepareExistingEnvironment() error = %v, want unknown policy", err)
+	}
+}
+
+func TestDescribeOwner(t *testing.T) {
+	foreign := manifestObject{}
+	if got := describeOwner(foreign); got != " and is not managed by Keptn" {
+		t.Errorf("describeOwner() = %q", got)
+	}
+
+	owned := manifestObject{}
+	owned.setLabel(KeptnContextLabel, "a-context")
+	owned.setLabel(ProjectLabel, "sockshop")
+	owned.setLabel(StageLabel, "dev")
+	if got, want := describeOwner(owned), " and belongs to Keptn context a-context of project sockshop, stage dev"; got != want {
+		t.Errorf("describeOwner() = %q, want %q", got, want)
+	}
+}
+
+func TestPrepareExistingEnvironment(t *testing.T) {
+	ready := map[string]interface{}{
+		"conditions": []interface{}{map[string]interface{}{"type": "Ready", "status": "True"}},
+	}
+
+	tests := []struct {
+		name        string
+		policy      string
+		status      map[string]interface{}
+		missing     bool
+		protection  string
+		want        string
+		wantErr     string
+		wantDeleted bool
+	}{
+		{name: "missing environment is created", policy: ExistingPolicyCreateOnly, missing: true, want: EnvironmentCreated},
+		{name: "create-only fails for an existing environment", policy: ExistingPolicyCreateOnly, wantErr: "already exists and is not managed by Keptn"},
+		{name: "adopt fails if the environment is not Ready", policy: ExistingPolicyAdopt, wantErr: "is not Ready"},
+		{name: "adopt a Ready environment", policy: ExistingPolicyAdopt, status: ready, want: EnvironmentAdopted},
+		{name: "replace deletes the environment", policy: ExistingPolicyReplace, want: EnvironmentReplaced, wantDeleted: true},
+		{name: "replace fails for a protected environment", policy: ExistingPolicyReplace, protection: "stage dev is protected", wantErr: "is protected and can not be replaced: stage dev is protected"},
+		{name: "update by default", policy: "", want: EnvironmentUpdated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := loadTestManifest(t, "demo/cluster.yaml")[0]
+			setNestedValue(live, "large", "spec", "parameters", "nodeSize")
+			if tt.status != nil {
+				live["status"] = tt.status
+			}
+			var objects []manifestObject
+			if !tt.missing {
+				objects = append(objects, live)
+			}
+			memory := useMemoryCluster(t, objects...)
+
+			environment := &environmentResource{object: loadTestManifest(t, "demo/cluster.yaml")[0]}
+			got, err := PrepareExistingEnvironment(context.Background(), environment, tt.policy, tt.protection)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("PrepareExistingEnvironment() error = %v, want %s", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("PrepareExistingEnvironment() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("PrepareExistingEnvironment() = %s, want %s", got, tt.want)
+			}
+			if deleted := len(memory.deleted) > 0; deleted != tt.wantDeleted {
+				t.Errorf("PrepareExistingEnvironment() deleted %v, want deletion %t", memory.deleted, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestAdoptEnvironment(t *testing.T) {
+	live := loadTestManifest(t, "demo/cluster.yaml")[0]
+	setNestedValue(live, "large", "spec", "parameters", "nodeSize")
+	live.setLabel("team", "platform")
+	memory := useMemoryCluster(t, live)
+
+	manifest := loadTestManifest(t, "demo/cluster.yaml")
+	environment := &environmentResource{object: manifest[0]}
+	environment.object.setLabel("team", "keptn")
+	owner := ownership{Project: "sockshop", Stage: "dev", Service: "carts", KeptnContext: "a-context", TriggeredID: "an-id"}
+	applySetID := ApplySetID("sockshop", "dev")
+
+	if err := AdoptEnvironment(context.Background(), environment, applySetID, owner); err != nil {
+		t.Fatalf("AdoptEnvironment() error = %v", err)
+	}
+
+	adopted := memory.object(live.resource(), live.name(), "")
+	if got := nestedString(adopted, "spec", "parameters", "nodeSize"); got != "large" {
+		t.Errorf("AdoptEnvironment() changed spec.parameters.nodeSize to %s", got)
+	}
+	if got := nestedString(adopted, "metadata", "labels", "team"); got != "platform" {
+		t.Errorf("AdoptEnvironment() changed the label team to %s", got)
+	}
+	if got := nestedString(adopted, "metadata", "labels", ApplySetLabel); got != applySetID {
+		t.Errorf("AdoptEnvironment() apply set label = %s, want %s", got, applySetID)
+	}
+	if got := ownerOf(adopted); got != owner {
+		t.Errorf("AdoptEnvironment() owner = %+v, want %+v", got, owner)
+	}
+	if len(memory.applied) > 0 {
+		t.Errorf("AdoptEnvironment() applied %v", memory.applied)
+	}
+
+	if remaining := withoutEnvironment(manifest, environment); len(remaining) != 0 {
+		t.Errorf("withoutEnvironment() = %v, want no objects", remaining)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// eventFilter restricts the events handled by the service, it matches all events unless configured in _main
+var eventFilter = &EventFilter{}
+
+// EventFilter restricts the events handled by the service to a subset of projects, stages and services, in the same
+// way as the PROJECT_FILTER, STAGE_FILTER and SERVICE_FILTER of the distributor
+type EventFilter struct {
+	projects namePatterns
+	stages   namePatterns
+	services namePatterns
+}
+
+// NewEventFilter creates a filter from the comma separated lists of patterns for projects, stages and services. A
+// pattern is either a name, a glob such as dev-* or a regular expression enclosed in slashes such as /^(dev|qa)$/. An
+// empty list matches everything.
+func NewEventFilter(projects string, stages string, services string) (*EventFilter, error) {
+	filter := &EventFilter{}
+	var err error
+	if filter.projects, err = parseNamePatterns(projects); err != nil {
+		return nil, fmt.Errorf("invalid project filter: %s", err.Error())
+	}
+	if filter.stages, err = parseNamePatterns(stages); err != nil {
+		return nil, fmt.Errorf("invalid stage filter: %s", err.Error())
+	}
+	if filter.services, err = parseNamePatterns(services); err != nil {
+		return nil, fmt.Errorf("invalid service filter: %s", err.Error())
+	}
+	return filter, nil
+}
+
+// Matches returns true if the project, stage and service of an event match the filter
+func (f *EventFilter) Matches(project string, stage string, service string) bool {
+	return f.projects.matches(project) && f.stages.matches(stage) && f.services.matches(service)
+}
+
+// namePattern matches a name of a project, stage or service
+type namePattern func(name string) bool
+
+// namePatterns match a name if any of the patterns matches, or if there are no patterns at all
+type namePatterns []namePattern
+
+func (p namePatterns) matches(name string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, pattern := range p {
+		if pattern(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNamePatterns parses a comma separated list of names, globs and regular expressions enclosed in slashes
+func parseNamePatterns(list string) (namePatterns, error) {
+	patterns := namePatterns{}
+	for _, entry := range splitPatternList(list) {
+		pattern, err := parseNamePattern(entry)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func parseNamePattern(entry string) (namePattern, error) {
+	if len(entry) > 1 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+		expression, err := regexp.Compile(entry[1 : len(entry)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %s: %s", entry, err.Error())
+		}
+		return expression.MatchString, nil
+	}
+
+	// validate the glob once, filepath.Match only reports a bad pattern when it is evaluated
+	if _, err := filepath.Match(entry, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %s", entry, err.Error())
+	}
+	return func(name string) bool {
+		matched, _ := filepath.Match(entry, name)
+		return matched
+	}, nil
+}
+
+// splitPatternList splits the list at commas, except for commas within a regular expression such as /^a{1,3}$/
+func splitPatternList(list string) []string {
+	entries := []string{}
+	current := ""
+	for _, part := range strings.Split(list, ",") {
+		if current != "" {
+			current += "," + part
+		} else {
+			current = strings.TrimSpace(part)
+		}
+		if strings.HasPrefix(current, "/") && (len(current) == 1 || !strings.HasSuffix(strings.TrimSpace(current), "/")) {
+			continue
+		}
+		if current = strings.TrimSpace(current); current != "" {
+			entries = append(entries, current)
+		}
+		current = ""
+	}
+	if current = strings.TrimSpace(current); current != "" {
+		entries = append(entries, current)
+	}
+	return entries
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
+	"github.com/keptn/go-utils/pkg/lib/v0_2_0/fake"
+)
+
+func TestSplitPatternList(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []string
+	}{
+		{
+			name: "empty",
+			list: "",
+			want: []string{},
+		},
+		{
+			name: "names and globs",
+			list: "dev, hardening ,prod-*,",
+			want: []string{"dev", "hardening", "prod-*"},
+		},
+		{
+			name: "regular expression containing a comma",
+			list: "/^a{1,3}$/,dev",
+			want: []string{"/^a{1,3}$/", "dev"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitPatternList(tt.list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitPatternList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventFilterMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		projects string
+		stages   string
+		services string
+		project  string
+		stage    string
+		service  string
+		want     bool
+	}{
+		{
+			name:    "empty filter matches everything",
+			project: "sockshop", stage: "dev", service: "carts",
+			want: true,
+		},
+		{
+			name:     "exact project",
+			projects: "sockshop,podtato",
+			project:  "podtato", stage: "dev", service: "carts",
+			want: true,
+		},
+		{
+			name:     "other project",
+			projects: "sockshop",
+			project:  "podtato", stage: "dev", service: "carts",
+			want: false,
+		},
+		{
+			name:    "stage glob",
+			stages:  "perf-*",
+			project: "sockshop", stage: "perf-test", service: "carts",
+			want: true,
+		},
+		{
+			name:    "stage glob does not match",
+			stages:  "perf-*",
+			project: "sockshop", stage: "production", service: "carts",
+			want: false,
+		},
+		{
+			name:     "service regular expression",
+			services: "/^(carts|orders)(-db)?$/",
+			project:  "sockshop", stage: "dev", service: "carts-db",
+			want: true,
+		},
+		{
+			name:     "regular expression does not match",
+			services: "/^(carts|orders)(-db)?$/",
+			project:  "sockshop", stage: "dev", service: "payment",
+			want: false,
+		},
+		{
+			name:     "all filters have to match",
+			projects: "sockshop", stages: "dev", services: "orders",
+			project: "sockshop", stage: "dev", service: "carts",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewEventFilter(tt.projects, tt.stages, tt.services)
+			if err != nil {
+				t.Fatalf("NewEventFilter() error = %v", err)
+			}
+			if got := filter.Matches(tt.project, tt.stage, tt.service); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewEventFilterInvalidPatterns(t *testing.T) {
+	if _, err := NewEventFilter("/^(sockshop$/", "", ""); err == nil {
+		t.Errorf("NewEventFilter() with invalid regular expression, want error")
+	}
+	if _, err := NewEventFilter("", "[dev", ""); err == nil {
+		t.Errorf("NewEventFilter() with invalid glob, want error")
+	}
+}
+
+func TestProcessKeptnCloudEventIgnoresFilteredEvents(t *testing.T) {
+	eventFile, err := ioutil.ReadFile("test-events/action.triggered.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := cloudevents.Event{}
+	if err := json.Unmarshal(eventFile, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &fake.EventSender{}
+	previousSender, previousFilter := keptnOptions.EventSender, eventFilter
+	defer func() {
+		keptnOptions.EventSender, eventFilter = previousSender, previousFilter
+	}()
+	keptnOptions.EventSender = sender
+	if eventFilter, err = NewEventFilter("", "production", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processKeptnCloudEvent(context.Background(), event); err != nil {
+		t.Errorf("processKeptnCloudEvent() error = %v", err)
+	}
+	if len(sender.SentEvents) != 0 {
+		t.Errorf("processKeptnCloudEvent() sent %d events for a filtered stage, want none", len(sender.SentEvents))
+	}
+}
@@ -4,7 +4,13 @@ go 1.16
 
 require (
 	github.com/cloudevents/sdk-go/v2 v2.5.0
+	github.com/google/uuid v1.3.0
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/keptn/go-utils v0.10.0
+	github.com/nats-io/nats-server/v2 v2.3.4
+	github.com/nats-io/nats.go v1.11.1-0.20210623165838-4b75fc59ae30
 	gopkg.in/yaml.v2 v2.4.0
+	helm.sh/helm/v3 v3.6.3
+	sigs.k8s.io/kustomize/api v0.8.11
+	sigs.k8s.io/kustomize/kyaml v0.11.0
 )
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+)
+
+// HelmChartProperties are the task properties selecting a Helm chart as source of the environment definition
+type HelmChartProperties struct {
+	// Chart is the path of a packaged chart (.tgz) or a chart directory in the Keptn git repo,
+	// or an absolute path within the local chart directory of the service
+	Chart string `json:"chart,omitempty"`
+	// Values is the path of a values file in the Keptn git repo or an absolute path within the local chart directory
+	// of the service
+	Values string `json:"values,omitempty"`
+}
+
+// localChartDirectory is the directory of the filesystem of the service charts and values files can be loaded from
+// by their absolute path, an empty directory only allows charts of the Keptn git repo
+var localChartDirectory = ""
+
+// maxReleaseNameLength is the maximum length of a Helm release name
+const maxReleaseNameLength = 53
+
+// RenderHelmChart renders the chart in-process. The values are composed of the chart defaults, the values file and
+// the values derived from the event, which are available as .Values.keptn.project, .stage and .service.
+// As the same set has to be rendered for setup, teardown and later sequences, only values that are stable over all
+// sequences of a stage are passed.
+func RenderHelmChart(resources map[string][]byte, properties HelmChartProperties, eventValues map[string]interface{}, releaseName string) ([]byte, error) {
+	helmChart, err := loadHelmChart(resources, properties.Chart)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	if properties.Values != "" {
+		content, err := getResourceOrLocalFile(resources, properties.Values)
+		if err != nil {
+			return nil, fmt.Errorf("could not load values file %s: %s", properties.Values, err.Error())
+		}
+		values, err = chartutil.ReadValues(content)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse values file %s: %s", properties.Values, err.Error())
+		}
+	}
+	values["keptn"] = eventValues
+
+	renderValues, err := chartutil.ToRenderValues(helmChart, values, chartutil.ReleaseOptions{
+		Name:      releaseName,
+		Namespace: serviceNamespace,
+		IsInstall: true,
+	}, chartutil.DefaultCapabilities)
+	if err != nil {
+		return nil, fmt.Errorf("could not compose values of chart %s: %s", properties.Chart, err.Error())
+	}
+
+	rendered, err := engine.Render(helmChart, renderValues)
+	if err != nil {
+		return nil, fmt.Errorf("could not render chart %s: %s", properties.Chart, err.Error())
+	}
+
+	// combine the rendered templates in a deterministic order, skipping notes and empty templates
+	templates := make([]string, 0, len(rendered))
+	for template, content := range rendered {
+		if strings.HasSuffix(template, "NOTES.txt") || strings.TrimSpace(content) == "" {
+			continue
+		}
+		templates = append(templates, template)
+	}
+	sort.Strings(templates)
+
+	var manifest bytes.Buffer
+	for _, template := range templates {
+		fmt.Fprintf(&manifest, "---\n# Source: %s\n%s\n", template, rendered[template])
+	}
+	return manifest.Bytes(), nil
+}
+
+// loadHelmChart loads a packaged chart or a chart directory from the Keptn resources or the local filesystem
+func loadHelmChart(resources map[string][]byte, chartPath string) (*chart.Chart, error) {
+	resourcePath := normalizeResourceURI(chartPath)
+
+	if content, ok := resources[resourcePath]; ok {
+		helmChart, err := loader.LoadArchive(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("could not load chart archive %s: %s", resourcePath, err.Error())
+		}
+		return helmChart, nil
+	}
+
+	prefix := strings.TrimSuffix(resourcePath, "/") + "/"
+	var files []*loader.BufferedFile
+	for filename, content := range resources {
+		if strings.HasPrefix(filename, prefix) {
+			files = append(files, &loader.BufferedFile{Name: strings.TrimPrefix(filename, prefix), Data: content})
+		}
+	}
+	if len(files) > 0 {
+		helmChart, err := loader.LoadFiles(files)
+		if err != nil {
+			return nil, fmt.Errorf("could not load chart directory %s: %s", chartPath, err.Error())
+		}
+		return helmChart, nil
+	}
+
+	localPath, err := localChartPath(chartPath)
+	if err != nil {
+		return nil, fmt.Errorf("chart %s: %s", chartPath, err.Error())
+	}
+	helmChart, err := loader.Load(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load chart %s from the local filesystem: %s", chartPath, err.Error())
+	}
+	return helmChart, nil
+}
+
+// HelmReleaseName returns the name of the release the chart is rendered as, which is the same for all sequences of a
+// service in a stage, e.g., sockshop-production-carts
+func HelmReleaseName(project string, stage string, service string) string {
+	name := strings.Join([]string{project, stage, service}, "-")
+	if len(name) > maxReleaseNameLength {
+		name = strings.TrimRight(name[:maxReleaseNameLength], "-")
+	}
+	return name
+}
+
+// getResourceOrLocalFile returns the content of a Keptn resource, or of a file in the local chart directory given by
+// its absolute path, like for charts
+func getResourceOrLocalFile(resources map[string][]byte, filename string) ([]byte, error) {
+	if content, ok := resources[normalizeResourceURI(filename)]; ok {
+		return content, nil
+	}
+	localPath, err := localChartPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(localPath)
+}
+
+// localChartPath returns the path of a file on the filesystem of the service, which has to be given by its absolute
+// path and has to be located within the local chart directory, also after resolving symbolic links. Any other file
+// of the service, such as its service account token, cannot be read by a task.
+func localChartPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("not found in the Keptn git repo")
+	}
+	if localChartDirectory == "" {
+		return "", fmt.Errorf("not found in the Keptn git repo, local charts are disabled")
+	}
+
+	directory, err := filepath.EvalSymlinks(localChartDirectory)
+	if err != nil {
+		return "", fmt.Errorf("local chart directory is not available")
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", fmt.Errorf("not found in the Keptn git repo or the local chart directory")
+	}
+	relative, err := filepath.Rel(directory, resolved)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("not located within the local chart directory")
+	}
+	return resolved, nil
+}
@@ -11,7 +11,11 @@ type helmValues struct {
 			Enabled bool `yaml:"enabled"`
 		} `yaml:"service"`
 	} `yaml:"helmservice"`
-	Distributor struct {
+	ReplicaCount                  int    `yaml:"replicaCount"`
+	TerminationGracePeriodSeconds int    `yaml:"terminationGracePeriodSeconds"`
+	DriftCheckInterval            string `yaml:"driftCheckInterval"`
+	MetricsPort                   int    `yaml:"metricsPort"`
+	Distributor                   struct {
 		StageFilter   string `yaml:"stageFilter"`
 		ServiceFilter string `yaml:"serviceFilter"`
 		ProjectFilter string `yaml:"projectFilter"`
@@ -22,8 +26,9 @@ type helmValues struct {
 		} `yaml:"image"`
 	} `yaml:"distributor"`
 	RemoteControlPlane struct {
-		Enabled bool `yaml:"enabled"`
-		API     struct {
+		Enabled    bool `yaml:"enabled"`
+		PullEvents bool `yaml:"pullEvents"`
+		API        struct {
 			Protocol       string `yaml:"protocol"`
 			Hostname       string `yaml:"hostname"`
 			APIValidateTLS bool   `yaml:"apiValidateTls"`
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderHelmChart(t *testing.T) {
+	resources := map[string][]byte{
+		"crossplane/chart/Chart.yaml":  []byte("apiVersion: v2\nname: environment\nversion: 0.1.0\n"),
+		"crossplane/chart/values.yaml": []byte("nodeSize: small\nminNodeCount: 1\n"),
+		"crossplane/chart/templates/cluster.yaml": []byte(`apiVersion: devopstoolkitseries.com/v1alpha1
+kind: CompositeCluster
+metadata:
+  name: {{ .Values.keptn.project }}-{{ .Values.keptn.stage }}
+spec:
+  id: {{ .Values.keptn.project }}-{{ .Values.keptn.stage }}
+  parameters:
+    nodeSize: {{ .Values.nodeSize }}
+    minNodeCount: {{ .Values.minNodeCount }}
+`),
+		"crossplane/chart/templates/NOTES.txt": []byte("Cluster {{ .Release.Name }} requested"),
+		"crossplane/values-perf-test.yaml":     []byte("nodeSize: large\n"),
+	}
+
+	manifest, err := RenderHelmChart(resources, HelmChartProperties{
+		Chart:  "/crossplane/chart",
+		Values: "crossplane/values-perf-test.yaml",
+	}, map[string]interface{}{
+		"project": "sockshop",
+		"stage":   "perf-test",
+	}, "sockshop.perf-test")
+	if err != nil {
+		t.Fatalf("RenderHelmChart() error = %s", err.Error())
+	}
+
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		t.Fatalf("Cant parse rendered manifest: %s", err.Error())
+	}
+	if len(objects) != 1 {
+		t.Fatalf("RenderHelmChart() rendered %d objects, want 1", len(objects))
+	}
+	if name := objects[0].name(); name != "sockshop-perf-test" {
+		t.Errorf("RenderHelmChart() name = %s, want sockshop-perf-test", name)
+	}
+	if nodeSize := nestedString(objects[0], "spec", "parameters", "nodeSize"); nodeSize != "large" {
+		t.Errorf("RenderHelmChart() nodeSize = %s, want large", nodeSize)
+	}
+	if minNodeCount, _ := toFloat(nestedValue(objects[0], "spec", "parameters", "minNodeCount")); minNodeCount != 1 {
+		t.Errorf("RenderHelmChart() minNodeCount = %v, want 1", minNodeCount)
+	}
+}
+
+func TestRenderHelmChartValuesOutsideRepo(t *testing.T) {
+	resources := map[string][]byte{
+		"crossplane/chart/Chart.yaml": []byte("apiVersion: v2\nname: environment\nversion: 0.1.0\n"),
+	}
+
+	// relative paths are never read from the filesystem of the service
+	_, err := RenderHelmChart(resources, HelmChartProperties{
+		Chart:  "crossplane/chart",
+		Values: "helm_test.go",
+	}, map[string]interface{}{}, "sockshop-perf-test-carts")
+	if err == nil || !strings.Contains(err.Error(), "not found in the Keptn git repo") {
+		t.Errorf("RenderHelmChart() error = %v, want values file not found in the Keptn git repo", err)
+	}
+}
+
+func TestHelmReleaseName(t *testing.T) {
+	if got := HelmReleaseName("sockshop", "perf-test", "carts"); got != "sockshop-perf-test-carts" {
+		t.Errorf("HelmReleaseName() = %s, want sockshop-perf-test-carts", got)
+	}
+	if got := HelmReleaseName(strings.Repeat("p", 40), "dev", "carts"); len(got) > maxReleaseNameLength || strings.HasSuffix(got, "-") {
+		t.Errorf("HelmReleaseName() = %s, want at most %d characters without trailing dash", got, maxReleaseNameLength)
+	}
+}
+
+// useLocalChartDirectory allows to load charts and values files of a temporary directory for the test
+func useLocalChartDirectory(t *testing.T) string {
+	directory := t.TempDir()
+	previous := localChartDirectory
+	localChartDirectory = directory
+	t.Cleanup(func() {
+		localChartDirectory = previous
+	})
+	return directory
+}
+
+func TestLocalChartPath(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := localChartPath(outside); err == nil {
+		t.Errorf("localChartPath() without local chart directory did not fail")
+	}
+
+	directory := useLocalChartDirectory(t)
+	values := filepath.Join(directory, "values.yaml")
+	if err := ioutil.WriteFile(values, []byte("nodeSize: large\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(directory, "link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "file within the directory", path: values},
+		{name: "relative path", path: "values.yaml", wantErr: true},
+		{name: "file outside the directory", path: outside, wantErr: true},
+		{name: "path escaping the directory", path: filepath.Join(directory, "..", filepath.Base(filepath.Dir(outside)), "token"), wantErr: true},
+		{name: "link to a file outside the directory", path: filepath.Join(directory, "link.yaml"), wantErr: true},
+		{name: "service account token", path: "/var/run/secrets/kubernetes.io/serviceaccount/token", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := localChartPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("localChartPath(%s) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+
+	resources := map[string][]byte{
+		"crossplane/chart/Chart.yaml":               []byte("apiVersion: v2\nname: environment\nversion: 0.1.0\n"),
+		"crossplane/chart/templates/configmap.yaml": []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Values.nodeSize }}\n"),
+	}
+	manifest, err := RenderHelmChart(resources, HelmChartProperties{Chart: "crossplane/chart", Values: values}, map[string]interface{}{}, "sockshop-dev-carts")
+	if err != nil {
+		t.Fatalf("RenderHelmChart() with local values error = %v", err)
+	}
+	if !strings.Contains(string(manifest), "name: large") {
+		t.Errorf("RenderHelmChart() = %s, want the local values", manifest)
+	}
+	if _, err := RenderHelmChart(resources, HelmChartProperties{Chart: "crossplane/chart", Values: outside}, map[string]interface{}{}, "sockshop-dev-carts"); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("RenderHelmChart() with values outside the local chart directory error = %v, want an error without the content", err)
+	}
+}
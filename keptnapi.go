@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
+	"github.com/keptn/go-utils/pkg/api/models"
+	api "github.com/keptn/go-utils/pkg/api/utils"
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+)
+
+// keptnAPITokenHeader is the header the Keptn API token is sent with
+const keptnAPITokenHeader = "x-token"
+
+// SubscribedEventTypes are the triggered events handled by the service
+var SubscribedEventTypes = []string{
+	keptnv2.GetTriggeredEventType("environment-setup"),
+	keptnv2.GetTriggeredEventType("environment-teardown"),
+	keptnv2.GetTriggeredEventType("environment-update"),
+	keptnv2.GetTriggeredEventType(keptnv2.ActionTaskName),
+	keptnv2.GetTriggeredEventType(keptnv2.GetSLITaskName),
+}
+
+// keptnAPI is the connection to the Keptn control-plane API used in pull mode, nil if events are pushed to the service
+var keptnAPI *KeptnAPIConnection
+
+// KeptnAPIConnection connects the service to the Keptn control-plane API, so the service can run in an
+// execution-plane cluster without a distributor
+type KeptnAPIConnection struct {
+	scheme     string
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewKeptnAPIConnection creates a connection to the Keptn API at the endpoint, e.g., https://keptn.example.com/api
+func NewKeptnAPIConnection(endpoint string, token string, validateTLS bool) (*KeptnAPIConnection, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Keptn API endpoint %s: %s", endpoint, err.Error())
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("invalid Keptn API endpoint %s: scheme has to be http or https", endpoint)
+	}
+
+	return &KeptnAPIConnection{
+		scheme:  parsed.Scheme,
+		baseURL: strings.TrimRight(parsed.Host+parsed.Path, "/"),
+		token:   token,
+		// the handlers of go-utils never verify certificates, hence they all use this client instead
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: !validateTLS},
+				Proxy:           http.ProxyFromEnvironment,
+			},
+		},
+	}, nil
+}
+
+// ResourceHandler returns a handler for the resources of the Keptn git repo served through the API
+func (c *KeptnAPIConnection) ResourceHandler() *api.ResourceHandler {
+	handler := api.NewAuthenticatedResourceHandler(c.baseURL, c.token, keptnAPITokenHeader, nil, c.scheme)
+	handler.HTTPClient = c.httpClient
+	return handler
+}
+
+// EventSender returns a sender for the events of the service that sends them through the API
+func (c *KeptnAPIConnection) EventSender() *APIEventSender {
+	handler := api.NewAuthenticatedAPIHandler(c.baseURL, c.token, keptnAPITokenHeader, nil, c.scheme)
+	handler.HTTPClient = c.httpClient
+	return &APIEventSender{handler: handler}
+}
+
+// shipyardController returns a handler for the open triggered events of the shipyard controller
+func (c *KeptnAPIConnection) shipyardController() *api.ShipyardControllerHandler {
+	handler := api.NewAuthenticatedShipyardControllerHandler(c.baseURL, c.token, keptnAPITokenHeader, nil, c.scheme)
+	handler.HTTPClient = c.httpClient
+	return handler
+}
+
+// APIEventSender sends CloudEvents to the Keptn API
+type APIEventSender struct {
+	handler *api.APIHandler
+}
+
+// SendEvent sends the CloudEvent to the Keptn API
+func (s *APIEventSender) SendEvent(event cloudevents.Event) error {
+	return s.Send(context.Background(), event)
+}
+
+// Send sends the CloudEvent to the Keptn API
+func (s *APIEventSender) Send(ctx context.Context, event cloudevents.Event) error {
+	var data interface{}
+	if err := event.DataAs(&data); err != nil {
+		return fmt.Errorf("could not decode data of event %s: %s", event.ID(), err.Error())
+	}
+
+	source := event.Source()
+	eventType := event.Type()
+	keptnEvent := models.KeptnContextExtendedCE{
+		Contenttype:    cloudevents.ApplicationJSON,
+		Data:           data,
+		ID:             event.ID(),
+		Shkeptncontext: extensionString(event, "shkeptncontext"),
+		Source:         &source,
+		Specversion:    event.SpecVersion(),
+		Time:           event.Time(),
+		Triggeredid:    extensionString(event, "triggeredid"),
+		Type:           &eventType,
+	}
+
+	if _, errObj := s.handler.SendEvent(keptnEvent); errObj != nil {
+		message := "unknown error"
+		if errObj.Message != nil {
+			message = *errObj.Message
+		}
+		return fmt.Errorf("could not send event %s to the Keptn API: %s", event.Type(), message)
+	}
+	return nil
+}
+
+// EventPuller polls the Keptn API for open triggered events of the subscribed types and passes each event to the
+// handler once. Each event is handled by the replica that acquires its lease, so that it is handled once across all
+// replicas of the service.
+type EventPuller struct {
+	connection *KeptnAPIConnection
+	eventTypes []string
+	interval   time.Duration
+	handler    func(ctx context.Context, event cloudevents.Event) error
+
+	mutex sync.Mutex
+	// processed are the ids of the open events that have been passed to the handler already or are handled by another
+	// replica, per event type
+	processed map[string]map[string]bool
+	// leased are the events handled by this replica, whose leases are removed once the events are not open anymore
+	leased map[string]*eventLease
+}
+
+// eventLease is the lease of an event handled by this replica
+type eventLease struct {
+	name string
+	// done is true once the handler returned
+	done bool
+}
+
+// NewEventPuller creates a puller for the event types that polls the Keptn API in the given interval
+func NewEventPuller(connection *KeptnAPIConnection, eventTypes []string, interval time.Duration, handler func(ctx context.Context, event cloudevents.Event) error) *EventPuller {
+	return &EventPuller{
+		connection: connection,
+		eventTypes: eventTypes,
+		interval:   interval,
+		handler:    handler,
+		processed:  map[string]map[string]bool{},
+		leased:     map[string]*eventLease{},
+	}
+}
+
+// Run polls the Keptn API until the context is cancelled
+func (p *EventPuller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		for _, eventType := range p.eventTypes {
+			if err := p.poll(ctx, eventType); err != nil {
+				log.Printf("Could not pull %s events from the Keptn API: %s", eventType, err.Error())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches the open triggered events of the type and handles the new ones in the background
+func (p *EventPuller) poll(ctx context.Context, eventType string) error {
+	openEvents, err := p.connection.shipyardController().GetOpenTriggeredEvents(api.EventFilter{EventType: eventType})
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// events that are not open anymore will never be returned again, hence they can be forgotten
+	previous := p.processed[eventType]
+	current := make(map[string]bool, len(openEvents))
+	for _, openEvent := range openEvents {
+		if previous[openEvent.ID] {
+			current[openEvent.ID] = true
+			// the lease of a handled event is renewed while it is open, so that no other replica handles it again
+			if lease, ok := p.leased[openEvent.ID]; ok && lease.done {
+				if _, err := leases.acquire(lease.name, leaseHolder, LeaseDuration); err != nil {
+					log.Printf("Could not renew lease %s of event %s: %s", lease.name, openEvent.ID, err.Error())
+				}
+			}
+			continue
+		}
+
+		event, err := toCloudEvent(openEvent)
+		if err != nil {
+			current[openEvent.ID] = true
+			log.Printf("Ignoring invalid event %s: %s", openEvent.ID, err.Error())
+			continue
+		}
+
+		// the lease is kept after handling the event, so that no other replica handles it until it is closed
+		leaseName := LeaseName("event/" + openEvent.ID)
+		state, err := leases.acquire(leaseName, leaseHolder, LeaseDuration)
+		if err != nil {
+			log.Printf("Could not acquire lease for event %s, trying again with the next poll: %s", openEvent.ID, err.Error())
+			continue
+		}
+		if !state.acquired {
+			// the event is tried again with the next poll, in case the holder stops renewing the lease, e.g., because
+			// its replica crashed
+			log.Printf("Event %s is handled by %s", openEvent.ID, state.holder)
+			continue
+		}
+		current[openEvent.ID] = true
+
+		lease := &eventLease{name: leaseName}
+		p.leased[openEvent.ID] = lease
+		go keepLease(ctx, leaseName, func(ctx context.Context) {
+			if err := p.handler(ctx, event); err != nil {
+				log.Printf("Error while handling %s event %s: %s", event.Type(), event.ID(), err.Error())
+			}
+			p.mutex.Lock()
+			lease.done = true
+			p.mutex.Unlock()
+		}, nil)
+	}
+	for id := range previous {
+		if current[id] {
+			continue
+		}
+		if lease, ok := p.leased[id]; ok && lease.done {
+			if err := leases.remove(lease.name, leaseHolder); err != nil {
+				log.Printf("Could not remove lease %s of event %s: %s", lease.name, id, err.Error())
+			}
+			delete(p.leased, id)
+		} else if ok {
+			// the event has been closed while it is still handled, hence the lease is removed with the next poll
+			current[id] = true
+		}
+	}
+	p.processed[eventType] = current
+	return nil
+}
+
+// toCloudEvent converts an event of the Keptn API to a CloudEvent
+func toCloudEvent(keptnEvent *models.KeptnContextExtendedCE) (cloudevents.Event, error) {
+	event := cloudevents.NewEvent()
+	if keptnEvent.Type == nil || keptnEvent.ID == "" {
+		return event, errors.New("event has no type or id")
+	}
+
+	event.SetID(keptnEvent.ID)
+	event.SetType(*keptnEvent.Type)
+	if keptnEvent.Source != nil {
+		event.SetSource(*keptnEvent.Source)
+	}
+	event.SetTime(keptnEvent.Time)
+	event.SetExtension("shkeptncontext", keptnEvent.Shkeptncontext)
+	if keptnEvent.Triggeredid != "" {
+		event.SetExtension("triggeredid", keptnEvent.Triggeredid)
+	}
+	if err := event.SetData(cloudevents.ApplicationJSON, keptnEvent.Data); err != nil {
+		return event, err
+	}
+	return event, nil
+}
+
+// extensionString returns the value of the CloudEvent extension as string, or an empty string if it is not set
+func extensionString(event cloudevents.Event, name string) string {
+	value, ok := event.Extensions()[name]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
+)
+
+// stubKeptnAPI serves open triggered events like the shipyard controller and records the events sent to the API
+type stubKeptnAPI struct {
+	mutex      sync.Mutex
+	openEvents map[string][]map[string]interface{}
+	sentEvents []map[string]interface{}
+	tokens     []string
+}
+
+func (s *stubKeptnAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens = append(s.tokens, r.Header.Get(keptnAPITokenHeader))
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/controlPlane/v1/event/triggered/"):
+		eventType := strings.TrimPrefix(r.URL.Path, "/api/controlPlane/v1/event/triggered/")
+		events := s.openEvents[eventType]
+		if events == nil {
+			events = []map[string]interface{}{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"events": events, "nextPageKey": "0"})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/event":
+		body, _ := ioutil.ReadAll(r.Body)
+		event := map[string]interface{}{}
+		json.Unmarshal(body, &event)
+		s.sentEvents = append(s.sentEvents, event)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keptnContext": event["shkeptncontext"]})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// openTestEvent returns an open environment-setup.triggered event as returned by the shipyard controller
+func openTestEvent(id string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             id,
+		"type":           EnvironmentsetupEventTriggeredType,
+		"source":         "shipyard-controller",
+		"specversion":    "1.0",
+		"shkeptncontext": "a-context",
+		"time":           "2021-01-15T15:09:46.144Z",
+		"data":           map[string]interface{}{"project": "sockshop", "stage": "dev", "service": "carts"},
+	}
+}
+
+func TestEventPullerHandlesEachOpenEventOnce(t *testing.T) {
+	useMemoryLeases(t)
+	stub := &stubKeptnAPI{openEvents: map[string][]map[string]interface{}{
+		EnvironmentsetupEventTriggeredType: {openTestEvent("an-event-id")},
+	}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	connection, err := NewKeptnAPIConnection(server.URL+"/api", "a-token", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan cloudevents.Event, 10)
+	puller := NewEventPuller(connection, SubscribedEventTypes, time.Second, func(ctx context.Context, event cloudevents.Event) error {
+		handled <- event
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := puller.poll(context.Background(), EnvironmentsetupEventTriggeredType); err != nil {
+			t.Fatalf("poll() error = %v", err)
+		}
+	}
+
+	select {
+	case event := <-handled:
+		if event.ID() != "an-event-id" || event.Type() != EnvironmentsetupEventTriggeredType {
+			t.Errorf("handled event %s of type %s", event.ID(), event.Type())
+		}
+		if got := extensionString(event, "shkeptncontext"); got != "a-context" {
+			t.Errorf("handled event with shkeptncontext %s, want a-context", got)
+		}
+		data := map[string]interface{}{}
+		if err := event.DataAs(&data); err != nil || data["project"] != "sockshop" {
+			t.Errorf("handled event with data %v (%v)", data, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("open event has not been handled")
+	}
+	select {
+	case event := <-handled:
+		t.Errorf("event %s has been handled twice", event.ID())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for _, token := range stub.tokens {
+		if token != "a-token" {
+			t.Errorf("request with token %q, want a-token", token)
+		}
+	}
+}
+
+func TestEventPullerSkipsEventsLeasedByOtherReplicas(t *testing.T) {
+	memory := useMemoryLeases(t)
+	if _, err := memory.acquire(LeaseName("event/other-event-id"), "other-replica", LeaseDuration); err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubKeptnAPI{openEvents: map[string][]map[string]interface{}{
+		EnvironmentsetupEventTriggeredType: {openTestEvent("an-event-id"), openTestEvent("other-event-id")},
+	}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	connection, err := NewKeptnAPIConnection(server.URL+"/api", "a-token", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan string, 10)
+	puller := NewEventPuller(connection, SubscribedEventTypes, time.Second, func(ctx context.Context, event cloudevents.Event) error {
+		handled <- event.ID()
+		return nil
+	})
+	if err := puller.poll(context.Background(), EnvironmentsetupEventTriggeredType); err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+
+	select {
+	case id := <-handled:
+		if id != "an-event-id" {
+			t.Errorf("handled event %s, which is leased by another replica", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("open event has not been handled")
+	}
+	select {
+	case id := <-handled:
+		t.Errorf("handled event %s, which is leased by another replica", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the lease is kept after handling, until the event is not open anymore
+	leaseName := LeaseName("event/an-event-id")
+	if holder := memory.holder(leaseName); holder != leaseHolder {
+		t.Fatalf("lease of the handled event is held by %q, want %s", holder, leaseHolder)
+	}
+	stub.mutex.Lock()
+	stub.openEvents[EnvironmentsetupEventTriggeredType] = []map[string]interface{}{openTestEvent("other-event-id")}
+	stub.mutex.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for memory.holder(leaseName) != "" && time.Now().Before(deadline) {
+		if err := puller.poll(context.Background(), EnvironmentsetupEventTriggeredType); err != nil {
+			t.Fatalf("poll() error = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if holder := memory.holder(leaseName); holder != "" {
+		t.Errorf("lease of the closed event is still held by %s", holder)
+	}
+	if holder := memory.holder(LeaseName("event/other-event-id")); holder != "other-replica" {
+		t.Errorf("lease of the event of the other replica is held by %q", holder)
+	}
+}
+
+func TestAPIEventSenderSend(t *testing.T) {
+	stub := &stubKeptnAPI{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	connection, err := NewKeptnAPIConnection(server.URL+"/api", "a-token", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := cloudevents.NewEvent()
+	event.SetID("a-started-event")
+	event.SetType(EnvironmentsetupStartedEventType)
+	event.SetSource(ServiceName)
+	event.SetExtension("shkeptncontext", "a-context")
+	event.SetExtension("triggeredid", "an-event-id")
+	event.SetData(cloudevents.ApplicationJSON, map[string]interface{}{"project": "sockshop"})
+
+	if err := connection.EventSender().Send(context.Background(), event); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	if len(stub.sentEvents) != 1 {
+		t.Fatalf("sent %d events, want 1", len(stub.sentEvents))
+	}
+	sent := stub.sentEvents[0]
+	if sent["type"] != EnvironmentsetupStartedEventType || sent["shkeptncontext"] != "a-context" || sent["triggeredid"] != "an-event-id" {
+		t.Errorf("sent event %v", sent)
+	}
+	if stub.tokens[0] != "a-token" {
+		t.Errorf("request with token %q, want a-token", stub.tokens[0])
+	}
+}
+
+func TestNewKeptnAPIConnectionInvalidEndpoint(t *testing.T) {
+	if _, err := NewKeptnAPIConnection("keptn.example.com/api", "a-token", true); err == nil {
+		t.Errorf("NewKeptnAPIConnection() error = nil, want invalid endpoint")
+	}
+}
+
+func TestEventPullerTakesOverEventsOfCrashedReplicas(t *testing.T) {
+	memory := useMemoryLeases(t)
+	leaseName := LeaseName("event/other-event-id")
+	if _, err := memory.acquire(leaseName, "other-replica", LeaseDuration); err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubKeptnAPI{openEvents: map[string][]map[string]interface{}{
+		EnvironmentsetupEventTriggeredType: {openTestEvent("other-event-id")},
+	}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	connection, err := NewKeptnAPIConnection(server.URL+"/api", "a-token", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan string, 10)
+	puller := NewEventPuller(connection, SubscribedEventTypes, time.Second, func(ctx context.Context, event cloudevents.Event) error {
+		handled <- event.ID()
+		return nil
+	})
+	if err := puller.poll(context.Background(), EnvironmentsetupEventTriggeredType); err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	select {
+	case id := <-handled:
+		t.Fatalf("handled event %s, which is leased by another replica", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the other replica crashed, hence its lease expires
+	if err := memory.release(leaseName, "other-replica"); err != nil {
+		t.Fatal(err)
+	}
+	if err := puller.poll(context.Background(), EnvironmentsetupEventTriggeredType); err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	select {
+	case id := <-handled:
+		if id != "other-event-id" {
+			t.Errorf("handled event %s, want other-event-id", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event of the crashed replica has not been handled")
+	}
+	if holder := memory.holder(leaseName); holder != leaseHolder {
+		t.Errorf("lease of the taken over event is held by %q, want %s", holder, leaseHolder)
+	}
+}
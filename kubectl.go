@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cluster is the management cluster the objects are read from and written to
+var cluster clusterBackend = kubectlCluster{}
+
+// kubectlCommand is the kubectl executable used to access the management cluster
+var kubectlCommand = "kubectl"
+
+// clusterBackend reads and writes the objects of the management cluster
+type clusterBackend interface {
+	get(ctx context.Context, resource string, name string, namespace string) (manifestObject, error)
+	list(ctx context.Context, resource string, namespace string, selector string) ([]manifestObject, error)
+	apply(ctx context.Context, objects []manifestObject) error
+	create(ctx context.Context, object manifestObject) error
+	replace(ctx context.Context, object manifestObject) error
+	delete(ctx context.Context, resource string, name string, namespace string) error
+	label(ctx context.Context, resource string, name string, namespace string, labels map[string]string, resourceVersion string) error
+	patch(ctx context.Context, resource string, name string, namespace string, patch map[string]interface{}) error
+}
+
+// kubectlCluster accesses the management cluster with kubectl
+type kubectlCluster struct{}
+
+// kubectlJSON executes kubectl with the given args and decodes its JSON output.
+// In contrast to ExecuteCommand, stderr is not mixed into the decoded output.
+func kubectlJSON(ctx context.Context, args []string, out interface{}) error {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, kubectlCommand, append(args, "-o", "json")...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error executing command kubectl %s: %s\n%s", strings.Join(args, " "), err.Error(), stderr.String())
+	}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return fmt.Errorf("could not decode output of kubectl %s: %s", strings.Join(args, " "), err.Error())
+	}
+	return nil
+}
+
+// GetObject fetches a single object from the management cluster
+func GetObject(ctx context.Context, resource string, name string, namespace string) (manifestObject, error) {
+	return cluster.get(ctx, resource, name, namespace)
+}
+
+func (kubectlCluster) get(ctx context.Context, resource string, name string, namespace string) (manifestObject, error) {
+	args := []string{"get", resource, name}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+
+	object := manifestObject{}
+	if err := kubectlJSON(ctx, args, &object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// ListObjects lists all objects of the resource in the management cluster, optionally filtered by namespace and label selector.
+// An empty namespace lists the objects of all namespaces.
+func ListObjects(ctx context.Context, resource string, namespace string, selector string) ([]manifestObject, error) {
+	return cluster.list(ctx, resource, namespace, selector)
+}
+
+func (kubectlCluster) list(ctx context.Context, resource string, namespace string, selector string) ([]manifestObject, error) {
+	args := []string{"get", resource}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	} else {
+		args = append(args, "--all-namespaces")
+	}
+	if selector != "" {
+		args = append(args, "-l", selector)
+	}
+
+	list := struct {
+		Items []manifestObject `json:"items"`
+	}{}
+	if err := kubectlJSON(ctx, args, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// IsNotFoundError returns true if the error was caused by kubectl not finding the requested object or resource type
+func IsNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "NotFound") || strings.Contains(message, "not found") || strings.Contains(message, "doesn't have a resource type")
+}
+
+// DiffManifest performs a server-side dry-run of the manifest file and returns the diff against the live objects.
+// The returned bool is true if applying the manifest would change the management cluster.
+func DiffManifest(ctx context.Context, filename string) (string, bool, error) {
+	args := []string{"diff", "-f", filename}
+	out, err := exec.CommandContext(ctx, kubectlCommand, args...).CombinedOutput()
+	if err != nil {
+		// kubectl diff exits with 1 if differences were found and with >1 if kubectl itself failed
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return string(out), true, nil
+		}
+		return string(out), false, fmt.Errorf("Error executing command kubectl %s: %s\n%s", strings.Join(args, " "), err.Error(), string(out))
+	}
+	return string(out), false, nil
+}
+
+// WriteTempFile writes the content to a new temporary file and returns its name, the caller has to remove the file.
+// Each operation uses its own file, so that concurrent event handlers do not overwrite each other's files.
+func WriteTempFile(pattern string, content []byte) (string, error) {
+	file, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// kubectlObjects executes kubectl with the given args for a temporary manifest file of the objects
+func kubectlObjects(ctx context.Context, args []string, objects []manifestObject) error {
+	content, err := marshalManifest(objects)
+	if err != nil {
+		return err
+	}
+
+	filename, err := WriteTempFile(RenderedManifestPattern, content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filename)
+
+	_, err = ExecuteCommand(ctx, kubectlCommand, append(args, "-f", filename))
+	return err
+}
+
+// ApplyObjects applies the objects to the management cluster
+func ApplyObjects(ctx context.Context, objects []manifestObject) error {
+	return cluster.apply(ctx, objects)
+}
+
+func (kubectlCluster) apply(ctx context.Context, objects []manifestObject) error {
+	return kubectlObjects(ctx, []string{"apply"}, objects)
+}
+
+// CreateObject creates a single object in the management cluster, it fails if the object exists already
+func CreateObject(ctx context.Context, object manifestObject) error {
+	return cluster.create(ctx, object)
+}
+
+func (kubectlCluster) create(ctx context.Context, object manifestObject) error {
+	return kubectlObjects(ctx, []string{"create"}, []manifestObject{object})
+}
+
+// ReplaceObject replaces a single object in the management cluster. If the object contains a resourceVersion, the
+// update only succeeds if the object has not been modified in the meantime.
+func ReplaceObject(ctx context.Context, object manifestObject) error {
+	return cluster.replace(ctx, object)
+}
+
+func (kubectlCluster) replace(ctx context.Context, object manifestObject) error {
+	return kubectlObjects(ctx, []string{"replace"}, []manifestObject{object})
+}
+
+// IsConflictError returns true if kubectl failed because the object has been created or modified concurrently
+func IsConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "AlreadyExists") || strings.Contains(message, "already exists") || strings.Contains(message, "Conflict") || strings.Contains(message, "the object has been modified")
+}
+
+// DeleteObject deletes a single object from the management cluster, objects that do not exist are ignored. It does not
+// wait for finalizers, e.g., for Crossplane deleting the cloud resources of a composite, use WaitForDeletion for that.
+func DeleteObject(ctx context.Context, resource string, name string, namespace string) error {
+	return cluster.delete(ctx, resource, name, namespace)
+}
+
+func (kubectlCluster) delete(ctx context.Context, resource string, name string, namespace string) error {
+	args := []string{"delete", resource, name, "--ignore-not-found", "--wait=false"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	_, err := ExecuteCommand(ctx, kubectlCommand, args)
+	return err
+}
+
+// deletionPollInterval is the interval in which WaitForDeletion checks whether an object is gone
+var deletionPollInterval = 5 * time.Second
+
+// WaitForDeletion waits until the object does not exist anymore in the management cluster, the timeout elapsed or the
+// context is done
+func WaitForDeletion(ctx context.Context, resource string, name string, namespace string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		_, err := GetObject(ctx, resource, name, namespace)
+		if IsNotFoundError(err) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Could not check whether %s %s has been deleted: %s", resource, name, err.Error())
+		}
+		if err := sleepContext(ctx, deletionPollInterval); err != nil {
+			return fmt.Errorf("%s %s has not been deleted within %s: %w", resource, name, timeout, err)
+		}
+	}
+}
+
+// LabelObject sets the labels of a single object in the management cluster, labels with an empty value are removed.
+// If resourceVersion is not empty, the update only succeeds if the object has not been modified in the meantime.
+func LabelObject(ctx context.Context, resource string, name string, namespace string, labels map[string]string, resourceVersion string) error {
+	return cluster.label(ctx, resource, name, namespace, labels, resourceVersion)
+}
+
+func (kubectlCluster) label(ctx context.Context, resource string, name string, namespace string, labels map[string]string, resourceVersion string) error {
+	args := []string{"label", resource, name, "--overwrite"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	if resourceVersion != "" {
+		args = append(args, "--resource-version", resourceVersion)
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if labels[key] == "" {
+			args = append(args, key+"-")
+		} else {
+			args = append(args, key+"="+labels[key])
+		}
+	}
+
+	_, err := ExecuteCommand(ctx, kubectlCommand, args)
+	return err
+}
+
+// PatchObject applies a JSON merge patch to a single object in the management cluster
+func PatchObject(ctx context.Context, resource string, name string, namespace string, patch map[string]interface{}) error {
+	return cluster.patch(ctx, resource, name, namespace, patch)
+}
+
+func (kubectlCluster) patch(ctx context.Context, resource string, name string, namespace string, patch map[string]interface{}) error {
+	content, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"patch", resource, name, "--type", "merge", "-p", string(content)}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	_, err = ExecuteCommand(ctx, kubectlCommand, args)
+	return err
+}
+
+// ListWarningEvents lists the Warning events of an object of the management cluster
+func ListWarningEvents(ctx context.Context, object manifestObject) ([]manifestObject, error) {
+	selector := fmt.Sprintf("involvedObject.kind=%s,involvedObject.name=%s,type=Warning", object.kind(), object.name())
+	args := []string{"get", "events", "--field-selector", selector}
+	if object.namespace() != "" {
+		args = append(args, "-n", object.namespace())
+	} else {
+		args = append(args, "--all-namespaces")
+	}
+
+	list := struct {
+		Items []manifestObject `json:"items"`
+	}{}
+	if err := kubectlJSON(ctx, args, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// CountNodes counts the nodes of the cluster the kubeconfig points to
+func CountNodes(ctx context.Context, kubeconfig []byte) (int, error) {
+	filename, err := WriteTempFile(KubeconfigPattern, kubeconfig)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(filename)
+
+	list := struct {
+		Items []manifestObject `json:"items"`
+	}{}
+	if err := kubectlJSON(ctx, []string{"get", "nodes", "--kubeconfig", filename}, &list); err != nil {
+		return 0, err
+	}
+	return len(list.Items), nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryCluster keeps the objects of the management cluster in memory instead of calling kubectl
+type memoryCluster struct {
+	mutex   sync.Mutex
+	objects map[string]manifestObject
+	version int
+	// unknown are resources the cluster does not know, e.g., because their CRD has been removed
+	unknown map[string]bool
+	// failDeletes are the names of objects that cannot be deleted
+	failDeletes map[string]bool
+	// deleted are the deleted objects in the order of their deletion
+	deleted []string
+	// applied are the objects that have been applied
+	applied []string
+}
+
+// useMemoryCluster replaces the management cluster for the test with one containing the objects
+func useMemoryCluster(t *testing.T, objects ...manifestObject) *memoryCluster {
+	memory := &memoryCluster{objects: map[string]manifestObject{}, unknown: map[string]bool{}, failDeletes: map[string]bool{}}
+	for _, object := range objects {
+		memory.store(object)
+	}
+	previous := cluster
+	cluster = memory
+	t.Cleanup(func() {
+		cluster = previous
+	})
+	return memory
+}
+
+// useKubectlScript replaces kubectl for the test with a shell script, e.g., to stub the output and exit code of
+// kubectl diff
+func useKubectlScript(t *testing.T, script string) {
+	filename := filepath.Join(t.TempDir(), "kubectl")
+	if err := ioutil.WriteFile(filename, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	previous := kubectlCommand
+	kubectlCommand = filename
+	t.Cleanup(func() {
+		kubectlCommand = previous
+	})
+}
+
+// copyObject returns a deep copy of the object as decoded from the JSON output of kubectl
+func copyObject(object manifestObject) manifestObject {
+	content, err := json.Marshal(convertYAMLValue(map[string]interface{}(object)))
+	if err != nil {
+		panic(err)
+	}
+	copied := manifestObject{}
+	if err := json.Unmarshal(content, &copied); err != nil {
+		panic(err)
+	}
+	return copied
+}
+
+func objectKey(object manifestObject) string {
+	return strings.ToLower(object.resource()) + "/" + object.namespace() + "/" + object.name()
+}
+
+// matchesResource returns true if the object is of the resource as passed to kubectl, e.g., configmap, secrets,
+// CompositeCluster.devopstoolkitseries.com or compositions.apiextensions.crossplane.io
+func matchesResource(object manifestObject, resource string) bool {
+	resource = strings.ToLower(resource)
+	kind := strings.ToLower(object.kind())
+	return resource == strings.ToLower(object.resource()) || resource == kind || resource == kind+"s" || resource == kind+"s."+object.group()
+}
+
+func matchesSelector(object manifestObject, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	labels := nestedMap(object, "metadata", "labels")
+	for _, requirement := range strings.Split(selector, ",") {
+		key, value, hasValue := requirement, "", false
+		if index := strings.Index(requirement, "="); index >= 0 {
+			key, value, hasValue = requirement[:index], requirement[index+1:], true
+		}
+		actual, ok := labels[key].(string)
+		if !ok || (hasValue && actual != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func notFound(resource string, name string) error {
+	return fmt.Errorf("Error from server (NotFound): %s %q not found", resource, name)
+}
+
+func (m *memoryCluster) store(object manifestObject) {
+	m.version++
+	stored := copyObject(object)
+	setNestedValue(stored, strconv.Itoa(m.version), "metadata", "resourceVersion")
+	m.objects[objectKey(stored)] = stored
+}
+
+func (m *memoryCluster) find(resource string, name string, namespace string) (string, manifestObject) {
+	for key, object := range m.objects {
+		if matchesResource(object, resource) && object.name() == name && object.namespace() == namespace {
+			return key, object
+		}
+	}
+	return "", nil
+}
+
+func (m *memoryCluster) get(ctx context.Context, resource string, name string, namespace string) (manifestObject, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, object := m.find(resource, name, namespace); object != nil {
+		return copyObject(object), nil
+	}
+	return nil, notFound(resource, name)
+}
+
+func (m *memoryCluster) list(ctx context.Context, resource string, namespace string, selector string) ([]manifestObject, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.unknown[resource] {
+		return nil, fmt.Errorf("error: the server doesn't have a resource type %q", resource)
+	}
+	var objects []manifestObject
+	for _, object := range m.objects {
+		if matchesResource(object, resource) && (namespace == "" || object.namespace() == namespace) && matchesSelector(object, selector) {
+			objects = append(objects, copyObject(object))
+		}
+	}
+	return objects, nil
+}
+
+func (m *memoryCluster) apply(ctx context.Context, objects []manifestObject) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, object := range objects {
+		applied := copyObject(object)
+		if existing, ok := m.objects[objectKey(applied)]; ok && existing["status"] != nil {
+			applied["status"] = existing["status"]
+		}
+		m.store(applied)
+		m.applied = append(m.applied, object.String())
+	}
+	return nil
+}
+
+func (m *memoryCluster) create(ctx context.Context, object manifestObject) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.objects[objectKey(object)]; ok {
+		return fmt.Errorf("Error from server (AlreadyExists): %s %q already exists", object.resource(), object.name())
+	}
+	m.store(object)
+	return nil
+}
+
+func (m *memoryCluster) replace(ctx context.Context, object manifestObject) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	existing, ok := m.objects[objectKey(object)]
+	if !ok {
+		return notFound(object.resource(), object.name())
+	}
+	if version := nestedString(object, "metadata", "resourceVersion"); version != "" && version != nestedString(existing, "metadata", "resourceVersion") {
+		return fmt.Errorf("Error from server (Conflict): the object has been modified")
+	}
+	m.store(object)
+	return nil
+}
+
+func (m *memoryCluster) delete(ctx context.Context, resource string, name string, namespace string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.failDeletes[name] {
+		return fmt.Errorf("Error from server (Forbidden): %s %q cannot be deleted", resource, name)
+	}
+	if key, object := m.find(resource, name, namespace); object != nil {
+		delete(m.objects, key)
+		m.deleted = append(m.deleted, object.String())
+	}
+	return nil
+}
+
+func (m *memoryCluster) label(ctx context.Context, resource string, name string, namespace string, labels map[string]string, resourceVersion string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, object := m.find(resource, name, namespace)
+	if object == nil {
+		return notFound(resource, name)
+	}
+	if resourceVersion != "" && resourceVersion != nestedString(object, "metadata", "resourceVersion") {
+		return fmt.Errorf("Error from server (Conflict): the object has been modified")
+	}
+	for key, value := range labels {
+		if value == "" {
+			delete(nestedMap(object, "metadata", "labels"), key)
+		} else {
+			object.setLabel(key, value)
+		}
+	}
+	m.store(object)
+	return nil
+}
+
+func (m *memoryCluster) patch(ctx context.Context, resource string, name string, namespace string, patch map[string]interface{}) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, object := m.find(resource, name, namespace)
+	if object == nil {
+		return notFound(resource, name)
+	}
+	m.store(mergePatch(object, copyObject(patch)))
+	return nil
+}
+
+// object returns the object stored in the cluster, or nil
+func (m *memoryCluster) object(resource string, name string, namespace string) manifestObject {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, object := m.find(resource, name, namespace)
+	return object
+}
+
+func TestIsNotFoundError(t *testing.T) {
+	for _, err := range []error{
+		notFound("CompositeCluster.devopstoolkitseries.com", "keptn-crossplane"),
+		fmt.Errorf(`error: the server doesn't have a resource type "clusters"`),
+	} {
+		if !IsNotFoundError(err) {
+			t.Errorf("IsNotFoundError(%v) = false, want true", err)
+		}
+	}
+	if IsNotFoundError(fmt.Errorf("Error from server (Forbidden): secrets is forbidden")) {
+		t.Errorf("IsNotFoundError() of a forbidden error = true, want false")
+	}
+}
+
+func TestDiffManifest(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		wantDiff    string
+		wantChanged bool
+		wantErr     bool
+	}{
+		{
+			name:   "no changes",
+			script: "exit 0",
+		},
+		{
+			name:        "changes",
+			script:      "echo '+  nodeSize: large'; exit 1",
+			wantDiff:    "+  nodeSize: large\n",
+			wantChanged: true,
+		},
+		{
+			name:    "kubectl failed",
+			script:  "echo 'error: the server could not be reached' >&2; exit 2",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useKubectlScript(t, tt.script)
+
+			diff, changed, err := DiffManifest(context.Background(), "cluster.yaml")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DiffManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff != tt.wantDiff || changed != tt.wantChanged {
+				t.Errorf("DiffManifest() = %q, %v, want %q, %v", diff, changed, tt.wantDiff, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestKubectlStopsWithContext(t *testing.T) {
+	useKubectlScript(t, "exec sleep 10")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if _, err := GetObject(ctx, "secret", "keptn-crossplane", "crossplane-system"); err == nil {
+		t.Errorf("GetObject() with a cancelled context succeeded, want error")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("GetObject() returned after %s, want kubectl to be stopped with the context", elapsed)
+	}
+}
+
+func TestWaitForDeletion(t *testing.T) {
+	previous := deletionPollInterval
+	deletionPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		deletionPollInterval = previous
+	})
+	object := manifestObject{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "keptn-crossplane", "namespace": "sockshop-dev"},
+	}
+
+	memory := useMemoryCluster(t, object)
+	if err := WaitForDeletion(context.Background(), "configmap", "keptn-crossplane", "sockshop-dev", 50*time.Millisecond); err == nil {
+		t.Errorf("WaitForDeletion() of an object that is not deleted succeeded, want timeout")
+	}
+
+	// the object is deleted while waiting, e.g., once Crossplane removed its finalizer
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		memory.delete(context.Background(), "configmap", "keptn-crossplane", "sockshop-dev")
+	}()
+	if err := WaitForDeletion(context.Background(), "configmap", "keptn-crossplane", "sockshop-dev", time.Second); err != nil {
+		t.Errorf("WaitForDeletion() error = %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// kustomizationFilenames are the file names kustomize recognizes as kustomization
+var kustomizationFilenames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// findKustomization returns the kustomization file in the crossplane directory, or an empty string if there is none
+func findKustomization(resources map[string][]byte) string {
+	for _, filename := range kustomizationFilenames {
+		kustomization := path.Join(CrossPlaneDirectory, filename)
+		if _, ok := resources[kustomization]; ok {
+			return kustomization
+		}
+	}
+	return ""
+}
+
+// BuildKustomization renders the kustomization of the crossplane directory in-process. All resources are made
+// available to kustomize in an in-memory filesystem, hence bases and patches may be located anywhere in the crossplane
+// directory and on any level of Keptn's resource hierarchy.
+func BuildKustomization(resources map[string][]byte) ([]byte, error) {
+	fSys := filesys.MakeFsInMemory()
+	for filename, content := range resources {
+		if err := fSys.WriteFile(path.Join("/", filename), content); err != nil {
+			return nil, fmt.Errorf("could not prepare %s for kustomize: %s", filename, err.Error())
+		}
+	}
+
+	kustomizer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resMap, err := kustomizer.Run(fSys, path.Join("/", CrossPlaneDirectory))
+	if err != nil {
+		return nil, fmt.Errorf("could not build kustomization: %s", err.Error())
+	}
+
+	manifest, err := resMap.AsYaml()
+	if err != nil {
+		return nil, fmt.Errorf("could not render kustomization: %s", err.Error())
+	}
+	return manifest, nil
+}
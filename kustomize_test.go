@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildKustomization(t *testing.T) {
+	resources := map[string][]byte{
+		"crossplane/base/kustomization.yaml": []byte("resources:\n- cluster.yaml\n"),
+		"crossplane/base/cluster.yaml": []byte(`apiVersion: devopstoolkitseries.com/v1alpha1
+kind: CompositeCluster
+metadata:
+  name: keptn-crossplane
+spec:
+  id: keptn-crossplane
+  parameters:
+    nodeSize: small
+`),
+		"crossplane/kustomization.yaml": []byte(`resources:
+- base
+patchesJson6902:
+- target:
+    group: devopstoolkitseries.com
+    version: v1alpha1
+    kind: CompositeCluster
+    name: keptn-crossplane
+  patch: |-
+    - op: replace
+      path: /spec/parameters/nodeSize
+      value: large
+`),
+	}
+
+	if kustomization := findKustomization(resources); kustomization != "crossplane/kustomization.yaml" {
+		t.Fatalf("findKustomization() = %s, want crossplane/kustomization.yaml", kustomization)
+	}
+
+	manifest, err := BuildKustomization(resources)
+	if err != nil {
+		t.Fatalf("BuildKustomization() error = %s", err.Error())
+	}
+
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		t.Fatalf("Cant parse rendered manifest: %s", err.Error())
+	}
+	if len(objects) != 1 {
+		t.Fatalf("BuildKustomization() rendered %d objects, want 1", len(objects))
+	}
+	if nodeSize := nestedString(objects[0], "spec", "parameters", "nodeSize"); nodeSize != "large" {
+		t.Errorf("BuildKustomization() nodeSize = %s, want large", nodeSize)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// LeaseDuration is the time a lease stays valid without being renewed, e.g., after its holder crashed
+	LeaseDuration = 30 * time.Second
+	// leaseRenewInterval is the interval in which held leases are renewed
+	leaseRenewInterval = 10 * time.Second
+	// leaseRetryInterval is the interval in which a lease held by another replica is tried to be acquired again
+	leaseRetryInterval = 5 * time.Second
+	// leaseRequestTimeout is the maximum time a request for a lease may take. Leases are not bound to the context of
+	// an operation, so that they can be released after the operation has been cancelled.
+	leaseRequestTimeout = 10 * time.Second
+)
+
+// leaseTimeFormat is the format of the MicroTime fields of a Lease
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// CancelRequestedAnnotation is set on a Lease to ask its holder to cancel the operation it is running
+const CancelRequestedAnnotation = "crossplane-service.keptn.sh/cancel-requested"
+
+// leaseHolder identifies this replica of the service as holder of leases. The pod name is extended by a random
+// suffix, so that a restarted pod does not take over the leases of the handlers of its previous incarnation.
+var leaseHolder = newLeaseHolder()
+
+// leases stores the leases, which are Lease objects in the namespace of the service
+var leases leaseBackend = kubernetesLeases{}
+
+// leaseBackend acquires and releases leases shared by all replicas of the service
+type leaseBackend interface {
+	// acquire acquires or renews the lease for the holder
+	acquire(name string, holder string, duration time.Duration) (leaseState, error)
+	// release gives up the lease if it is held by the holder
+	release(name string, holder string) error
+	// requestCancel asks the current holder of the lease to cancel its operation
+	requestCancel(name string, request string) error
+	// remove deletes the lease unless it is held by another holder
+	remove(name string, holder string) error
+}
+
+// leaseState is the state of a lease after trying to acquire it
+type leaseState struct {
+	// acquired is true if the lease is held by the holder that tried to acquire it
+	acquired bool
+	// holder is the current holder of the lease
+	holder string
+	// cancelRequested describes the request to cancel the operation of the holder, if any
+	cancelRequested string
+}
+
+func newLeaseHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = ServiceName
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%x", hostname, suffix)
+}
+
+// LeaseName returns the name of the Lease for a lock, which is a valid object name for any lock name
+func LeaseName(lock string) string {
+	return fmt.Sprintf("crossplane-service-%x", sha256.Sum256([]byte(lock)))[:40]
+}
+
+// RunAsLeader runs the background loop while this replica is the leader for it, so that the loop runs at most once
+// across all replicas of the service. The context of the loop is cancelled if the leadership is lost. RunAsLeader
+// returns once the context is done.
+func RunAsLeader(ctx context.Context, name string, loop func(ctx context.Context)) {
+	leaseName := LeaseName("leader/" + name)
+	for {
+		state, err := leases.acquire(leaseName, leaseHolder, LeaseDuration)
+		if err != nil {
+			log.Printf("Could not acquire leadership for %s: %s", name, err.Error())
+		} else if state.acquired {
+			log.Printf("Became leader for %s", name)
+			holdLease(ctx, leaseName, loop, nil)
+			log.Printf("Stopped being leader for %s", name)
+		} else {
+			log.Printf("Replica %s is leader for %s", state.holder, name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaseRetryInterval):
+		}
+	}
+}
+
+// holdLease runs the function while renewing the acquired lease and releases the lease afterwards. The context of
+// the function is cancelled if the lease cannot be renewed anymore. cancelRequested is called, if not nil, while
+// another replica asks to cancel the operation running with the lease.
+func holdLease(ctx context.Context, leaseName string, run func(ctx context.Context), cancelRequested func(request string)) {
+	keepLease(ctx, leaseName, run, cancelRequested)
+
+	if err := leases.release(leaseName, leaseHolder); err != nil {
+		log.Printf("Could not release lease %s: %s", leaseName, err.Error())
+	}
+}
+
+// keepLease runs the function while renewing the acquired lease like holdLease, but does not release the lease
+// afterwards, so that other replicas can not acquire it until it expires
+func keepLease(ctx context.Context, leaseName string, run func(ctx context.Context), cancelRequested func(request string)) {
+	holdCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(holdCtx)
+	}()
+
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+			state, err := leases.acquire(leaseName, leaseHolder, LeaseDuration)
+			switch {
+			case state.acquired:
+				renewed = time.Now()
+				if state.cancelRequested != "" && cancelRequested != nil {
+					cancelRequested(state.cancelRequested)
+				}
+			case err == nil:
+				log.Printf("Lease %s has been taken over by %s", leaseName, state.holder)
+				cancel()
+			case time.Since(renewed) > LeaseDuration-leaseRenewInterval:
+				log.Printf("Could not renew lease %s in time: %s", leaseName, err.Error())
+				cancel()
+			default:
+				log.Printf("Could not renew lease %s: %s", leaseName, err.Error())
+			}
+		}
+	}
+	cancel()
+}
+
+// kubernetesLeases stores leases as coordination.k8s.io Lease objects in the namespace of the service
+type kubernetesLeases struct{}
+
+func (kubernetesLeases) acquire(name string, holder string, duration time.Duration) (leaseState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	now := time.Now()
+	lease, err := GetObject(ctx, "lease", name, serviceNamespace)
+	if err != nil {
+		if !IsNotFoundError(err) {
+			return leaseState{}, err
+		}
+		err = CreateObject(ctx, newLeaseObject(name, holder, duration, now))
+		if IsConflictError(err) {
+			// another replica created the lease in the meantime
+			return leaseState{}, nil
+		}
+		if err != nil {
+			return leaseState{}, err
+		}
+		return leaseState{acquired: true, holder: holder}, nil
+	}
+
+	current := leaseState{
+		holder:          nestedString(lease, "spec", "holderIdentity"),
+		cancelRequested: nestedString(lease, "metadata", "annotations", CancelRequestedAnnotation),
+	}
+	if !leaseAvailable(lease, holder, now) {
+		return current, nil
+	}
+
+	updated := newLeaseObject(name, holder, duration, now)
+	updated["metadata"].(map[string]interface{})["resourceVersion"] = nestedString(lease, "metadata", "resourceVersion")
+	if current.holder == holder {
+		// renewing keeps the time the lease was acquired and the requests to cancel the operation of the holder
+		if acquireTime := nestedString(lease, "spec", "acquireTime"); acquireTime != "" {
+			updated["spec"].(map[string]interface{})["acquireTime"] = acquireTime
+		}
+		if annotations := nestedMap(lease, "metadata", "annotations"); annotations != nil {
+			updated["metadata"].(map[string]interface{})["annotations"] = annotations
+		}
+	} else {
+		current.cancelRequested = ""
+	}
+	if err := ReplaceObject(ctx, updated); err != nil {
+		if IsConflictError(err) {
+			return leaseState{holder: current.holder}, nil
+		}
+		return leaseState{holder: current.holder}, err
+	}
+	return leaseState{acquired: true, holder: holder, cancelRequested: current.cancelRequested}, nil
+}
+
+func (kubernetesLeases) release(name string, holder string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	lease, err := GetObject(ctx, "lease", name, serviceNamespace)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if nestedString(lease, "spec", "holderIdentity") != holder {
+		return nil
+	}
+
+	spec, _ := lease["spec"].(map[string]interface{})
+	delete(spec, "holderIdentity")
+	if annotations := nestedMap(lease, "metadata", "annotations"); annotations != nil {
+		delete(annotations, CancelRequestedAnnotation)
+	}
+	if err := ReplaceObject(ctx, lease); err != nil && !IsConflictError(err) {
+		return err
+	}
+	return nil
+}
+
+func (kubernetesLeases) requestCancel(name string, request string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				CancelRequestedAnnotation: request,
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	if err := PatchObject(ctx, "lease", name, serviceNamespace, patch); err != nil && !IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+func (kubernetesLeases) remove(name string, holder string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	lease, err := GetObject(ctx, "lease", name, serviceNamespace)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if !leaseAvailable(lease, holder, time.Now()) {
+		return nil
+	}
+	return DeleteObject(ctx, "lease", name, serviceNamespace)
+}
+
+// newLeaseObject returns a Lease held by the holder
+func newLeaseObject(name string, holder string, duration time.Duration, now time.Time) manifestObject {
+	return manifestObject{
+		"apiVersion": "coordination.k8s.io/v1",
+		"kind":       "Lease",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": serviceNamespace,
+		},
+		"spec": map[string]interface{}{
+			"holderIdentity":       holder,
+			"leaseDurationSeconds": int(duration.Seconds()),
+			"acquireTime":          now.UTC().Format(leaseTimeFormat),
+			"renewTime":            now.UTC().Format(leaseTimeFormat),
+		},
+	}
+}
+
+// leaseAvailable returns true if the Lease can be acquired by the holder, i.e., it is not held, held by the holder
+// already or has expired
+func leaseAvailable(lease manifestObject, holder string, now time.Time) bool {
+	current := nestedString(lease, "spec", "holderIdentity")
+	if current == "" || current == holder {
+		return true
+	}
+
+	renewTime, err := time.Parse(leaseTimeFormat, nestedString(lease, "spec", "renewTime"))
+	if err != nil {
+		return true
+	}
+	seconds, _ := toFloat(nestedValue(lease, "spec", "leaseDurationSeconds"))
+	return now.After(renewTime.Add(time.Duration(seconds) * time.Second))
+}
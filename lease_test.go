@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryLeases keeps leases in memory instead of the management cluster
+type memoryLeases struct {
+	mutex   sync.Mutex
+	holders map[string]string
+	cancels map[string]string
+	err     error
+}
+
+func (m *memoryLeases) acquire(name string, holder string, duration time.Duration) (leaseState, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return leaseState{}, m.err
+	}
+	if current := m.holders[name]; current != "" && current != holder {
+		return leaseState{holder: current, cancelRequested: m.cancels[name]}, nil
+	}
+	m.holders[name] = holder
+	return leaseState{acquired: true, holder: holder, cancelRequested: m.cancels[name]}, nil
+}
+
+func (m *memoryLeases) release(name string, holder string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.holders[name] == holder {
+		delete(m.holders, name)
+		delete(m.cancels, name)
+	}
+	return nil
+}
+
+func (m *memoryLeases) requestCancel(name string, request string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.cancels[name] = request
+	return nil
+}
+
+func (m *memoryLeases) remove(name string, holder string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if current := m.holders[name]; current == "" || current == holder {
+		delete(m.holders, name)
+		delete(m.cancels, name)
+	}
+	return nil
+}
+
+func (m *memoryLeases) holder(name string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.holders[name]
+}
+
+// useMemoryLeases replaces the leases of the management cluster for the test
+func useMemoryLeases(t *testing.T) *memoryLeases {
+	memory := &memoryLeases{holders: map[string]string{}, cancels: map[string]string{}}
+	previous := leases
+	leases = memory
+	t.Cleanup(func() {
+		leases = previous
+	})
+	return memory
+}
+
+func TestLeaseAvailable(t *testing.T) {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	lease := func(holder string, renewed time.Time) manifestObject {
+		return manifestObject{"spec": map[string]interface{}{
+			"holderIdentity":       holder,
+			"leaseDurationSeconds": float64(30),
+			"renewTime":            renewed.Format(leaseTimeFormat),
+		}}
+	}
+
+	tests := []struct {
+		name  string
+		lease manifestObject
+		want  bool
+	}{
+		{
+			name:  "not held",
+			lease: lease("", now),
+			want:  true,
+		},
+		{
+			name:  "held by the holder",
+			lease: lease("replica-1", now),
+			want:  true,
+		},
+		{
+			name:  "held by another replica",
+			lease: lease("replica-2", now.Add(-10*time.Second)),
+			want:  false,
+		},
+		{
+			name:  "expired",
+			lease: lease("replica-2", now.Add(-31*time.Second)),
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := leaseAvailable(tt.lease, "replica-1", now); got != tt.want {
+				t.Errorf("leaseAvailable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLeaseObject(t *testing.T) {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	lease := newLeaseObject(LeaseName("environment/sockshop.dev"), "replica-1", LeaseDuration, now)
+
+	if lease.kind() != "Lease" || lease.namespace() != serviceNamespace {
+		t.Errorf("newLeaseObject() = %s in namespace %s, want a Lease in namespace %s", lease.kind(), lease.namespace(), serviceNamespace)
+	}
+	if len(lease.name()) > 63 {
+		t.Errorf("newLeaseObject() name %s is too long", lease.name())
+	}
+	if renewTime := nestedString(lease, "spec", "renewTime"); renewTime != "2021-09-01T12:00:00.000000Z" {
+		t.Errorf("newLeaseObject() renewTime = %s, want 2021-09-01T12:00:00.000000Z", renewTime)
+	}
+	if !leaseAvailable(lease, "replica-1", now) || leaseAvailable(lease, "replica-2", now) {
+		t.Errorf("newLeaseObject() has to be held by replica-1 only")
+	}
+}
+
+func TestRunAsLeader(t *testing.T) {
+	memory := useMemoryLeases(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	running := make(chan bool, 1)
+	stopped := make(chan bool)
+	go func() {
+		RunAsLeader(ctx, "pool-manager", func(ctx context.Context) {
+			running <- true
+			<-ctx.Done()
+		})
+		close(stopped)
+	}()
+
+	select {
+	case <-running:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop was not started as leader")
+	}
+	if holder := memory.holder(LeaseName("leader/pool-manager")); holder != leaseHolder {
+		t.Errorf("leader lease held by %q, want %q", holder, leaseHolder)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunAsLeader() did not return after cancellation")
+	}
+	if holder := memory.holder(LeaseName("leader/pool-manager")); holder != "" {
+		t.Errorf("leader lease still held by %q after stopping", holder)
+	}
+}
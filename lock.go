@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// EnvironmentOperation describes how an operation on an environment interacts with other operations on it
+type EnvironmentOperation struct {
+	// Name of the operation, e.g., the task name
+	Name string
+	// Cancellable operations are cancelled by preempting operations instead of blocking them until they are finished
+	Cancellable bool
+	// Preempting operations cancel a running cancellable operation on the environment
+	Preempting bool
+}
+
+// Operations on an environment, a teardown cancels a running setup since the environment is going to be deleted anyway
+var (
+	SetupOperation       = EnvironmentOperation{Name: "environment-setup", Cancellable: true}
+	TeardownOperation    = EnvironmentOperation{Name: "environment-teardown", Preempting: true}
+	UpdateOperation      = EnvironmentOperation{Name: "environment-update"}
+	RemediationOperation = EnvironmentOperation{Name: "action"}
+	DriftCheckOperation  = EnvironmentOperation{Name: "drift-check", Cancellable: true}
+)
+
+// environmentLocks serializes the operations on an environment within this replica, the lease of the environment
+// serializes them across replicas
+var environmentLocks = struct {
+	sync.Mutex
+	locks map[string]*localEnvironmentLock
+	// interrupted is closed once all operations have been interrupted because the service is shutting down
+	interrupted chan struct{}
+}{locks: map[string]*localEnvironmentLock{}, interrupted: make(chan struct{})}
+
+// localEnvironmentLock is the lock of an environment within this replica
+type localEnvironmentLock struct {
+	slot chan struct{}
+	// holder is the lock of the operation currently running on the environment, if any
+	holder *EnvironmentLock
+}
+
+// EnvironmentLock is held by an operation on the environment of an apply set (i.e., project and stage)
+type EnvironmentLock struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	operation EnvironmentOperation
+	mutex     sync.Mutex
+	err       error
+
+	unlock sync.Once
+	held   chan struct{}
+	// released is closed once the lease of the environment has been released
+	released chan struct{}
+}
+
+// ErrOperationCancelled is returned by EnvironmentLock.Err if the operation has been cancelled
+var ErrOperationCancelled = errors.New("operation cancelled")
+
+// ErrServiceShutdown is returned by EnvironmentLock.Err if the operation has been interrupted because the service is
+// shutting down
+var ErrServiceShutdown = fmt.Errorf("%w: the service is shutting down", ErrOperationCancelled)
+
+// Context returns the context of the operation, which is done if the operation has been cancelled
+func (l *EnvironmentLock) Context() context.Context {
+	return l.ctx
+}
+
+// Err returns an error describing why the operation has been cancelled, or nil if it may continue
+func (l *EnvironmentLock) Err() error {
+	if l.ctx.Err() == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.err == nil {
+		return fmt.Errorf("%w: %s", ErrOperationCancelled, l.ctx.Err().Error())
+	}
+	return l.err
+}
+
+// cancelOperation cancels the operation holding the lock, the first reason is kept
+func (l *EnvironmentLock) cancelOperation(reason string) {
+	l.cancelWith(fmt.Errorf("%w: %s", ErrOperationCancelled, reason))
+}
+
+// cancelWith cancels the operation holding the lock with the error returned by Err, the first error is kept
+func (l *EnvironmentLock) cancelWith(err error) {
+	l.mutex.Lock()
+	if l.err == nil {
+		l.err = err
+		log.Printf("Cancelling %s: %s", l.operation.Name, err.Error())
+	}
+	l.mutex.Unlock()
+	l.cancel()
+}
+
+// preempt cancels the operation holding the lock for the preempting operation, if it can be cancelled
+func (l *EnvironmentLock) preempt(by string) {
+	if l.operation.Cancellable {
+		l.cancelOperation("cancelled by " + by)
+	}
+}
+
+// Unlock unlocks the environment, it is safe to call it more than once
+func (l *EnvironmentLock) Unlock() {
+	l.unlock.Do(func() {
+		close(l.held)
+		<-l.released
+		l.cancel()
+	})
+}
+
+// LockEnvironment waits until no other operation is running on the environment of the apply set in any replica of
+// the service and locks it. A preempting operation cancels a running cancellable operation and then waits for it to
+// report its cancellation. waiting is called once if the environment is locked by another operation. Once the
+// service is shutting down, it fails with ErrServiceShutdown.
+func LockEnvironment(ctx context.Context, applySetID string, operation EnvironmentOperation, waiting func()) (*EnvironmentLock, error) {
+	environmentLocks.Lock()
+	local, ok := environmentLocks.locks[applySetID]
+	if !ok {
+		local = &localEnvironmentLock{slot: make(chan struct{}, 1)}
+		environmentLocks.locks[applySetID] = local
+	}
+	if operation.Preempting && local.holder != nil {
+		local.holder.preempt(operation.Name)
+	}
+	interrupted := environmentLocks.interrupted
+	environmentLocks.Unlock()
+
+	select {
+	case <-interrupted:
+		return nil, ErrServiceShutdown
+	default:
+	}
+
+	notify := func() {
+		if waiting != nil {
+			waiting()
+			waiting = nil
+		}
+	}
+
+	select {
+	case local.slot <- struct{}{}:
+	default:
+		notify()
+		select {
+		case local.slot <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-interrupted:
+			return nil, ErrServiceShutdown
+		}
+	}
+
+	operationCtx, cancel := context.WithCancel(ctx)
+	lock := &EnvironmentLock{
+		ctx:       operationCtx,
+		cancel:    cancel,
+		operation: operation,
+		held:      make(chan struct{}),
+		released:  make(chan struct{}),
+	}
+	environmentLocks.Lock()
+	local.holder = lock
+	select {
+	case <-interrupted:
+		lock.cancelWith(ErrServiceShutdown)
+	default:
+	}
+	environmentLocks.Unlock()
+
+	unlockLocal := func() {
+		environmentLocks.Lock()
+		local.holder = nil
+		environmentLocks.Unlock()
+		<-local.slot
+	}
+
+	leaseName := LeaseName("environment/" + applySetID)
+	cancelRequested := false
+	for {
+		state, err := leases.acquire(leaseName, leaseHolder, LeaseDuration)
+		if err != nil {
+			cancel()
+			unlockLocal()
+			return nil, fmt.Errorf("could not acquire lease %s: %s", leaseName, err.Error())
+		}
+		if state.acquired {
+			break
+		}
+		log.Printf("Environment of apply set %s is locked by %s", applySetID, state.holder)
+		notify()
+
+		// the holder checks for requests to cancel its operation whenever it renews the lease
+		if operation.Preempting && !cancelRequested {
+			if err := leases.requestCancel(leaseName, fmt.Sprintf("%s in %s", operation.Name, leaseHolder)); err != nil {
+				log.Printf("Could not request cancellation of the operation on apply set %s: %s", applySetID, err.Error())
+			} else {
+				cancelRequested = true
+			}
+		}
+
+		select {
+		case <-operationCtx.Done():
+			unlockLocal()
+			return nil, lock.Err()
+		case <-time.After(leaseRetryInterval):
+		}
+	}
+
+	go func() {
+		defer close(lock.released)
+		defer unlockLocal()
+		holdLease(context.Background(), leaseName, func(leaseCtx context.Context) {
+			select {
+			case <-lock.held:
+			case <-leaseCtx.Done():
+				// keep the lease until the operation reported that it stopped
+				lock.cancelOperation("the lock of the environment has been lost")
+				<-lock.held
+			}
+		}, func(request string) {
+			lock.preempt(request)
+		})
+	}()
+
+	return lock, nil
+}
+
+// InterruptEnvironmentOperations cancels all operations on environments running in this replica because the service
+// is shutting down, operations waiting for or trying to lock an environment afterwards fail with ErrServiceShutdown
+func InterruptEnvironmentOperations() {
+	environmentLocks.Lock()
+	defer environmentLocks.Unlock()
+
+	select {
+	case <-environmentLocks.interrupted:
+	default:
+		close(environmentLocks.interrupted)
+	}
+	for _, local := range environmentLocks.locks {
+		if local.holder != nil {
+			local.holder.cancelWith(ErrServiceShutdown)
+		}
+	}
+}
+
+// sleepContext waits for the duration, it returns the error of the context if the context is done earlier
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
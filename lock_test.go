@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockEnvironmentSerializesOperations(t *testing.T) {
+	memory := useMemoryLeases(t)
+
+	lock, err := LockEnvironment(context.Background(), "sockshop.dev", UpdateOperation, nil)
+	if err != nil {
+		t.Fatalf("LockEnvironment() error = %v", err)
+	}
+	leaseName := LeaseName("environment/sockshop.dev")
+	if holder := memory.holder(leaseName); holder != leaseHolder {
+		t.Errorf("lease held by %q, want %q", holder, leaseHolder)
+	}
+
+	// other environments are not affected
+	other, err := LockEnvironment(context.Background(), "sockshop.production", UpdateOperation, nil)
+	if err != nil {
+		t.Fatalf("LockEnvironment() for other environment error = %v", err)
+	}
+	other.Unlock()
+
+	waiting := make(chan bool, 1)
+	locked := make(chan *EnvironmentLock, 1)
+	go func() {
+		second, err := LockEnvironment(context.Background(), "sockshop.dev", SetupOperation, func() {
+			waiting <- true
+		})
+		if err != nil {
+			t.Errorf("second LockEnvironment() error = %v", err)
+		}
+		locked <- second
+	}()
+
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second operation is not waiting for the lock")
+	}
+	select {
+	case <-locked:
+		t.Fatal("second operation got the lock while the first one holds it")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	lock.Unlock()
+	select {
+	case second := <-locked:
+		second.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("second operation did not get the lock after unlocking")
+	}
+	if holder := memory.holder(leaseName); holder != "" {
+		t.Errorf("lease still held by %q after unlocking", holder)
+	}
+}
+
+func TestLockEnvironmentTeardownCancelsSetup(t *testing.T) {
+	useMemoryLeases(t)
+
+	setup, err := LockEnvironment(context.Background(), "sockshop.dev", SetupOperation, nil)
+	if err != nil {
+		t.Fatalf("LockEnvironment() error = %v", err)
+	}
+
+	locked := make(chan *EnvironmentLock, 1)
+	go func() {
+		teardown, err := LockEnvironment(context.Background(), "sockshop.dev", TeardownOperation, nil)
+		if err != nil {
+			t.Errorf("LockEnvironment() for teardown error = %v", err)
+		}
+		locked <- teardown
+	}()
+
+	// the setup notices the cancellation while waiting
+	if err := sleepContext(setup.Context(), 5*time.Second); err == nil {
+		t.Fatal("setup has not been cancelled by the teardown")
+	}
+	if err := setup.Err(); !errors.Is(err, ErrOperationCancelled) {
+		t.Errorf("setup Err() = %v, want %v", err, ErrOperationCancelled)
+	}
+
+	// the teardown proceeds once the setup reported its cancellation
+	select {
+	case <-locked:
+		t.Fatal("teardown got the lock before the setup stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	setup.Unlock()
+	select {
+	case teardown := <-locked:
+		if err := teardown.Err(); err != nil {
+			t.Errorf("teardown Err() = %v, want nil", err)
+		}
+		teardown.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("teardown did not get the lock after the setup stopped")
+	}
+}
+
+func TestLockEnvironmentTeardownWaitsForUpdate(t *testing.T) {
+	useMemoryLeases(t)
+
+	update, err := LockEnvironment(context.Background(), "sockshop.dev", UpdateOperation, nil)
+	if err != nil {
+		t.Fatalf("LockEnvironment() error = %v", err)
+	}
+
+	locked := make(chan *EnvironmentLock, 1)
+	go func() {
+		teardown, err := LockEnvironment(context.Background(), "sockshop.dev", TeardownOperation, nil)
+		if err != nil {
+			t.Errorf("LockEnvironment() for teardown error = %v", err)
+		}
+		locked <- teardown
+	}()
+
+	if err := sleepContext(update.Context(), 200*time.Millisecond); err != nil {
+		t.Errorf("update has been cancelled: %v", update.Err())
+	}
+	update.Unlock()
+	select {
+	case teardown := <-locked:
+		teardown.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("teardown did not get the lock after the update finished")
+	}
+}
+
+func TestLockEnvironmentTeardownRequestsCancellationFromOtherReplica(t *testing.T) {
+	memory := useMemoryLeases(t)
+	leaseName := LeaseName("environment/sockshop.dev")
+	memory.holders[leaseName] = "another-replica"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waited := make(chan bool, 1)
+	go func() {
+		LockEnvironment(ctx, "sockshop.dev", TeardownOperation, func() {
+			waited <- true
+		})
+	}()
+
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("teardown is not waiting for the other replica")
+	}
+	memory.mutex.Lock()
+	request := memory.cancels[leaseName]
+	memory.mutex.Unlock()
+	if request == "" {
+		t.Errorf("teardown did not request the other replica to cancel its operation")
+	}
+}
+
+func TestLockEnvironmentWaitIsCancelled(t *testing.T) {
+	memory := useMemoryLeases(t)
+	memory.holders[LeaseName("environment/sockshop.dev")] = "another-replica"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := false
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := LockEnvironment(ctx, "sockshop.dev", SetupOperation, func() { waited = true }); !errors.Is(err, ErrOperationCancelled) {
+		t.Errorf("LockEnvironment() error = %v, want %v", err, ErrOperationCancelled)
+	}
+	if !waited {
+		t.Errorf("LockEnvironment() did not report waiting for another replica")
+	}
+
+	// the environment is not locked within this replica after the cancelled attempt
+	memory.mutex.Lock()
+	memory.holders = map[string]string{}
+	memory.mutex.Unlock()
+	lock, err := LockEnvironment(context.Background(), "sockshop.dev", SetupOperation, nil)
+	if err != nil {
+		t.Fatalf("LockEnvironment() error = %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestLockEnvironmentFailsIfLeasesAreUnavailable(t *testing.T) {
+	memory := useMemoryLeases(t)
+	memory.err = errors.New("leases.coordination.k8s.io is forbidden")
+
+	if _, err := LockEnvironment(context.Background(), "sockshop.dev", SetupOperation, nil); err == nil {
+		t.Errorf("LockEnvironment() error = nil, want error")
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
 	"github.com/kelseyhightower/envconfig"
 	keptn "github.com/keptn/go-utils/pkg/lib/keptn"
 	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+	"github.com/nats-io/nats.go"
 )
 
 var keptnOptions = keptn.KeptnOpts{}
@@ -24,13 +29,54 @@ type envConfig struct {
 	Env string `envconfig:"ENV" default:"local"`
 	// URL of the Keptn configuration service (this is where we can fetch files from the config repo)
 	ConfigurationServiceUrl string `envconfig:"CONFIGURATION_SERVICE" default:""`
+	// Namespace the service is running in, used to store the inventory of apply sets
+	PodNamespace string `envconfig:"POD_NAMESPACE" default:"keptn"`
+	// Version of the service, added as annotation to all applied objects
+	Version string `envconfig:"VERSION" default:"develop"`
+	// URL of the Keptn API (e.g., https://keptn.example.com/api), if set the service pulls events from the API instead of receiving them
+	KeptnAPIEndpoint string `envconfig:"KEPTN_API_ENDPOINT" default:""`
+	// Token used to authenticate at the Keptn API
+	KeptnAPIToken string `envconfig:"KEPTN_API_TOKEN" default:""`
+	// Whether the certificate of the Keptn API is validated
+	HTTPSSLVerify bool `envconfig:"HTTP_SSL_VERIFY" default:"true"`
+	// Interval in which the Keptn API is polled for new events
+	PullInterval time.Duration `envconfig:"PULL_INTERVAL" default:"10s"`
+	// URL of the NATS server (e.g., nats://keptn-nats-cluster:4222), if set the service subscribes to NATS directly instead of receiving events from a distributor
+	PubSubURL string `envconfig:"PUBSUB_URL" default:""`
+	// Comma separated list of NATS subjects to subscribe to, defaults to all events handled by the service
+	PubSubTopic string `envconfig:"PUBSUB_TOPIC" default:""`
+	// NATS queue group shared by all replicas of the service
+	PubSubGroup string `envconfig:"PUBSUB_GROUP" default:"crossplane-service"`
+	// Comma separated list of projects, globs or /regular expressions/ the service handles events for, empty for all
+	ProjectFilter string `envconfig:"PROJECT_FILTER" default:""`
+	// Comma separated list of stages, globs or /regular expressions/ the service handles events for, empty for all
+	StageFilter string `envconfig:"STAGE_FILTER" default:""`
+	// Comma separated list of services, globs or /regular expressions/ the service handles events for, empty for all
+	ServiceFilter string `envconfig:"SERVICE_FILTER" default:""`
+	// Time running event handlers get to finish after SIGTERM before their operations are interrupted
+	ShutdownGracePeriod time.Duration `envconfig:"SHUTDOWN_GRACE_PERIOD" default:"20s"`
+	// Interval in which the tracked environments are checked for drift, 0 disables the check
+	DriftCheckInterval time.Duration `envconfig:"DRIFT_CHECK_INTERVAL" default:"15m"`
+	// Port the metrics are served on, 0 disables the metrics
+	MetricsPort int `envconfig:"METRICS_PORT" default:"9090"`
+	// Directory Helm charts and values files may be loaded from by their absolute path, empty for charts of the Keptn git repo only
+	LocalChartDirectory string `envconfig:"LOCAL_CHART_DIRECTORY" default:""`
 }
 
+// serviceNamespace is the namespace the service is running in
+var serviceNamespace = "keptn"
+
+// serviceVersion is the version of the service
+var serviceVersion = "develop"
+
 // ServiceName specifies the current services name (e.g., used as source when sending CloudEvents)
 const ServiceName = "crossplane-service"
 
-// CrossPlaneFilename is the path for the crossplane file that will be applied
-const CrossPlaneFilename = "crossplane/cluster.yaml"
+// RenderedManifestPattern is the pattern of the temporary files the combined crossplane manifest is stored in
+const RenderedManifestPattern = "crossplane-*.yaml"
+
+// KubeconfigPattern is the pattern of the temporary files the kubeconfig of a created cluster is stored in
+const KubeconfigPattern = "kubeconfig-*"
 
 // EnvironemtsetupFinishedEventData is the name of an echo triggered event
 const EnvironmentsetupEventTriggeredType = "sh.keptn.event.environment-setup.triggered"
@@ -41,9 +87,54 @@ const EnvironmentsetupStartedEventType = "sh.keptn.event.environment-setup.start
 // EnvironemtsetupFinishedEventData is the name of an echo finished event
 const EnvironmentsetupFinishedEventType = "sh.keptn.event.environment-setup.finished"
 
+// StatusAborted is the status of a task that has been cancelled before it finished
+const StatusAborted keptnv2.StatusType = "aborted"
+
+// EnvironmentSetupModeApply applies the manifest to the management cluster (default)
+const EnvironmentSetupModeApply = "apply"
+
+// EnvironmentSetupModePlan only performs a server-side dry-run and reports the diff against the live objects
+const EnvironmentSetupModePlan = "plan"
+
+// Maximum times the event handlers wait for Crossplane
+const (
+	// EnvironmentSetupTimeout is the maximum time to wait for the connection secret of a new environment
+	EnvironmentSetupTimeout = 60 * time.Minute
+	// EnvironmentUpdateTimeout is the maximum time to wait for Crossplane to reconcile an updated environment
+	EnvironmentUpdateTimeout = 30 * time.Minute
+	// EnvironmentRemediationTimeout is the maximum time to wait for an environment to become Ready after a remediation
+	EnvironmentRemediationTimeout = 30 * time.Minute
+	// EnvironmentTeardownTimeout is the maximum time to wait for Crossplane to delete the objects of the crossplane file
+	EnvironmentTeardownTimeout = 30 * time.Minute
+)
+
+// EnvironmentSetupProperties are the task properties of the environment-setup task as defined in the shipyard
+type EnvironmentSetupProperties struct {
+	HelmChartProperties
+	CompositionProperties
+	Mode string `json:"mode,omitempty"`
+	// Existing is the policy for an environment that already exists: create-only, adopt or replace
+	Existing string `json:"existing,omitempty"`
+	// OnFailure is the policy for the objects created by a failed setup: keep or delete
+	OnFailure string `json:"onFailure,omitempty"`
+}
+
+// EnvironmentSetupFinishedDetails are the task specific details reported in the environment-setup.finished event
+type EnvironmentSetupFinishedDetails struct {
+	Mode      string   `json:"mode,omitempty"`
+	Diff      string   `json:"diff,omitempty"`
+	Pruned    []string `json:"pruned,omitempty"`
+	Composite string   `json:"composite,omitempty"`
+	Pooled    bool     `json:"pooled,omitempty"`
+	Existing  string   `json:"existing,omitempty"`
+	// Rollback reports what happened to the objects created by a failed setup
+	Rollback *RollbackDetails `json:"rollback,omitempty"`
+}
+
 // EnvironemtsetupFinishedEventData is the data of an echo triggered event
 type EnvironmentsetupTriggeredEventData struct {
 	keptnv2.EventData
+	EnvironmentSetup EnvironmentSetupProperties `json:"environment-setup"`
 }
 
 // EnvironemtsetupFinishedEventData is the data of an echo started event
@@ -54,6 +145,7 @@ type EnvironmentsetupStartedEventData struct {
 // EnvironemtsetupFinishedEventData is the data of an echo finished event
 type EnvironmentsetupFinishedEventData struct {
 	keptnv2.EventData
+	EnvironmentSetup EnvironmentSetupFinishedDetails `json:"environment-setup"`
 }
 
 const EnvironmentTeardownTriggeredEventType = "sh.keptn.event.environment-teardown.triggered"
@@ -62,12 +154,66 @@ const EnvironmentTeardownFinishedEventType = "sh.keptn.event.environment-teardow
 
 type EnvironmentTeardownTriggeredEventData struct {
 	keptnv2.EventData
+	EnvironmentTeardown EnvironmentTeardownProperties `json:"environment-teardown"`
+}
+
+// EnvironmentTeardownProperties are the task properties of the environment-teardown task as defined in the shipyard
+type EnvironmentTeardownProperties struct {
+	HelmChartProperties
+	CompositionProperties
+	// OverrideProtection tears down protected stages and environments, which are refused otherwise
+	OverrideProtection bool `json:"overrideProtection,omitempty"`
 }
 type EnvironmentTeardownStartedEventData struct {
 	keptnv2.EventData
 }
 type EnvironmentTeardownFinishedEventData struct {
 	keptnv2.EventData
+	EnvironmentTeardown EnvironmentTeardownFinishedDetails `json:"environment-teardown"`
+}
+
+// EnvironmentTeardownFinishedDetails are the task specific details reported in the environment-teardown.finished event
+type EnvironmentTeardownFinishedDetails struct {
+	Pruned   []string `json:"pruned,omitempty"`
+	Recycled []string `json:"recycled,omitempty"`
+	// Protected are the protected environments that have been torn down with an override or kept due to a refusal
+	Protected []string `json:"protected,omitempty"`
+	// Refused is true if the teardown has been refused because the stage or environment is protected
+	Refused bool `json:"refused,omitempty"`
+}
+
+const EnvironmentUpdateTriggeredEventType = "sh.keptn.event.environment-update.triggered"
+const EnvironmentUpdateStartedEventType = "sh.keptn.event.environment-update.started"
+const EnvironmentUpdateFinishedEventType = "sh.keptn.event.environment-update.finished"
+
+type EnvironmentUpdateTriggeredEventData struct {
+	keptnv2.EventData
+	EnvironmentUpdate EnvironmentUpdateProperties `json:"environment-update"`
+}
+
+// EnvironmentUpdateProperties are the task properties of the environment-update task as defined in the shipyard
+type EnvironmentUpdateProperties struct {
+	HelmChartProperties
+	CompositionProperties
+	// Parameters are merged into spec.parameters of the existing composite or claim
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+type EnvironmentUpdateFinishedEventData struct {
+	keptnv2.EventData
+	EnvironmentUpdate EnvironmentUpdateFinishedDetails `json:"environment-update"`
+}
+
+// EnvironmentUpdateFinishedDetails are the task specific details reported in the environment-update.finished event
+type EnvironmentUpdateFinishedDetails struct {
+	Environment string                 `json:"environment,omitempty"`
+	Before      map[string]interface{} `json:"before,omitempty"`
+	After       map[string]interface{} `json:"after,omitempty"`
+}
+
+// EnvironmentDriftTriggeredEventData is the data of the triggered event of the sequence triggered for a drifted environment
+type EnvironmentDriftTriggeredEventData struct {
+	keptnv2.EventData
+	EnvironmentDrift DriftReport `json:"environment-drift"`
 }
 
 /**
@@ -76,27 +222,69 @@ type EnvironmentTeardownFinishedEventData struct {
 func parseKeptnCloudEventPayload(event cloudevents.Event, data interface{}) error {
 	err := event.DataAs(data)
 	if err != nil {
-		log.Fatalf("Got Data Error: %s", err.Error())
-		return err
+		return fmt.Errorf("invalid payload of %s event %s: %s", event.Type(), event.ID(), err.Error())
 	}
 	return nil
 }
 
+// rejectKeptnCloudEvent reports a triggered event whose payload could not be parsed in an errored finished event if
+// the event can be addressed, i.e., it belongs to a project and stage. Otherwise the rejection is only logged, since
+// Keptn could not match a finished event to the task anyway.
+func rejectKeptnCloudEvent(myKeptn *keptnv2.Keptn, event cloudevents.Event, invalid error) error {
+	logMessage := fmt.Sprintf("Rejecting event %s: %s", event.ID(), invalid.Error())
+	log.Printf(logMessage)
+	if myKeptn.Event.GetProject() == "" || myKeptn.Event.GetStage() == "" {
+		return invalid
+	}
+
+	_, err := myKeptn.SendTaskStartedEvent(&keptnv2.EventData{}, ServiceName)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to send task started CloudEvent (%s), aborting...", err.Error())
+		log.Println(errMsg)
+		return err
+	}
+
+	_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+		Status:  keptnv2.StatusErrored,
+		Result:  keptnv2.ResultFailed,
+		Message: logMessage,
+	}, ServiceName)
+
+	return err
+}
+
 /**
  * This method gets called when a new event is received from the Keptn Event Distributor
  * Depending on the Event Type will call the specific event handler functions, e.g: handleDeploymentFinishedEvent
  * See https://github.com/keptn/spec/blob/0.2.0-alpha/cloudevents.md for details on the payload
  */
 func processKeptnCloudEvent(ctx context.Context, event cloudevents.Event) error {
+	// events without a Keptn context cannot be handled, and a Keptn handler cannot be created for them
+	if keptnContext, ok := event.Extensions()["shkeptncontext"].(string); !ok || keptnContext == "" {
+		log.Printf("Rejecting %s event %s without Keptn context", event.Type(), event.ID())
+		return fmt.Errorf("%s event %s has no Keptn context", event.Type(), event.ID())
+	}
+
 	// create keptn handler
 	log.Printf("Initializing Keptn Handler")
 	myKeptn, err := keptnv2.NewKeptn(&event, keptnOptions)
 	if err != nil {
 		return errors.New("Could not create Keptn Handler: " + err.Error())
 	}
+	myKeptn.EventSender = handlers.Sender(myKeptn.EventSender)
+
+	// in pull mode, the resources are fetched through the Keptn API as well
+	if keptnAPI != nil {
+		myKeptn.ResourceHandler = keptnAPI.ResourceHandler()
+	}
 
 	log.Printf("gotEvent(%s): %s - %s", event.Type(), myKeptn.KeptnContext, event.Context.GetID())
 
+	if !eventFilter.Matches(myKeptn.Event.GetProject(), myKeptn.Event.GetStage(), myKeptn.Event.GetService()) {
+		log.Printf("Ignoring event %s for project %s, stage %s and service %s, which does not match the filter", event.Context.GetID(), myKeptn.Event.GetProject(), myKeptn.Event.GetStage(), myKeptn.Event.GetService())
+		return nil
+	}
+
 	if err != nil {
 		log.Printf("failed to parse incoming cloudevent: %v", err)
 		return err
@@ -153,11 +341,11 @@ func processKeptnCloudEvent(ctx context.Context, event cloudevents.Event) error
 		log.Printf("Processing environment-setup.triggered Event")
 
 		eventData := &EnvironmentsetupTriggeredEventData{}
-		parseKeptnCloudEventPayload(event, eventData)
+		if err := parseKeptnCloudEventPayload(event, eventData); err != nil {
+			return rejectKeptnCloudEvent(myKeptn, event, err)
+		}
 
 		return HandleEnvironmentSetupTriggeredEvent(myKeptn, event, eventData)
-
-		break
 	case keptnv2.GetStartedEventType(keptnv2.ConfigureMonitoringTaskName): // sh.keptn.event.your-event.started
 		log.Printf("Processing your-event.started Event")
 		// eventData := &keptnv2.YourEventStartedEventData{}
@@ -183,11 +371,48 @@ func processKeptnCloudEvent(ctx context.Context, event cloudevents.Event) error
 		log.Printf("Processing environment-teardown.triggered Event")
 
 		eventData := &EnvironmentTeardownTriggeredEventData{}
-		parseKeptnCloudEventPayload(event, eventData)
+		if err := parseKeptnCloudEventPayload(event, eventData); err != nil {
+			return rejectKeptnCloudEvent(myKeptn, event, err)
+		}
 
 		return HandleEnvironmentTeardownTriggeredEvent(myKeptn, event, eventData)
 
-		break
+		// environment update event
+	case keptnv2.GetTriggeredEventType("environment-update"):
+		log.Printf("Processing environment-update.triggered Event")
+
+		eventData := &EnvironmentUpdateTriggeredEventData{}
+		if err := parseKeptnCloudEventPayload(event, eventData); err != nil {
+			return rejectKeptnCloudEvent(myKeptn, event, err)
+		}
+
+		return HandleEnvironmentUpdateTriggeredEvent(myKeptn, event, eventData)
+
+		// remediation action event
+	case keptnv2.GetTriggeredEventType(keptnv2.ActionTaskName):
+		log.Printf("Processing action.triggered Event")
+
+		// the action might be handled by another remediation service, hence an invalid payload is not answered
+		eventData := &keptnv2.ActionTriggeredEventData{}
+		if err := parseKeptnCloudEventPayload(event, eventData); err != nil {
+			log.Printf("Rejecting event %s: %s", event.ID(), err.Error())
+			return err
+		}
+
+		return HandleActionTriggeredEvent(myKeptn, event, eventData)
+
+		// SLI provider event
+	case keptnv2.GetTriggeredEventType(keptnv2.GetSLITaskName):
+		log.Printf("Processing get-sli.triggered Event")
+
+		// the SLIs might be provided by another SLI provider, hence an invalid payload is not answered
+		eventData := &keptnv2.GetSLITriggeredEventData{}
+		if err := parseKeptnCloudEventPayload(event, eventData); err != nil {
+			log.Printf("Rejecting event %s: %s", event.ID(), err.Error())
+			return err
+		}
+
+		return HandleGetSLITriggeredEvent(myKeptn, event, eventData)
 	case keptnv2.GetStartedEventType(keptnv2.ConfigureMonitoringTaskName): // sh.keptn.event.your-event.started
 		log.Printf("Processing your-event.started Event")
 		// eventData := &keptnv2.YourEventStartedEventData{}
@@ -244,11 +469,75 @@ func _main(args []string, env envConfig) int {
 	}
 
 	keptnOptions.ConfigurationServiceURL = env.ConfigurationServiceUrl
+	serviceNamespace = env.PodNamespace
+	serviceVersion = env.Version
+	localChartDirectory = env.LocalChartDirectory
+
+	filter, err := NewEventFilter(env.ProjectFilter, env.StageFilter, env.ServiceFilter)
+	if err != nil {
+		log.Fatalf("failed to configure the event filter, %v", err)
+	}
+	eventFilter = filter
 
 	log.Println("Starting crossplane-service...")
-	log.Printf("    on Port = %d; Path=%s", env.Port, env.Path)
 
-	ctx := context.Background()
+	// SIGTERM stops receiving new events, the running handlers get the grace period to finish
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	handler := handlers.Track(processKeptnCloudEvent)
+
+	if env.MetricsPort != 0 {
+		log.Printf("    serving metrics on port %d", env.MetricsPort)
+		go ServeMetrics(ctx, env.MetricsPort)
+	}
+	// the drift checks may send events, hence they are started once the event sender is configured
+	startDriftChecks := func() {
+		if env.DriftCheckInterval > 0 {
+			log.Printf("    checking environments for drift every %s", env.DriftCheckInterval)
+			go RunAsLeader(ctx, "drift-check", func(ctx context.Context) {
+				RunDriftChecks(ctx, env.DriftCheckInterval)
+			})
+		}
+	}
+
+	if env.KeptnAPIEndpoint != "" {
+		connection, err := NewKeptnAPIConnection(env.KeptnAPIEndpoint, env.KeptnAPIToken, env.HTTPSSLVerify)
+		if err != nil {
+			log.Fatalf("failed to connect to the Keptn API, %v", err)
+		}
+		keptnAPI = connection
+		keptnOptions.EventSender = connection.EventSender()
+		startDriftChecks()
+
+		log.Printf("    pulling events from the Keptn API %s every %s", env.KeptnAPIEndpoint, env.PullInterval)
+		NewEventPuller(connection, SubscribedEventTypes, env.PullInterval, handler).Run(ctx)
+		handlers.Shutdown(env.ShutdownGracePeriod)
+		return 0
+	}
+
+	if env.PubSubURL != "" {
+		conn, err := nats.Connect(env.PubSubURL, nats.Name(ServiceName), nats.MaxReconnects(-1))
+		if err != nil {
+			log.Fatalf("failed to connect to NATS, %v", err)
+		}
+		defer conn.Close()
+		keptnOptions.EventSender = NewNATSEventSender(conn)
+		startDriftChecks()
+
+		topics := NATSTopics(env.PubSubTopic)
+		log.Printf("    subscribing to %s on %s in queue group %s", strings.Join(topics, ","), env.PubSubURL, env.PubSubGroup)
+		subscriber := NewNATSSubscriber(conn, topics, env.PubSubGroup, handler)
+		if err := subscriber.Subscribe(ctx); err != nil {
+			log.Fatalf("failed to subscribe to NATS, %v", err)
+		}
+		<-ctx.Done()
+		subscriber.Unsubscribe()
+		handlers.Shutdown(env.ShutdownGracePeriod)
+		return 0
+	}
+
+	startDriftChecks()
+	log.Printf("    on Port = %d; Path=%s", env.Port, env.Path)
 	ctx = cloudevents.WithEncodingStructured(ctx)
 
 	log.Printf("Creating new http handler")
@@ -265,7 +554,13 @@ func _main(args []string, env envConfig) int {
 	}
 
 	log.Printf("Starting receiver")
-	log.Fatal(c.StartReceiver(ctx, processKeptnCloudEvent))
+	go func() {
+		if err := c.StartReceiver(ctx, handler); err != nil && ctx.Err() == nil {
+			log.Fatalf("failed to start receiver, %v", err)
+		}
+	}()
+	<-ctx.Done()
+	handlers.Shutdown(env.ShutdownGracePeriod)
 
 	return 0
 }
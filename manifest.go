@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// manifestObject is a single Kubernetes object of a (possibly multi-document) Crossplane manifest
+type manifestObject map[string]interface{}
+
+// parseManifest splits a YAML manifest into its documents and returns all non-empty objects
+func parseManifest(content []byte) ([]manifestObject, error) {
+	var objects []manifestObject
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for index := 0; ; index++ {
+		var document interface{}
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse document %d of manifest: %s", index, err.Error())
+		}
+		if document == nil {
+			continue
+		}
+
+		object, ok := convertYAMLValue(document).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("document %d of manifest is not a Kubernetes object", index)
+		}
+		if object["apiVersion"] == nil || object["kind"] == nil {
+			return nil, fmt.Errorf("document %d of manifest is missing apiVersion or kind", index)
+		}
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+// marshalManifest serializes the objects back into a multi-document YAML manifest
+func marshalManifest(objects []manifestObject) ([]byte, error) {
+	var buffer bytes.Buffer
+	for index, object := range objects {
+		if index > 0 {
+			buffer.WriteString("---\n")
+		}
+		out, err := yaml.Marshal(map[string]interface{}(object))
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(out)
+	}
+	return buffer.Bytes(), nil
+}
+
+// convertYAMLValue turns the map[interface{}]interface{} maps produced by yaml.v2 into JSON compatible maps
+func convertYAMLValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			result[fmt.Sprintf("%v", key)] = convertYAMLValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			result[key] = convertYAMLValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(typed))
+		for index, item := range typed {
+			result[index] = convertYAMLValue(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+func (o manifestObject) apiVersion() string {
+	return nestedString(o, "apiVersion")
+}
+
+func (o manifestObject) kind() string {
+	return nestedString(o, "kind")
+}
+
+func (o manifestObject) name() string {
+	return nestedString(o, "metadata", "name")
+}
+
+func (o manifestObject) namespace() string {
+	return nestedString(o, "metadata", "namespace")
+}
+
+// group returns the API group of the object, e.g., devopstoolkitseries.com
+func (o manifestObject) group() string {
+	apiVersion := o.apiVersion()
+	if index := strings.Index(apiVersion, "/"); index >= 0 {
+		return apiVersion[:index]
+	}
+	return ""
+}
+
+// version returns the API version of the object without the group, e.g., v1alpha1
+func (o manifestObject) version() string {
+	apiVersion := o.apiVersion()
+	return apiVersion[strings.Index(apiVersion, "/")+1:]
+}
+
+// resource returns the fully qualified kind of the object as understood by kubectl, e.g., CompositeCluster.devopstoolkitseries.com
+func (o manifestObject) resource() string {
+	if o.group() == "" {
+		return o.kind()
+	}
+	return o.kind() + "." + o.group()
+}
+
+// String returns a human readable identifier of the object, e.g., CompositeCluster/keptn-crossplane
+func (o manifestObject) String() string {
+	if o.namespace() != "" {
+		return fmt.Sprintf("%s/%s/%s", o.kind(), o.namespace(), o.name())
+	}
+	return fmt.Sprintf("%s/%s", o.kind(), o.name())
+}
+
+// nestedValue returns the value found by following the fields in the object, or nil if it does not exist
+func nestedValue(object map[string]interface{}, fields ...string) interface{} {
+	var current interface{} = object
+	for _, field := range fields {
+		currentMap, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = currentMap[field]
+	}
+	return current
+}
+
+// nestedString returns the string found by following the fields in the object, or an empty string
+func nestedString(object map[string]interface{}, fields ...string) string {
+	value, _ := nestedValue(object, fields...).(string)
+	return value
+}
+
+// nestedMap returns the map found by following the fields in the object, or nil
+func nestedMap(object map[string]interface{}, fields ...string) map[string]interface{} {
+	value, _ := nestedValue(object, fields...).(map[string]interface{})
+	return value
+}
+
+// setNestedValue sets the value at the path described by fields, creating intermediate maps as needed
+func setNestedValue(object map[string]interface{}, value interface{}, fields ...string) {
+	current := object
+	for _, field := range fields[:len(fields)-1] {
+		next, ok := current[field].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			current[field] = next
+		}
+		current = next
+	}
+	current[fields[len(fields)-1]] = value
+}
+
+// setLabel sets the label on the object, creating the labels if needed
+func (o manifestObject) setLabel(key string, value string) {
+	setNestedValue(o, value, "metadata", "labels", key)
+}
+
+// setAnnotation sets the annotation on the object, creating the annotations if needed
+func (o manifestObject) setAnnotation(key string, value string) {
+	setNestedValue(o, value, "metadata", "annotations", key)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsPath is the path the metrics are served on in the Prometheus text format
+const MetricsPath = "/metrics"
+
+// driftMetrics holds the results of the last drift check per apply set, which are exposed as metrics
+var driftMetrics = newDriftMetricStore()
+
+// driftMetricStore keeps the last drift report per apply set and counts reconciliations and failed checks
+type driftMetricStore struct {
+	mutex   sync.Mutex
+	reports map[string]DriftReport
+	// reconciliations counts the reconciliations per apply set
+	reconciliations map[string]int
+	// failures counts the drift checks that could not list the tracked environments
+	failures int
+}
+
+func newDriftMetricStore() *driftMetricStore {
+	return &driftMetricStore{
+		reports:         map[string]DriftReport{},
+		reconciliations: map[string]int{},
+	}
+}
+
+// record stores the report of the apply set
+func (s *driftMetricStore) record(applySetID string, report DriftReport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reports[applySetID] = report
+	if report.Reconciled {
+		s.reconciliations[applySetID]++
+	}
+}
+
+// forget removes the metrics of the apply set, e.g., because its stage is not checked anymore
+func (s *driftMetricStore) forget(applySetID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.reports, applySetID)
+	delete(s.reconciliations, applySetID)
+}
+
+// retain removes the metrics of the apply sets that have not been checked, e.g., because they have been torn down
+func (s *driftMetricStore) retain(applySetIDs map[string]bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for applySetID := range s.reports {
+		if !applySetIDs[applySetID] {
+			delete(s.reports, applySetID)
+			delete(s.reconciliations, applySetID)
+		}
+	}
+}
+
+// failed counts a drift check that could not list the tracked environments
+func (s *driftMetricStore) failed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures++
+}
+
+// reset removes all metrics, so that a replica that is not the leader anymore does not expose outdated results
+func (s *driftMetricStore) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reports = map[string]DriftReport{}
+	s.reconciliations = map[string]int{}
+	s.failures = 0
+}
+
+// driftGauges are the metrics exposed per checked environment
+var driftGauges = []struct {
+	name  string
+	help  string
+	value func(report DriftReport) float64
+}{
+	{
+		name:  "crossplane_service_environment_drifted",
+		help:  "Whether the environment differs from the crossplane files (1) or not (0)",
+		value: func(report DriftReport) float64 { return boolMetric(report.Drifted()) },
+	},
+	{
+		name:  "crossplane_service_environment_drift_changed_fields",
+		help:  "Number of fields of live objects that differ from the crossplane files",
+		value: func(report DriftReport) float64 { return float64(len(report.Changed)) },
+	},
+	{
+		name:  "crossplane_service_environment_drift_missing_objects",
+		help:  "Number of objects of the crossplane files that do not exist in the management cluster",
+		value: func(report DriftReport) float64 { return float64(len(report.Missing)) },
+	},
+	{
+		name:  "crossplane_service_environment_drift_extra_objects",
+		help:  "Number of objects of the apply set of the environment that are not part of the crossplane files",
+		value: func(report DriftReport) float64 { return float64(len(report.Extra)) },
+	},
+	{
+		name:  "crossplane_service_environment_drift_repository_changed",
+		help:  "Whether the crossplane files changed since the environment has been set up (1) or not (0)",
+		value: func(report DriftReport) float64 { return boolMetric(report.RepositoryChanged) },
+	},
+	{
+		name:  "crossplane_service_environment_drift_check_failed",
+		help:  "Whether the last drift check of the environment failed (1) or not (0)",
+		value: func(report DriftReport) float64 { return boolMetric(report.Error != "") },
+	},
+	{
+		name:  "crossplane_service_environment_drift_last_check_timestamp_seconds",
+		help:  "Time of the last drift check of the environment",
+		value: func(report DriftReport) float64 { return float64(report.Checked.UnixNano()) / float64(time.Second) },
+	},
+}
+
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// WriteTo writes the metrics in the Prometheus text format, one series per checked environment
+func (s *driftMetricStore) WriteTo(w io.Writer) (int64, error) {
+	s.mutex.Lock()
+	applySetIDs := make([]string, 0, len(s.reports))
+	for applySetID := range s.reports {
+		applySetIDs = append(applySetIDs, applySetID)
+	}
+	sort.Strings(applySetIDs)
+
+	var builder strings.Builder
+	for _, gauge := range driftGauges {
+		fmt.Fprintf(&builder, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for _, applySetID := range applySetIDs {
+			report := s.reports[applySetID]
+			fmt.Fprintf(&builder, "%s{%s} %g\n", gauge.name, metricLabels(report), gauge.value(report))
+		}
+	}
+	builder.WriteString("# HELP crossplane_service_environment_drift_reconciliations_total Number of reconciliations of the environment with the crossplane files\n")
+	builder.WriteString("# TYPE crossplane_service_environment_drift_reconciliations_total counter\n")
+	for _, applySetID := range applySetIDs {
+		fmt.Fprintf(&builder, "crossplane_service_environment_drift_reconciliations_total{%s} %d\n", metricLabels(s.reports[applySetID]), s.reconciliations[applySetID])
+	}
+	builder.WriteString("# HELP crossplane_service_drift_check_failures_total Number of drift checks that could not list the environments\n")
+	builder.WriteString("# TYPE crossplane_service_drift_check_failures_total counter\n")
+	fmt.Fprintf(&builder, "crossplane_service_drift_check_failures_total %d\n", s.failures)
+	s.mutex.Unlock()
+
+	written, err := io.WriteString(w, builder.String())
+	return int64(written), err
+}
+
+// metricLabels returns the labels identifying the environment of the report
+func metricLabels(report DriftReport) string {
+	return fmt.Sprintf(`project="%s",stage="%s"`, escapeLabelValue(report.Project), escapeLabelValue(report.Stage))
+}
+
+// escapeLabelValue escapes a label value as required by the Prometheus text format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// ServeMetrics serves the metrics on the port until the context is done
+func ServeMetrics(ctx context.Context, port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if _, err := driftMetrics.WriteTo(w); err != nil {
+			log.Printf("Could not write metrics: %s", err.Error())
+		}
+	})
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Could not serve metrics on port %d: %s", port, err.Error())
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDriftMetricStoreWriteTo(t *testing.T) {
+	store := newDriftMetricStore()
+	store.record("sockshop.dev", DriftReport{
+		Project: "sockshop",
+		Stage:   "dev",
+		Changed: []string{"CompositeCluster/dev: spec.parameters.nodeSize", "CompositeCluster/dev: metadata.labels.team"},
+		Checked: time.Unix(1700000000, 0),
+	})
+	store.record("sockshop.production", DriftReport{
+		Project:    "sockshop",
+		Stage:      "production",
+		Missing:    []string{"CompositeCluster/production"},
+		Reconciled: true,
+		Checked:    time.Unix(1700000000, 0),
+	})
+	store.record("sockshop.staging", DriftReport{Project: "sockshop", Stage: "staging", Checked: time.Unix(1700000000, 0)})
+	store.failed()
+
+	var builder strings.Builder
+	if _, err := store.WriteTo(&builder); err != nil {
+		t.Fatal(err)
+	}
+	metrics := builder.String()
+	for _, want := range []string{
+		"# TYPE crossplane_service_environment_drifted gauge\n",
+		`crossplane_service_environment_drifted{project="sockshop",stage="dev"} 1` + "\n",
+		`crossplane_service_environment_drifted{project="sockshop",stage="staging"} 0` + "\n",
+		`crossplane_service_environment_drift_changed_fields{project="sockshop",stage="dev"} 2` + "\n",
+		`crossplane_service_environment_drift_missing_objects{project="sockshop",stage="production"} 1` + "\n",
+		`crossplane_service_environment_drift_last_check_timestamp_seconds{project="sockshop",stage="dev"} 1.7e+09` + "\n",
+		`crossplane_service_environment_drift_reconciliations_total{project="sockshop",stage="production"} 1` + "\n",
+		`crossplane_service_environment_drift_reconciliations_total{project="sockshop",stage="dev"} 0` + "\n",
+		"crossplane_service_drift_check_failures_total 1\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("WriteTo() = %s, want it to contain %q", metrics, want)
+		}
+	}
+
+	store.retain(map[string]bool{"sockshop.dev": true})
+	builder.Reset()
+	if _, err := store.WriteTo(&builder); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(builder.String(), `stage="production"`) {
+		t.Errorf("WriteTo() after retain() still contains the production stage: %s", builder.String())
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	if got, want := escapeLabelValue("a\"b\\c\nd"), `a\"b\\c\nd`; got != want {
+		t.Errorf("escapeLabelValue() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultNATSQueueGroup is the queue group shared by all replicas of the service, so that each event is handled by
+// exactly one of them
+const DefaultNATSQueueGroup = ServiceName
+
+// NATSTopics returns the subjects to subscribe to for the comma separated list of topics, or the subscribed event
+// types if the list is empty. Topics may contain the NATS wildcards * and >.
+func NATSTopics(topics string) []string {
+	result := []string{}
+	for _, topic := range strings.Split(topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			result = append(result, topic)
+		}
+	}
+	if len(result) == 0 {
+		return SubscribedEventTypes
+	}
+	return result
+}
+
+// NATSSubscriber receives the events of the service directly from NATS instead of through a distributor
+type NATSSubscriber struct {
+	conn    *nats.Conn
+	topics  []string
+	group   string
+	handler func(ctx context.Context, event cloudevents.Event) error
+
+	subscriptions []*nats.Subscription
+}
+
+// NewNATSSubscriber creates a subscriber for the topics that joins the queue group on the connection
+func NewNATSSubscriber(conn *nats.Conn, topics []string, group string, handler func(ctx context.Context, event cloudevents.Event) error) *NATSSubscriber {
+	return &NATSSubscriber{
+		conn:    conn,
+		topics:  topics,
+		group:   group,
+		handler: handler,
+	}
+}
+
+// Subscribe subscribes to all topics as member of the queue group and passes the received events to the handler in
+// the background
+func (s *NATSSubscriber) Subscribe(ctx context.Context) error {
+	for _, topic := range s.topics {
+		subscription, err := s.conn.QueueSubscribe(topic, s.group, func(msg *nats.Msg) {
+			s.receive(ctx, msg)
+		})
+		if err != nil {
+			s.Unsubscribe()
+			return fmt.Errorf("could not subscribe to %s: %s", topic, err.Error())
+		}
+		s.subscriptions = append(s.subscriptions, subscription)
+	}
+	return s.conn.Flush()
+}
+
+// Unsubscribe stops receiving new events, events that have been received already are still handled
+func (s *NATSSubscriber) Unsubscribe() {
+	for _, subscription := range s.subscriptions {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Could not unsubscribe from %s: %s", subscription.Subject, err.Error())
+		}
+	}
+	s.subscriptions = nil
+}
+
+// receive decodes the structured CloudEvent of the message and handles it, messages are delivered one at a time per
+// subscription, hence the handler runs in the background
+func (s *NATSSubscriber) receive(ctx context.Context, msg *nats.Msg) {
+	event := cloudevents.NewEvent()
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		log.Printf("Ignoring invalid event on %s: %s", msg.Subject, err.Error())
+		return
+	}
+
+	go func() {
+		if err := s.handler(ctx, event); err != nil {
+			log.Printf("Error while handling %s event %s: %s", event.Type(), event.ID(), err.Error())
+		}
+	}()
+}
+
+// NATSEventSender publishes CloudEvents on the NATS connection, with the event type as subject
+type NATSEventSender struct {
+	conn *nats.Conn
+}
+
+// NewNATSEventSender creates a sender that publishes on the connection
+func NewNATSEventSender(conn *nats.Conn) *NATSEventSender {
+	return &NATSEventSender{conn: conn}
+}
+
+// SendEvent publishes the CloudEvent
+func (s *NATSEventSender) SendEvent(event cloudevents.Event) error {
+	return s.Send(context.Background(), event)
+}
+
+// Send publishes the CloudEvent
+func (s *NATSEventSender) Send(ctx context.Context, event cloudevents.Event) error {
+	if err := event.Validate(); err != nil {
+		return fmt.Errorf("could not send invalid event %s: %s", event.ID(), err.Error())
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not encode event %s: %s", event.ID(), err.Error())
+	}
+	if err := s.conn.Publish(event.Type(), payload); err != nil {
+		return fmt.Errorf("could not publish event %s: %s", event.Type(), err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// runNATSServer starts an embedded NATS server on a random port and connects to it
+func runNATSServer(t *testing.T) *nats.Conn {
+	options := natsserver.DefaultTestOptions
+	options.Port = -1
+	server := natsserver.RunServer(&options)
+	t.Cleanup(server.Shutdown)
+
+	conn, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+func newNATSTestEvent(t *testing.T, id string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID(id)
+	event.SetType(EnvironmentsetupEventTriggeredType)
+	event.SetSource("shipyard-controller")
+	event.SetExtension("shkeptncontext", "a-context")
+	if err := event.SetData(cloudevents.ApplicationJSON, map[string]interface{}{"project": "sockshop", "stage": "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestNATSTopics(t *testing.T) {
+	tests := []struct {
+		name   string
+		topics string
+		want   []string
+	}{
+		{
+			name:   "default to subscribed event types",
+			topics: "",
+			want:   SubscribedEventTypes,
+		},
+		{
+			name:   "comma separated topics with wildcards",
+			topics: "sh.keptn.event.environment-setup.>, sh.keptn.event.*.triggered,",
+			want:   []string{"sh.keptn.event.environment-setup.>", "sh.keptn.event.*.triggered"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NATSTopics(tt.topics); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NATSTopics() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNATSSubscriberSharesEventsInQueueGroup(t *testing.T) {
+	conn := runNATSServer(t)
+
+	handled := make(chan string, 10)
+	for replica := 0; replica < 2; replica++ {
+		subscriber := NewNATSSubscriber(conn, []string{"sh.keptn.event.environment-setup.>"}, DefaultNATSQueueGroup, func(ctx context.Context, event cloudevents.Event) error {
+			handled <- event.ID()
+			return nil
+		})
+		if err := subscriber.Subscribe(context.Background()); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+		defer subscriber.Unsubscribe()
+	}
+
+	sender := NewNATSEventSender(conn)
+	for _, id := range []string{"event-1", "event-2", "event-3"} {
+		if err := sender.SendEvent(newNATSTestEvent(t, id)); err != nil {
+			t.Fatalf("SendEvent() error = %v", err)
+		}
+	}
+	// events of other types are not subscribed to
+	other := newNATSTestEvent(t, "event-4")
+	other.SetType("sh.keptn.event.deployment.triggered")
+	if err := sender.SendEvent(other); err != nil {
+		t.Fatalf("SendEvent() error = %v", err)
+	}
+
+	received := map[string]int{}
+	timeout := time.After(5 * time.Second)
+	for len(received) < 3 {
+		select {
+		case id := <-handled:
+			received[id]++
+		case <-timeout:
+			t.Fatalf("received only %v", received)
+		}
+	}
+	select {
+	case id := <-handled:
+		t.Errorf("event %s received more than once or although not subscribed", id)
+	case <-time.After(200 * time.Millisecond):
+	}
+	for id, count := range received {
+		if count != 1 {
+			t.Errorf("event %s handled %d times, want 1", id, count)
+		}
+	}
+}
+
+func TestNATSEventSenderPublishesStructuredEvent(t *testing.T) {
+	conn := runNATSServer(t)
+
+	subscription, err := conn.SubscribeSync(EnvironmentsetupEventTriggeredType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewNATSEventSender(conn).SendEvent(newNATSTestEvent(t, "event-1")); err != nil {
+		t.Fatalf("SendEvent() error = %v", err)
+	}
+
+	msg, err := subscription.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("no event published: %v", err)
+	}
+	published := map[string]interface{}{}
+	if err := json.Unmarshal(msg.Data, &published); err != nil {
+		t.Fatalf("published event is not JSON: %v", err)
+	}
+	if published["id"] != "event-1" || published["shkeptncontext"] != "a-context" {
+		t.Errorf("published event = %v, want id event-1 and context a-context", published)
+	}
+	if data, _ := published["data"].(map[string]interface{}); data["project"] != "sockshop" {
+		t.Errorf("published data = %v, want project sockshop", published["data"])
+	}
+}
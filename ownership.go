@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Labels and annotations linking the applied objects back to the Keptn sequence that created them
+const (
+	ProjectLabel      = "keptn.sh/project"
+	StageLabel        = "keptn.sh/stage"
+	ServiceLabel      = "keptn.sh/service"
+	KeptnContextLabel = "keptn.sh/keptn-context"
+	TriggeredIDLabel  = "keptn.sh/triggered-id"
+	ManagedByLabel    = "app.kubernetes.io/managed-by"
+
+	ManifestHashLabel = "crossplane-service.keptn.sh/manifest-hash"
+	VersionAnnotation = "crossplane-service.keptn.sh/version"
+	// RenderAnnotation holds the task properties the crossplane files have been rendered with by the setup
+	RenderAnnotation = "crossplane-service.keptn.sh/render"
+)
+
+// ownership describes the Keptn sequence an object has been applied for
+type ownership struct {
+	Project      string
+	Stage        string
+	Service      string
+	KeptnContext string
+	TriggeredID  string
+	ManifestHash string
+	// Render are the encoded render inputs of the setup, see renderInputs
+	Render string
+}
+
+// renderInputs are the task properties of the setup that select how the crossplane files are rendered. They are kept
+// in the RenderAnnotation, so that the drift check renders the environment the same way as the setup did.
+type renderInputs struct {
+	HelmChartProperties
+	CompositionProperties
+}
+
+// String returns the render inputs as JSON, or an empty string if the setup used the defaults
+func (r renderInputs) String() string {
+	if r.Chart == "" && r.Values == "" && r.Composition == "" && len(r.CompositionSelector) == 0 {
+		return ""
+	}
+	content, err := json.Marshal(r)
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+// parseRenderInputs decodes the render inputs of an annotation, an empty annotation selects the defaults
+func parseRenderInputs(value string) (renderInputs, error) {
+	inputs := renderInputs{}
+	if value == "" {
+		return inputs, nil
+	}
+	if err := json.Unmarshal([]byte(value), &inputs); err != nil {
+		return inputs, fmt.Errorf("invalid %s annotation: %s", RenderAnnotation, err.Error())
+	}
+	return inputs, nil
+}
+
+// ManifestHash returns the sha256 checksum of the manifest as hex string
+func ManifestHash(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// maxLabelValueLength is the maximum length of a label value accepted by Kubernetes
+const maxLabelValueLength = 63
+
+// labels returns the labels identifying the owner, which are propagated to composed resources by compositions
+// patching metadata.labels. Label values are limited to 63 characters, hence the manifest hash is shortened and the
+// other values are sanitized. The annotations hold the full values.
+func (o ownership) labels() map[string]string {
+	labels := map[string]string{
+		ProjectLabel:      labelValue(o.Project),
+		StageLabel:        labelValue(o.Stage),
+		ServiceLabel:      labelValue(o.Service),
+		KeptnContextLabel: labelValue(o.KeptnContext),
+		TriggeredIDLabel:  labelValue(o.TriggeredID),
+		ManagedByLabel:    ServiceName,
+	}
+	if len(o.ManifestHash) > 16 {
+		labels[ManifestHashLabel] = o.ManifestHash[:16]
+	} else {
+		labels[ManifestHashLabel] = o.ManifestHash
+	}
+	return labels
+}
+
+// labelValue returns the value as valid label value: characters other than alphanumerics, '-', '_' and '.' are
+// replaced by '-', it is shortened to 63 characters and it starts and ends with an alphanumeric character.
+func labelValue(value string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if isAlphanumeric(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, value)
+	if len(sanitized) > maxLabelValueLength {
+		sanitized = sanitized[:maxLabelValueLength]
+	}
+	return strings.TrimFunc(sanitized, func(r rune) bool {
+		return !isAlphanumeric(r)
+	})
+}
+
+func isAlphanumeric(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// annotations returns the annotations identifying the owner with their full values
+func (o ownership) annotations() map[string]string {
+	return map[string]string{
+		ProjectLabel:      o.Project,
+		StageLabel:        o.Stage,
+		ServiceLabel:      o.Service,
+		KeptnContextLabel: o.KeptnContext,
+		TriggeredIDLabel:  o.TriggeredID,
+		ManifestHashLabel: o.ManifestHash,
+		VersionAnnotation: serviceVersion,
+		RenderAnnotation:  o.Render,
+	}
+}
+
+// PlanOwnership adds the ownership labels and annotations to all objects of the manifest for a dry-run. The keys
+// identifying the Keptn sequence (keptn-context and triggered-id) keep the values of the live objects, so that the
+// dry-run only shows the changes of the crossplane files.
+func PlanOwnership(ctx context.Context, objects []manifestObject, owner ownership) {
+	for _, object := range objects {
+		run := owner
+		live, err := GetObject(ctx, object.resource(), object.name(), object.namespace())
+		if err == nil {
+			applied := ownerOf(live)
+			run.KeptnContext = applied.KeptnContext
+			run.TriggeredID = applied.TriggeredID
+		} else if !IsNotFoundError(err) {
+			log.Printf("Could not get %s, the dry-run shows the keys of this sequence: %s", object, err.Error())
+		}
+		AddOwnership([]manifestObject{object}, run)
+	}
+}
+
+// AddOwnership adds the ownership labels and annotations to all objects of the manifest
+func AddOwnership(objects []manifestObject, owner ownership) {
+	for _, object := range objects {
+		for key, value := range owner.labels() {
+			if value != "" {
+				object.setLabel(key, value)
+			}
+		}
+		for key, value := range owner.annotations() {
+			if value != "" {
+				object.setAnnotation(key, value)
+			}
+		}
+	}
+}
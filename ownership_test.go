@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "valid value",
+			value: "8929e5e5-3826-488f-9257-708bfa974909",
+			want:  "8929e5e5-3826-488f-9257-708bfa974909",
+		},
+		{
+			name:  "invalid characters",
+			value: "sockshop/carts:v1",
+			want:  "sockshop-carts-v1",
+		},
+		{
+			name:  "invalid first and last character",
+			value: "_carts.",
+			want:  "carts",
+		},
+		{
+			name:  "too long",
+			value: strings.Repeat("a", 62) + "-b",
+			want:  strings.Repeat("a", 62),
+		},
+		{
+			name:  "empty",
+			value: "",
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := labelValue(tt.value); got != tt.want {
+				t.Errorf("labelValue() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddOwnership(t *testing.T) {
+	owner := ownership{
+		Project:      "sockshop",
+		Stage:        "production",
+		Service:      "carts",
+		KeptnContext: "8929e5e5-3826-488f-9257-708bfa974909",
+		TriggeredID:  "id:" + strings.Repeat("1", 70),
+		ManifestHash: ManifestHash([]byte("kind: CompositeCluster")),
+		Render:       renderInputs{HelmChartProperties: HelmChartProperties{Chart: "crossplane/chart"}}.String(),
+	}
+	environment := loadTestManifest(t, "demo/cluster.yaml")[0]
+	AddOwnership([]manifestObject{environment}, owner)
+
+	for key, value := range nestedMap(environment, "metadata", "labels") {
+		if len(value.(string)) > maxLabelValueLength {
+			t.Errorf("AddOwnership() set label %s to %s with more than %d characters", key, value, maxLabelValueLength)
+		}
+	}
+	if got := nestedString(environment, "metadata", "labels", ManifestHashLabel); got != owner.ManifestHash[:16] {
+		t.Errorf("AddOwnership() set manifest hash label %s, want %s", got, owner.ManifestHash[:16])
+	}
+	if got := nestedString(environment, "metadata", "labels", TriggeredIDLabel); got != "id-"+strings.Repeat("1", 60) {
+		t.Errorf("AddOwnership() set triggered-id label %s", got)
+	}
+
+	// the annotations hold the full values, hence the owner can be restored from them
+	if got := ownerOf(environment); got != owner {
+		t.Errorf("ownerOf() = %+v, want %+v", got, owner)
+	}
+
+	// objects labelled by compositions only have the labels
+	delete(nestedMap(environment, "metadata"), "annotations")
+	want := owner
+	want.TriggeredID = "id-" + strings.Repeat("1", 60)
+	want.ManifestHash = owner.ManifestHash[:16]
+	want.Render = ""
+	if got := ownerOf(environment); got != want {
+		t.Errorf("ownerOf() without annotations = %+v, want %+v", got, want)
+	}
+}
+
+func TestRenderInputs(t *testing.T) {
+	if got := (renderInputs{}).String(); got != "" {
+		t.Errorf("String() of the defaults = %s, want empty", got)
+	}
+	if inputs, err := parseRenderInputs(""); err != nil || inputs.Chart != "" || inputs.Composition != "" {
+		t.Errorf("parseRenderInputs() of an empty annotation = %+v, %v, want the defaults", inputs, err)
+	}
+
+	inputs := renderInputs{
+		HelmChartProperties:   HelmChartProperties{Chart: "crossplane/chart", Values: "crossplane/values-production.yaml"},
+		CompositionProperties: CompositionProperties{CompositionSelector: map[string]string{"provider": "aws"}},
+	}
+	parsed, err := parseRenderInputs(inputs.String())
+	if err != nil {
+		t.Fatalf("parseRenderInputs() error = %v", err)
+	}
+	if parsed.HelmChartProperties != inputs.HelmChartProperties || parsed.CompositionSelector["provider"] != "aws" {
+		t.Errorf("parseRenderInputs() = %+v, want %+v", parsed, inputs)
+	}
+
+	if _, err := parseRenderInputs("chart: crossplane/chart"); err == nil {
+		t.Errorf("parseRenderInputs() of an invalid annotation did not fail")
+	}
+}
+
+func TestPlanOwnership(t *testing.T) {
+	applied := ownership{Project: "sockshop", Stage: "dev", KeptnContext: "first-context", TriggeredID: "first-id", ManifestHash: "0123"}
+	live := loadTestManifest(t, "demo/cluster.yaml")[0]
+	AddOwnership([]manifestObject{live}, applied)
+	useMemoryCluster(t, live)
+
+	manifest := loadTestManifest(t, "demo/cluster.yaml")
+	created := copyObject(manifest[0])
+	setNestedValue(created, "created-by-plan", "metadata", "name")
+	manifest = append(manifest, created)
+
+	run := ownership{Project: "sockshop", Stage: "dev", KeptnContext: "second-context", TriggeredID: "second-id", ManifestHash: "4567"}
+	PlanOwnership(context.Background(), manifest, run)
+
+	want := applied
+	want.ManifestHash = run.ManifestHash
+	if got := ownerOf(manifest[0]); got != want {
+		t.Errorf("PlanOwnership() of an existing object = %+v, want %+v", got, want)
+	}
+	if got := ownerOf(manifest[1]); got != run {
+		t.Errorf("PlanOwnership() of a new object = %+v, want %+v", got, run)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Labels of the environments kept in a pool
+const (
+	PoolLabel      = "crossplane-service.keptn.sh/pool"
+	PoolStateLabel = "crossplane-service.keptn.sh/pool-state"
+)
+
+// States of an environment in a pool
+const (
+	PoolStateAvailable = "available"
+	PoolStateClaimed   = "claimed"
+)
+
+// Policies applied to environments claimed from a pool on teardown
+const (
+	PoolTeardownPolicyDestroy = "destroy"
+	PoolTeardownPolicyRecycle = "recycle"
+)
+
+// PoolConfig is the configuration of the pool of pre-warmed environments of a stage
+type PoolConfig struct {
+	// Size is the number of environments kept available per composition and parameters, 0 disables the pool
+	Size int `yaml:"size,omitempty"`
+	// TeardownPolicy is either destroy (default) or recycle, which puts the environment back into the pool
+	TeardownPolicy string `yaml:"teardownPolicy,omitempty"`
+}
+
+// Enabled returns true if environments of the stage are taken from a pool
+func (p PoolConfig) Enabled() bool {
+	return p.Size > 0
+}
+
+// replenishing tracks the pools that are currently replenished in the background
+var replenishing = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: map[string]bool{}}
+
+// PoolKey returns the identity of the pool an environment belongs to. Environments are interchangeable if they are of
+// the same kind, use the same composition and have the same parameters. Spec fields referring to the name of the
+// environment are ignored.
+func PoolKey(object manifestObject) string {
+	spec, _ := object["spec"].(map[string]interface{})
+	identity := map[string]interface{}{
+		"resource":            object.resource(),
+		"compositionRef":      spec["compositionRef"],
+		"compositionSelector": spec["compositionSelector"],
+	}
+	for key, value := range spec {
+		if !crossplaneManagedSpecFields[key] && value != object.name() {
+			identity["spec."+key] = value
+		}
+	}
+
+	// maps are marshalled with sorted keys, hence the key is deterministic
+	content, _ := json.Marshal(identity)
+	return fmt.Sprintf("%x", sha256.Sum256(content))[:16]
+}
+
+// ClaimFromPool claims a ready environment of the pool matching the environment of the manifest. The environment of
+// the manifest is renamed to the claimed one, so that applying the manifest labels the claimed environment for the
+// Keptn sequence instead of creating a new one. It returns the name of the claimed environment, or an empty string
+// if no environment of the pool is ready.
+func ClaimFromPool(ctx context.Context, environment *environmentResource) (string, error) {
+	key := PoolKey(environment.object)
+	resource := environment.object.resource()
+
+	members, err := ListObjects(ctx, resource, "", labelSelector(map[string]string{PoolLabel: key, PoolStateLabel: PoolStateAvailable}))
+	if err != nil {
+		return "", fmt.Errorf("could not list environments of pool %s: %s", key, err.Error())
+	}
+
+	for _, member := range members {
+		if !IsReady(member) {
+			continue
+		}
+
+		// the resource version makes sure that concurrent sequences never claim the same environment
+		resourceVersion := nestedString(member, "metadata", "resourceVersion")
+		if err := LabelObject(ctx, resource, member.name(), "", map[string]string{PoolStateLabel: PoolStateClaimed}, resourceVersion); err != nil {
+			log.Printf("Could not claim %s of pool %s, trying the next one: %s", member, key, err.Error())
+			continue
+		}
+
+		claimPoolMember(environment.object, member)
+		environment.object.setLabel(PoolStateLabel, PoolStateClaimed)
+		return member.name(), nil
+	}
+
+	return "", nil
+}
+
+// ReuseAppliedEnvironment looks up the environment a previous setup applied for the apply set. If it has been claimed
+// from the pool, the environment of the manifest is renamed to it like by ClaimFromPool, so that setting up the stage
+// again keeps the running environment instead of claiming another one and pruning the running one. It returns the name
+// of the reused environment, or an empty string, and whether the apply set has an environment at all, in which case no
+// environment must be claimed from the pool.
+func ReuseAppliedEnvironment(ctx context.Context, environment *environmentResource, applySetID string) (string, bool, error) {
+	applied, err := appliedEnvironment(ctx, environment, applySetID)
+	if err != nil || applied == nil {
+		return "", false, err
+	}
+	if nestedString(applied, "metadata", "labels", PoolStateLabel) != PoolStateClaimed {
+		return "", true, nil
+	}
+
+	claimPoolMember(environment.object, applied)
+	return applied.name(), true, nil
+}
+
+// ReplenishPool creates new environments from the template until the pool has the configured size again.
+// Environments that are still being created count as available. It is meant to be run in the background.
+func ReplenishPool(template manifestObject, size int) {
+	key := PoolKey(template)
+
+	replenishing.Lock()
+	if replenishing.keys[key] {
+		replenishing.Unlock()
+		return
+	}
+	replenishing.keys[key] = true
+	replenishing.Unlock()
+
+	defer func() {
+		replenishing.Lock()
+		delete(replenishing.keys, key)
+		replenishing.Unlock()
+	}()
+
+	// only one replica of the service manages the pool at a time
+	leaseName := LeaseName("pool/" + key)
+	state, err := leases.acquire(leaseName, leaseHolder, LeaseDuration)
+	if err != nil {
+		log.Printf("Could not acquire lease for pool %s: %s", key, err.Error())
+		return
+	}
+	if !state.acquired {
+		log.Printf("Pool %s is replenished by %s", key, state.holder)
+		return
+	}
+	holdLease(context.Background(), leaseName, func(ctx context.Context) {
+		replenishPool(ctx, template, key, size)
+	}, nil)
+}
+
+// replenishPool adds environments to the pool until it has the given size
+func replenishPool(ctx context.Context, template manifestObject, key string, size int) {
+	members, err := ListObjects(ctx, template.resource(), "", labelSelector(map[string]string{PoolLabel: key, PoolStateLabel: PoolStateAvailable}))
+	if err != nil {
+		log.Printf("Could not list environments of pool %s: %s", key, err.Error())
+		return
+	}
+
+	var created []manifestObject
+	for index := len(members); index < size; index++ {
+		created = append(created, newPoolMember(template, key))
+	}
+	if len(created) == 0 {
+		return
+	}
+
+	log.Printf("Adding %d environments to pool %s", len(created), key)
+	if err := ApplyObjects(ctx, created); err != nil {
+		log.Printf("Could not replenish pool %s: %s", key, err.Error())
+	}
+}
+
+// newPoolMember returns a copy of the template under a new name that is not linked to any Keptn sequence.
+// Every member writes its connection details to its own secret, and spec fields referring to the name of the
+// template (e.g., spec.id) refer to the name of the member instead.
+func newPoolMember(template manifestObject, key string) manifestObject {
+	member := manifestObject(convertYAMLValue(map[string]interface{}(template)).(map[string]interface{}))
+	delete(member, "status")
+
+	baseName := template.name()
+	if len(baseName) > 40 {
+		baseName = baseName[:40]
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-pool-%x", baseName, suffix)
+
+	renameEnvironment(member, name)
+	member["metadata"] = map[string]interface{}{"name": name}
+	member.setLabel(PoolLabel, key)
+	member.setLabel(PoolStateLabel, PoolStateAvailable)
+	member.setLabel(ManagedByLabel, ServiceName)
+
+	spec, _ := member["spec"].(map[string]interface{})
+	if spec == nil {
+		spec = map[string]interface{}{}
+		member["spec"] = spec
+	}
+
+	secretNamespace := nestedString(template, "spec", "writeConnectionSecretToRef", "namespace")
+	if secretNamespace == "" {
+		secretNamespace = DefaultConnectionSecretNamespace
+	}
+	spec["writeConnectionSecretToRef"] = map[string]interface{}{
+		"name":      name,
+		"namespace": secretNamespace,
+	}
+
+	return member
+}
+
+// renameEnvironment renames the environment, spec fields referring to its name (e.g., spec.id) are renamed as well
+func renameEnvironment(environment manifestObject, name string) {
+	if spec, ok := environment["spec"].(map[string]interface{}); ok {
+		for field, value := range spec {
+			if value == environment.name() {
+				spec[field] = name
+			}
+		}
+	}
+	setNestedValue(environment, name, "metadata", "name")
+}
+
+// claimPoolMember turns the environment of the manifest into the member of the pool, like the member has been created
+// from it by newPoolMember, so that applying the environment does not change the member
+func claimPoolMember(environment manifestObject, member manifestObject) {
+	renameEnvironment(environment, member.name())
+	if ref := nestedMap(member, "spec", "writeConnectionSecretToRef"); ref != nil {
+		setNestedValue(environment, ref, "spec", "writeConnectionSecretToRef")
+	}
+	for _, label := range []string{PoolLabel, PoolStateLabel} {
+		if value := nestedString(member, "metadata", "labels", label); value != "" {
+			environment.setLabel(label, value)
+		}
+	}
+}
+
+// RecyclePoolEnvironments puts the environments claimed from the pool by the apply set back into the pool, if the
+// teardown policy is recycle and the pool is not full. The labels linking them to the Keptn sequence are removed.
+// Environments that are not recycled remain in the apply set and are deleted with it.
+// It returns the recycled environments.
+func RecyclePoolEnvironments(ctx context.Context, environment *environmentResource, applySetID string, pool PoolConfig) ([]string, error) {
+	if pool.TeardownPolicy != PoolTeardownPolicyRecycle {
+		return nil, nil
+	}
+	resource := environment.object.resource()
+
+	claimed, err := ListObjects(ctx, resource, "", labelSelector(map[string]string{ApplySetLabel: applySetID, PoolStateLabel: PoolStateClaimed}))
+	if err != nil {
+		return nil, fmt.Errorf("could not list environments claimed from pool by apply set %s: %s", applySetID, err.Error())
+	}
+
+	var recycled []string
+	for _, member := range claimed {
+		key := nestedString(member, "metadata", "labels", PoolLabel)
+		available, err := ListObjects(ctx, resource, "", labelSelector(map[string]string{PoolLabel: key, PoolStateLabel: PoolStateAvailable}))
+		if err != nil {
+			return recycled, fmt.Errorf("could not list environments of pool %s: %s", key, err.Error())
+		}
+		if len(available) >= pool.Size {
+			log.Printf("Pool %s is full, %s will be destroyed", key, member)
+			continue
+		}
+
+		labels := map[string]string{
+			PoolStateLabel: PoolStateAvailable,
+			ApplySetLabel:  "",
+		}
+		for label := range (ownership{}).labels() {
+			if label != ManagedByLabel {
+				labels[label] = ""
+			}
+		}
+		if err := LabelObject(ctx, resource, member.name(), "", labels, ""); err != nil {
+			return recycled, fmt.Errorf("could not recycle %s: %s", member, err.Error())
+		}
+		recycled = append(recycled, member.String())
+	}
+
+	return recycled, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPoolKey(t *testing.T) {
+	template := loadTestManifest(t, "demo/cluster.yaml")[0]
+
+	tests := []struct {
+		name     string
+		modify   func(object manifestObject)
+		wantSame bool
+	}{
+		{
+			name: "name and metadata do not matter",
+			modify: func(object manifestObject) {
+				setNestedValue(object, "other-cluster", "metadata", "name")
+				setNestedValue(object, "other-cluster", "spec", "id")
+				object.setLabel(KeptnContextLabel, "a-context")
+			},
+			wantSame: true,
+		},
+		{
+			name: "connection secret does not matter",
+			modify: func(object manifestObject) {
+				setNestedValue(object, "other-secret", "spec", "writeConnectionSecretToRef", "name")
+			},
+			wantSame: true,
+		},
+		{
+			name: "parameters matter",
+			modify: func(object manifestObject) {
+				setNestedValue(object, "large", "spec", "parameters", "nodeSize")
+			},
+		},
+		{
+			name: "composition matters",
+			modify: func(object manifestObject) {
+				setNestedValue(object, "cluster-kind", "spec", "compositionRef", "name")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := loadTestManifest(t, "demo/cluster.yaml")[0]
+			tt.modify(object)
+
+			if same := PoolKey(object) == PoolKey(template); same != tt.wantSame {
+				t.Errorf("PoolKey() same = %t, want %t", same, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestNewPoolMember(t *testing.T) {
+	template := loadTestManifest(t, "demo/cluster.yaml")[0]
+	template.setLabel(KeptnContextLabel, "a-context")
+	key := PoolKey(template)
+
+	member := newPoolMember(template, key)
+
+	if !strings.HasPrefix(member.name(), "keptn-crossplane-pool-") {
+		t.Errorf("newPoolMember() name = %s, want prefix keptn-crossplane-pool-", member.name())
+	}
+	if other := newPoolMember(template, key); other.name() == member.name() {
+		t.Errorf("newPoolMember() returned the name %s twice", member.name())
+	}
+	if got := nestedString(member, "metadata", "labels", PoolLabel); got != key {
+		t.Errorf("newPoolMember() pool label = %s, want %s", got, key)
+	}
+	if got := nestedString(member, "metadata", "labels", PoolStateLabel); got != PoolStateAvailable {
+		t.Errorf("newPoolMember() pool state = %s, want %s", got, PoolStateAvailable)
+	}
+	if got := nestedString(member, "metadata", "labels", KeptnContextLabel); got != "" {
+		t.Errorf("newPoolMember() keptn context = %s, want none", got)
+	}
+	if got := nestedString(member, "spec", "id"); got != member.name() {
+		t.Errorf("newPoolMember() spec.id = %s, want %s", got, member.name())
+	}
+	if got := nestedString(member, "spec", "writeConnectionSecretToRef", "name"); got != member.name() {
+		t.Errorf("newPoolMember() connection secret = %s, want %s", got, member.name())
+	}
+	if got := PoolKey(member); got != key {
+		t.Errorf("PoolKey() of member = %s, want %s", got, key)
+	}
+	if template.name() != "keptn-crossplane" || nestedString(template, "spec", "id") != "keptn-crossplane" {
+		t.Errorf("newPoolMember() modified the template")
+	}
+}
+
+func TestClaimFromPool(t *testing.T) {
+	template := loadTestManifest(t, "demo/cluster.yaml")[0]
+	key := PoolKey(template)
+
+	creating := newPoolMember(template, key)
+	ready := newPoolMember(template, key)
+	ready["status"] = map[string]interface{}{
+		"conditions": []interface{}{map[string]interface{}{"type": "Ready", "status": "True"}},
+	}
+	memory := useMemoryCluster(t, creating, ready)
+
+	environment := &environmentResource{object: loadTestManifest(t, "demo/cluster.yaml")[0]}
+	claimed, err := ClaimFromPool(context.Background(), environment)
+	if err != nil {
+		t.Fatalf("ClaimFromPool() error = %v", err)
+	}
+	if claimed != ready.name() {
+		t.Fatalf("ClaimFromPool() = %s, want the ready member %s", claimed, ready.name())
+	}
+
+	// applying the environment must not reset the fields the member has been created with
+	if got := environment.object.name(); got != ready.name() {
+		t.Errorf("ClaimFromPool() renamed the environment to %s, want %s", got, ready.name())
+	}
+	if got := nestedString(environment.object, "spec", "id"); got != ready.name() {
+		t.Errorf("ClaimFromPool() spec.id = %s, want %s", got, ready.name())
+	}
+	if got := nestedString(environment.object, "spec", "writeConnectionSecretToRef", "name"); got != ready.name() {
+		t.Errorf("ClaimFromPool() connection secret = %s, want %s", got, ready.name())
+	}
+	if got := nestedString(environment.object, "metadata", "labels", PoolStateLabel); got != PoolStateClaimed {
+		t.Errorf("ClaimFromPool() pool state of the environment = %s, want %s", got, PoolStateClaimed)
+	}
+	live := memory.object(template.resource(), ready.name(), "")
+	if got := nestedString(live, "metadata", "labels", PoolStateLabel); got != PoolStateClaimed {
+		t.Errorf("ClaimFromPool() pool state of the member = %s, want %s", got, PoolStateClaimed)
+	}
+	if diff := DiffObject(environment.object, live); len(diff) > 0 {
+		t.Errorf("applying the claimed environment changes the member in %v", diff)
+	}
+
+	// the claimed member is not available anymore
+	environment = &environmentResource{object: loadTestManifest(t, "demo/cluster.yaml")[0]}
+	if claimed, err := ClaimFromPool(context.Background(), environment); err != nil || claimed != "" {
+		t.Errorf("ClaimFromPool() of an exhausted pool = %s, %v, want none", claimed, err)
+	}
+}
+
+func TestReuseAppliedEnvironment(t *testing.T) {
+	applySetID := ApplySetID("sockshop", "dev")
+	template := loadTestManifest(t, "demo/cluster.yaml")[0]
+	key := PoolKey(template)
+
+	claimed := newPoolMember(template, key)
+	claimed.setLabel(PoolStateLabel, PoolStateClaimed)
+	LabelApplySet([]manifestObject{claimed}, applySetID)
+	available := newPoolMember(template, key)
+	available["status"] = map[string]interface{}{
+		"conditions": []interface{}{map[string]interface{}{"type": "Ready", "status": "True"}},
+	}
+	memory := useMemoryCluster(t, claimed, available)
+
+	// setting up the stage again keeps the member claimed by the previous setup
+	environment := &environmentResource{object: loadTestManifest(t, "demo/cluster.yaml")[0]}
+	LabelApplySet([]manifestObject{environment.object}, applySetID)
+	reused, hasEnvironment, err := ReuseAppliedEnvironment(context.Background(), environment, applySetID)
+	if err != nil {
+		t.Fatalf("ReuseAppliedEnvironment() error = %v", err)
+	}
+	if reused != claimed.name() || !hasEnvironment {
+		t.Errorf("ReuseAppliedEnvironment() = %s, %v, want %s, true", reused, hasEnvironment, claimed.name())
+	}
+	if got := environment.object.name(); got != claimed.name() {
+		t.Errorf("ReuseAppliedEnvironment() renamed the environment to %s, want %s", got, claimed.name())
+	}
+	if got := nestedString(memory.object(template.resource(), available.name(), ""), "metadata", "labels", PoolStateLabel); got != PoolStateAvailable {
+		t.Errorf("ReuseAppliedEnvironment() changed the pool state of another member to %s", got)
+	}
+
+	// the running environment is not pruned by the setup
+	if pruned, err := PlanPruneApplySet(context.Background(), applySetID, []manifestObject{environment.object}, nil); err != nil || len(pruned) > 0 {
+		t.Errorf("PlanPruneApplySet() after reusing the environment = %v, %v, want nothing", pruned, err)
+	}
+
+	// an environment set up without the pool is kept as well
+	LabelApplySet([]manifestObject{template}, applySetID)
+	useMemoryCluster(t, template, available)
+	environment = &environmentResource{object: loadTestManifest(t, "demo/cluster.yaml")[0]}
+	reused, hasEnvironment, err = ReuseAppliedEnvironment(context.Background(), environment, applySetID)
+	if err != nil || reused != "" || !hasEnvironment {
+		t.Errorf("ReuseAppliedEnvironment() of an environment without pool = %s, %v, %v, want none, true", reused, hasEnvironment, err)
+	}
+	if got := environment.object.name(); got != template.name() {
+		t.Errorf("ReuseAppliedEnvironment() renamed the environment to %s, want %s", got, template.name())
+	}
+
+	// a new stage claims from the pool
+	useMemoryCluster(t, available)
+	if reused, hasEnvironment, err := ReuseAppliedEnvironment(context.Background(), environment, applySetID); err != nil || reused != "" || hasEnvironment {
+		t.Errorf("ReuseAppliedEnvironment() of a new stage = %s, %v, %v, want none, false", reused, hasEnvironment, err)
+	}
+}
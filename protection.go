@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProtectedAnnotation marks a composite or claim that must not be deleted by an environment-teardown, e.g., a shared
+// or production-like environment, if set to true
+const ProtectedAnnotation = "crossplane-service.keptn.sh/protected"
+
+// IsProtected returns true if the object is annotated as protected
+func IsProtected(object manifestObject) bool {
+	protected, _ := strconv.ParseBool(nestedString(object, "metadata", "annotations", ProtectedAnnotation))
+	return protected
+}
+
+// FindProtectedEnvironments returns the composites and claims that are annotated as protected, either in the
+// manifest or in the management cluster, including environments of the apply set that are not part of the manifest
+// anymore, e.g., environments claimed from a pool
+func FindProtectedEnvironments(ctx context.Context, objects []manifestObject, xrds []manifestObject, applySetID string) ([]string, error) {
+	var protected []string
+	var resources []string
+	for _, object := range objects {
+		if findCompositeResourceDefinition(xrds, object) == nil {
+			continue
+		}
+		resources = appendUnique(resources, object.resource())
+
+		if IsProtected(object) {
+			protected = appendUnique(protected, object.String())
+			continue
+		}
+		live, err := GetObject(ctx, object.resource(), object.name(), object.namespace())
+		if err != nil {
+			if IsNotFoundError(err) {
+				continue
+			}
+			return nil, fmt.Errorf("could not check whether %s is protected: %s", object, err.Error())
+		}
+		if IsProtected(live) {
+			protected = appendUnique(protected, object.String())
+		}
+	}
+
+	for _, resource := range resources {
+		live, err := ListObjects(ctx, resource, "", ApplySetLabel+"="+applySetID)
+		if err != nil {
+			if IsNotFoundError(err) {
+				continue
+			}
+			return nil, fmt.Errorf("could not check whether %s of apply set %s are protected: %s", resource, applySetID, err.Error())
+		}
+		for _, object := range live {
+			if IsProtected(object) {
+				protected = appendUnique(protected, object.String())
+			}
+		}
+	}
+	return protected, nil
+}
+
+// EnvironmentProtection returns why the environment must not be deleted by a setup or a remediation action, e.g.,
+// when it is replaced or pruned, or an empty string if it is not protected. Unlike a teardown, these tasks can not
+// override the protection.
+func EnvironmentProtection(stage string, config StageConfig, environment string, protected []string) string {
+	var reasons []string
+	if config.Protected {
+		reasons = append(reasons, fmt.Sprintf("stage %s is protected in %s", stage, ServiceConfigFilename))
+	}
+	for _, object := range protected {
+		if object == environment {
+			reasons = append(reasons, fmt.Sprintf("%s is annotated with %s=true", environment, ProtectedAnnotation))
+			break
+		}
+	}
+	return strings.Join(reasons, " and ")
+}
+
+// keepProtectedEnvironments returns a filter for PruneApplySet that keeps the composites and claims that are protected
+// by the stage configuration or by being one of the protected environments
+func keepProtectedEnvironments(xrds []manifestObject, stage string, config StageConfig, protected []string) func(object manifestObject) bool {
+	return func(object manifestObject) bool {
+		return findCompositeResourceDefinition(xrds, object) != nil && EnvironmentProtection(stage, config, object.String(), protected) != ""
+	}
+}
+
+// TeardownRefusal returns why the teardown of the stage has to be refused, or an empty string if it may proceed.
+// Protected stages and protected environments are only torn down if the task overrides the protection explicitly.
+func TeardownRefusal(stage string, config StageConfig, protected []string, override bool) string {
+	if override || (!config.Protected && len(protected) == 0) {
+		return ""
+	}
+
+	var reasons []string
+	if config.Protected {
+		reasons = append(reasons, fmt.Sprintf("stage %s is protected in %s", stage, ServiceConfigFilename))
+	}
+	if len(protected) > 0 {
+		verb := "is"
+		if len(protected) > 1 {
+			verb = "are"
+		}
+		reasons = append(reasons, fmt.Sprintf("%s %s annotated with %s=true", strings.Join(protected, ", "), verb, ProtectedAnnotation))
+	}
+	return fmt.Sprintf("Refusing to tear down the environment of stage %s: %s. Set the overrideProtection property of the environment-teardown task to true to tear it down anyway", stage, strings.Join(reasons, " and "))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsProtected(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		want       bool
+	}{
+		{
+			name:       "not annotated",
+			annotation: "",
+			want:       false,
+		},
+		{
+			name:       "protected",
+			annotation: "true",
+			want:       true,
+		},
+		{
+			name:       "explicitly unprotected",
+			annotation: "false",
+			want:       false,
+		},
+		{
+			name:       "invalid value",
+			annotation: "yes please",
+			want:       false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := manifestObject{}
+			if tt.annotation != "" {
+				object.setAnnotation(ProtectedAnnotation, tt.annotation)
+			}
+			if got := IsProtected(object); got != tt.want {
+				t.Errorf("IsProtected() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTeardownRefusal(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    StageConfig
+		protected []string
+		override  bool
+		want      []string
+	}{
+		{
+			name: "not protected",
+			want: nil,
+		},
+		{
+			name:   "protected stage",
+			config: StageConfig{Protected: true},
+			want:   []string{"stage production is protected in " + ServiceConfigFilename, "overrideProtection"},
+		},
+		{
+			name:      "protected composite",
+			protected: []string{"KindCluster/shared-cluster"},
+			want:      []string{"KindCluster/shared-cluster is annotated with " + ProtectedAnnotation + "=true"},
+		},
+		{
+			name:      "protected stage and composites",
+			config:    StageConfig{Protected: true},
+			protected: []string{"KindCluster/shared-cluster", "KindCluster/pool-cluster"},
+			want:      []string{"is protected in", "KindCluster/shared-cluster, KindCluster/pool-cluster are annotated"},
+		},
+		{
+			name:      "override",
+			config:    StageConfig{Protected: true},
+			protected: []string{"KindCluster/shared-cluster"},
+			override:  true,
+			want:      nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TeardownRefusal("production", tt.config, tt.protected, tt.override)
+			if tt.want == nil {
+				if got != "" {
+					t.Errorf("TeardownRefusal() = %q, want no refusal", got)
+				}
+				return
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("TeardownRefusal() = %q, want it to contain %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvironmentProtection(t *testing.T) {
+	protected := []string{"KindCluster/shared-cluster"}
+	if got := EnvironmentProtection("production", StageConfig{}, "KindCluster/keptn-cluster", protected); got != "" {
+		t.Errorf("EnvironmentProtection() of an unprotected environment = %q, want none", got)
+	}
+	if got, want := EnvironmentProtection("production", StageConfig{}, "KindCluster/shared-cluster", protected), "KindCluster/shared-cluster is annotated with "+ProtectedAnnotation+"=true"; got != want {
+		t.Errorf("EnvironmentProtection() of an annotated environment = %q, want %q", got, want)
+	}
+	if got, want := EnvironmentProtection("production", StageConfig{Protected: true}, "KindCluster/keptn-cluster", protected), "stage production is protected in "+ServiceConfigFilename; got != want {
+		t.Errorf("EnvironmentProtection() of a protected stage = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// Remediation actions handled by the service, as referenced in the remediation.yaml of a service
+const (
+	// ScaleEnvironmentAction merges the value of the action into the parameters of the environment
+	ScaleEnvironmentAction = "scale-environment"
+	// RecreateEnvironmentAction deletes the environment and creates it again
+	RecreateEnvironmentAction = "recreate-environment"
+)
+
+// DefaultScaleParameter is the parameter set by a scale-environment action with a single value, e.g., value: 3
+const DefaultScaleParameter = "minNodeCount"
+
+// IsEnvironmentAction returns true if the remediation action is handled by the service
+func IsEnvironmentAction(action string) bool {
+	return action == ScaleEnvironmentAction || action == RecreateEnvironmentAction
+}
+
+// ScaleParameters returns the parameters to merge into the environment for the value of a scale-environment action.
+// The value is either a map of parameters or a single number that is used for DefaultScaleParameter.
+func ScaleParameters(value interface{}) (map[string]interface{}, error) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if len(typed) == 0 {
+			return nil, fmt.Errorf("the value of action %s does not contain any parameters", ScaleEnvironmentAction)
+		}
+		return typed, nil
+	case string:
+		number, err := strconv.Atoi(typed)
+		if err != nil {
+			return nil, fmt.Errorf("the value %q of action %s is not a number", typed, ScaleEnvironmentAction)
+		}
+		return map[string]interface{}{DefaultScaleParameter: number}, nil
+	case float64:
+		return map[string]interface{}{DefaultScaleParameter: typed}, nil
+	}
+	return nil, fmt.Errorf("the value of action %s has to be a number or a map of parameters", ScaleEnvironmentAction)
+}
+
+// FindAppliedEnvironment returns the live environment that has been applied for the apply set (i.e., project and
+// stage), which may have a different name than the environment of the manifest if it was claimed from a pool
+func FindAppliedEnvironment(ctx context.Context, environment *environmentResource, applySetID string) (*environmentResource, error) {
+	live, err := appliedEnvironment(ctx, environment, applySetID)
+	if err != nil {
+		return nil, err
+	}
+	if live == nil {
+		return nil, fmt.Errorf("no %s has been applied for apply set %s", environment.object.kind(), applySetID)
+	}
+	return &environmentResource{object: live, claim: environment.claim}, nil
+}
+
+// appliedEnvironment returns the live object of the kind of the environment that has been applied for the apply set,
+// or nil
+func appliedEnvironment(ctx context.Context, environment *environmentResource, applySetID string) (manifestObject, error) {
+	resource := environment.object.resource()
+	live, err := ListObjects(ctx, resource, "", ApplySetLabel+"="+applySetID)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s of apply set %s: %s", resource, applySetID, err.Error())
+	}
+	if len(live) == 0 {
+		return nil, nil
+	}
+	return live[0], nil
+}
+
+// FindApplySetEnvironment returns the live claim or composite resource that has been applied for the apply set (i.e.,
+// project and stage) without rendering the crossplane files, so that it is found independent of their source
+func FindApplySetEnvironment(ctx context.Context, xrds []manifestObject, applySetID string) (*environmentResource, error) {
+	environment, err := findLabelledEnvironment(ctx, xrds, ApplySetLabel+"="+applySetID)
+	if err != nil {
+		return nil, err
+	}
+	if environment == nil {
+		return nil, fmt.Errorf("no environment has been applied for apply set %s", applySetID)
+	}
+	return environment, nil
+}
+
+// recreatableCopy returns a copy of the live environment without the fields set by the API server and Crossplane,
+// so that it can be created again
+func recreatableCopy(live manifestObject) manifestObject {
+	object := manifestObject(convertYAMLValue(map[string]interface{}(live)).(map[string]interface{}))
+	delete(object, "status")
+
+	metadata := map[string]interface{}{"name": live.name()}
+	if live.namespace() != "" {
+		metadata["namespace"] = live.namespace()
+	}
+	if labels := nestedMap(live, "metadata", "labels"); labels != nil {
+		metadata["labels"] = labels
+	}
+	if annotations := nestedMap(live, "metadata", "annotations"); annotations != nil {
+		copied := map[string]interface{}{}
+		for key, value := range annotations {
+			if key != "kubectl.kubernetes.io/last-applied-configuration" {
+				copied[key] = value
+			}
+		}
+		metadata["annotations"] = copied
+	}
+	object["metadata"] = metadata
+
+	if spec, ok := object["spec"].(map[string]interface{}); ok {
+		for _, field := range []string{"resourceRef", "resourceRefs", "claimRef", "compositionRevisionRef"} {
+			delete(spec, field)
+		}
+	}
+	return object
+}
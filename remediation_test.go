@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+	"github.com/keptn/go-utils/pkg/lib/v0_2_0/fake"
+)
+
+func TestScaleParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:  "number as string",
+			value: "3",
+			want:  map[string]interface{}{DefaultScaleParameter: 3},
+		},
+		{
+			name:  "number",
+			value: float64(3),
+			want:  map[string]interface{}{DefaultScaleParameter: float64(3)},
+		},
+		{
+			name:  "parameters",
+			value: map[string]interface{}{"nodeSize": "large"},
+			want:  map[string]interface{}{"nodeSize": "large"},
+		},
+		{
+			name:    "no number",
+			value:   "many",
+			wantErr: true,
+		},
+		{
+			name:    "no value",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ScaleParameters(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ScaleParameters() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ScaleParameters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecreatableCopy(t *testing.T) {
+	live := loadTestManifest(t, "demo/cluster.yaml")[0]
+	live.setLabel(ApplySetLabel, "sockshop.dev")
+	live.setAnnotation("kubectl.kubernetes.io/last-applied-configuration", "{}")
+	setNestedValue(live, "42", "metadata", "resourceVersion")
+	setNestedValue(live, "a-uid", "metadata", "uid")
+	setNestedValue(live, []interface{}{}, "spec", "resourceRefs")
+	setNestedValue(live, []interface{}{}, "status", "conditions")
+
+	object := recreatableCopy(live)
+
+	if _, ok := object["status"]; ok {
+		t.Errorf("recreatableCopy() kept the status")
+	}
+	if got := nestedString(object, "metadata", "resourceVersion") + nestedString(object, "metadata", "uid"); got != "" {
+		t.Errorf("recreatableCopy() kept resourceVersion and uid %s", got)
+	}
+	if got := nestedString(object, "metadata", "labels", ApplySetLabel); got != "sockshop.dev" {
+		t.Errorf("recreatableCopy() apply set label = %s, want sockshop.dev", got)
+	}
+	if _, ok := nestedMap(object, "metadata", "annotations")["kubectl.kubernetes.io/last-applied-configuration"]; ok {
+		t.Errorf("recreatableCopy() kept the last applied configuration")
+	}
+	if nestedValue(object, "spec", "resourceRefs") != nil {
+		t.Errorf("recreatableCopy() kept spec.resourceRefs")
+	}
+	if got := nestedString(object, "spec", "compositionRef", "name"); got != "cluster-civo" {
+		t.Errorf("recreatableCopy() compositionRef = %s, want cluster-civo", got)
+	}
+}
+
+func TestHandleActionTriggeredEventIgnoresOtherActions(t *testing.T) {
+	myKeptn, incomingEvent, err := initializeTestObjects("test-events/action.triggered.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := &keptnv2.ActionTriggeredEventData{}
+	if err := incomingEvent.DataAs(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := HandleActionTriggeredEvent(myKeptn, *incomingEvent, data); err != nil {
+		t.Errorf("HandleActionTriggeredEvent() error = %v", err)
+	}
+	if sent := len(myKeptn.EventSender.(*fake.EventSender).SentEvents); sent != 0 {
+		t.Errorf("HandleActionTriggeredEvent() sent %d events for action %s, want none", sent, data.Action.Action)
+	}
+}
+
+func TestFindApplySetEnvironment(t *testing.T) {
+	xrds := loadTestManifest(t, "demo/crossplane-resources/definition.yaml")[:1]
+	applySetID := ApplySetID("sockshop", "dev")
+
+	// environments claimed from a pool have another name than the environment of the crossplane files
+	member := loadTestManifest(t, "demo/cluster.yaml")[0]
+	renameEnvironment(member, "keptn-crossplane-pool-a1b2c3")
+	member.setLabel(ApplySetLabel, applySetID)
+	other := loadTestManifest(t, "demo/cluster.yaml")[0]
+	other.setLabel(ApplySetLabel, ApplySetID("sockshop", "production"))
+	useMemoryCluster(t, member, other)
+
+	environment, err := FindApplySetEnvironment(context.Background(), xrds, applySetID)
+	if err != nil {
+		t.Fatalf("FindApplySetEnvironment() error = %v", err)
+	}
+	if environment.object.name() != member.name() || environment.claim {
+		t.Errorf("FindApplySetEnvironment() = %s, want composite %s", environment, member.name())
+	}
+
+	if _, err := FindApplySetEnvironment(context.Background(), xrds, ApplySetID("sockshop", "staging")); err == nil {
+		t.Errorf("FindApplySetEnvironment() of an apply set without environment succeeded")
+	}
+}
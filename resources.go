@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/keptn/go-utils/pkg/api/models"
+	api "github.com/keptn/go-utils/pkg/api/utils"
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+)
+
+// CrossPlaneDirectory is the directory in the Keptn git repo holding the crossplane resources
+const CrossPlaneDirectory = "crossplane"
+
+// GetCrossplaneResources loads all files of the crossplane directory from the Keptn git repo using Keptn's resource
+// hierarchy: files on stage level override files with the same path on project level, files on service level
+// override both. The returned map is keyed by the path of the file, e.g., crossplane/cluster.yaml.
+func GetCrossplaneResources(myKeptn *keptnv2.Keptn) (map[string][]byte, error) {
+	if myKeptn.UseLocalFileSystem {
+		return getLocalCrossplaneResources()
+	}
+
+	project := myKeptn.Event.GetProject()
+	stage := myKeptn.Event.GetStage()
+	service := myKeptn.Event.GetService()
+	handler := myKeptn.ResourceHandler
+
+	resources := map[string][]byte{}
+
+	// project level
+	projectResources, err := getAllProjectResources(project, handler.Scheme+"://"+handler.BaseURL, handler.AuthHeader, handler.AuthToken, handler.HTTPClient)
+	if err != nil {
+		return nil, fmt.Errorf("could not list resources of project %s: %s", project, err.Error())
+	}
+	for _, uri := range filterCrossplaneResources(projectResources) {
+		resource, err := handler.GetProjectResource(project, uri)
+		if err != nil {
+			return nil, fmt.Errorf("could not get resource %s of project %s: %s", uri, project, err.Error())
+		}
+		resources[normalizeResourceURI(uri)] = []byte(resource.ResourceContent)
+	}
+
+	// stage level
+	if stage != "" {
+		stageResources, err := handler.GetAllStageResources(project, stage)
+		if err != nil {
+			return nil, fmt.Errorf("could not list resources of stage %s: %s", stage, err.Error())
+		}
+		for _, uri := range filterCrossplaneResources(stageResources) {
+			resource, err := handler.GetStageResource(project, stage, uri)
+			if err != nil {
+				return nil, fmt.Errorf("could not get resource %s of stage %s: %s", uri, stage, err.Error())
+			}
+			resources[normalizeResourceURI(uri)] = []byte(resource.ResourceContent)
+		}
+	}
+
+	// service level
+	if stage != "" && service != "" {
+		serviceResources, err := handler.GetAllServiceResources(project, stage, service)
+		if err != nil {
+			return nil, fmt.Errorf("could not list resources of service %s: %s", service, err.Error())
+		}
+		for _, uri := range filterCrossplaneResources(serviceResources) {
+			resource, err := handler.GetServiceResource(project, stage, service, uri)
+			if err != nil {
+				return nil, fmt.Errorf("could not get resource %s of service %s: %s", uri, service, err.Error())
+			}
+			resources[normalizeResourceURI(uri)] = []byte(resource.ResourceContent)
+		}
+	}
+
+	return resources, nil
+}
+
+// CombineManifests concatenates all YAML files of the resources into a single multi-document manifest.
+// Files are combined in lexical order of their path, so infra definitions can be ordered by naming them accordingly.
+func CombineManifests(resources map[string][]byte) ([]byte, []string) {
+	var files []string
+	for path := range resources {
+		if isYAMLFile(path) {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+
+	var combined []byte
+	for _, path := range files {
+		combined = append(combined, []byte("---\n")...)
+		combined = append(combined, resources[path]...)
+		combined = append(combined, '\n')
+	}
+	return combined, files
+}
+
+// getLocalCrossplaneResources loads the crossplane directory from the local filesystem
+func getLocalCrossplaneResources() (map[string][]byte, error) {
+	resources := map[string][]byte{}
+	err := filepath.Walk(CrossPlaneDirectory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		resources[filepath.ToSlash(path)] = content
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// getAllProjectResources lists the resources of a project, which is not provided by the ResourceHandler of go-utils
+func getAllProjectResources(project string, baseURL string, authHeader string, authToken string, client *http.Client) ([]*models.Resource, error) {
+	var resources []*models.Resource
+
+	u, err := url.Parse(baseURL + "/v1/project/" + project + "/resource")
+	if err != nil {
+		return nil, err
+	}
+
+	nextPageKey := ""
+	for {
+		if nextPageKey != "" {
+			query := u.Query()
+			query.Set("nextPageKey", nextPageKey)
+			u.RawQuery = query.Encode()
+		}
+
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if authHeader != "" && authToken != "" {
+			req.Header.Set(authHeader, authToken)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+		}
+
+		var received models.Resources
+		if err := json.Unmarshal(body, &received); err != nil {
+			return nil, err
+		}
+		resources = append(resources, received.Resources...)
+
+		if received.NextPageKey == "" || received.NextPageKey == "0" {
+			break
+		}
+		nextPageKey = received.NextPageKey
+	}
+
+	return resources, nil
+}
+
+// filterCrossplaneResources returns the URIs of all resources located in the crossplane directory
+func filterCrossplaneResources(resources []*models.Resource) []string {
+	var uris []string
+	for _, resource := range resources {
+		if resource == nil || resource.ResourceURI == nil {
+			continue
+		}
+		if strings.HasPrefix(normalizeResourceURI(*resource.ResourceURI), CrossPlaneDirectory+"/") {
+			uris = append(uris, *resource.ResourceURI)
+		}
+	}
+	return uris
+}
+
+// normalizeResourceURI removes the leading slash of resource URIs returned by the configuration service
+func normalizeResourceURI(uri string) string {
+	return strings.TrimPrefix(uri, "/")
+}
+
+// isResourceNotFoundError returns true if the configuration service does not know the resource
+func isResourceNotFoundError(err error) bool {
+	return errors.Is(err, api.ResourceNotFoundError)
+}
+
+func isYAMLFile(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	return extension == ".yaml" || extension == ".yml"
+}
+
+// LoadCrossplaneManifest loads all crossplane resources from the Keptn git repo and combines them into a single
+// manifest. If a Helm chart is configured, the manifest is rendered from the chart instead. Otherwise, if the crossplane
+// directory contains a kustomization, the manifest is rendered by kustomize.
+// It returns the manifest and the files it has been rendered from.
+func LoadCrossplaneManifest(myKeptn *keptnv2.Keptn, helmChart HelmChartProperties) ([]byte, []string, error) {
+	resources, err := GetCrossplaneResources(myKeptn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if helmChart.Chart != "" {
+		manifest, err := RenderHelmChart(resources, helmChart, map[string]interface{}{
+			"project": myKeptn.Event.GetProject(),
+			"stage":   myKeptn.Event.GetStage(),
+			"service": myKeptn.Event.GetService(),
+		}, HelmReleaseName(myKeptn.Event.GetProject(), myKeptn.Event.GetStage(), myKeptn.Event.GetService()))
+		if err != nil {
+			return nil, nil, err
+		}
+		files := []string{helmChart.Chart}
+		if helmChart.Values != "" {
+			files = append(files, helmChart.Values)
+		}
+		return manifest, files, nil
+	}
+
+	if kustomization := findKustomization(resources); kustomization != "" {
+		manifest, err := BuildKustomization(resources)
+		if err != nil {
+			return nil, nil, err
+		}
+		return manifest, []string{kustomization}, nil
+	}
+
+	manifest, files := CombineManifests(resources)
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no YAML files found in directory %s", CrossPlaneDirectory)
+	}
+	return manifest, files, nil
+}
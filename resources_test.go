@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/keptn/go-utils/pkg/api/models"
+	api "github.com/keptn/go-utils/pkg/api/utils"
+)
+
+func TestCombineManifests(t *testing.T) {
+	resources := map[string][]byte{
+		"crossplane/cluster.yaml":           []byte("kind: Cluster"),
+		"crossplane/database.yml":           []byte("kind: Database"),
+		"crossplane/README.md":              []byte("# not a manifest"),
+		"crossplane/10-networking/vpc.yaml": []byte("kind: Network"),
+	}
+
+	manifest, files := CombineManifests(resources)
+
+	wantFiles := []string{"crossplane/10-networking/vpc.yaml", "crossplane/cluster.yaml", "crossplane/database.yml"}
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("CombineManifests() files = %v, want %v", files, wantFiles)
+	}
+
+	wantManifest := "---\nkind: Network\n---\nkind: Cluster\n---\nkind: Database\n"
+	if string(manifest) != wantManifest {
+		t.Errorf("CombineManifests() manifest = %q, want %q", manifest, wantManifest)
+	}
+}
+
+func TestFilterCrossplaneResources(t *testing.T) {
+	uri := func(value string) *models.Resource {
+		return &models.Resource{ResourceURI: &value}
+	}
+
+	uris := filterCrossplaneResources([]*models.Resource{
+		uri("/crossplane/cluster.yaml"),
+		uri("/shipyard.yaml"),
+		uri("/carts/crossplane/cluster.yaml"),
+		uri("crossplane/database.yaml"),
+		{},
+	})
+
+	want := []string{"/crossplane/cluster.yaml", "crossplane/database.yaml"}
+	if !reflect.DeepEqual(uris, want) {
+		t.Errorf("filterCrossplaneResources() = %v, want %v", uris, want)
+	}
+}
+
+func TestIsResourceNotFoundError(t *testing.T) {
+	if !isResourceNotFoundError(fmt.Errorf("could not get resource: %w", api.ResourceNotFoundError)) {
+		t.Errorf("isResourceNotFoundError() of a wrapped not found error = false, want true")
+	}
+	if isResourceNotFoundError(errors.New("resource not found in cache")) {
+		t.Errorf("isResourceNotFoundError() of another error = true, want false")
+	}
+	if isResourceNotFoundError(nil) {
+		t.Errorf("isResourceNotFoundError(nil) = true, want false")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how often and how fast API interactions failing with a transient error are retried
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, including the first one
+	Attempts int
+	// InitialBackoff is the time to wait before the second attempt, it doubles with every further attempt
+	InitialBackoff time.Duration
+	// MaxBackoff limits the time to wait between two attempts
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is used for the interactions of the event handlers with the management cluster and Keptn
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       5,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// transientErrorMessages are parts of error messages of kubectl and the Keptn API that indicate a failure that is
+// likely to go away by itself, e.g., an API server that is restarting or overloaded
+var transientErrorMessages = []string{
+	"connection refused",
+	"connection reset by peer",
+	"broken pipe",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"unexpected EOF",
+	"http2: client connection lost",
+	"context deadline exceeded",
+	"etcdserver: request timed out",
+	"etcdserver: leader changed",
+	"the server is currently unable to handle the request",
+	"the server was unable to return a response in the time allotted",
+	"Timeout: request did not complete",
+	"ServiceUnavailable",
+	"TooManyRequests",
+	"Too Many Requests",
+	"failed calling webhook",
+	"503 Service Unavailable",
+	"502 Bad Gateway",
+	"504 Gateway Timeout",
+}
+
+// IsTransientError returns true if retrying the failed interaction might succeed. All other errors are permanent,
+// e.g., objects that do not exist, invalid manifests or missing permissions.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, ErrOperationCancelled) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	message := err.Error()
+	for _, transient := range transientErrorMessages {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the time to wait after the failed attempt (starting at 1)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
+
+// Retry runs the interaction until it succeeds, fails with a permanent error or the attempts of the policy are
+// exhausted, and returns the error of the last attempt. onRetry is called, if not nil, before waiting for the next
+// attempt. The context of the operation stops the retries, in that case the error of the last attempt is returned.
+func Retry(ctx context.Context, policy RetryPolicy, interaction func() error, onRetry func(attempt int, err error, backoff time.Duration)) error {
+	for attempt := 1; ; attempt++ {
+		err := interaction()
+		if err == nil || !IsTransientError(err) || attempt >= policy.Attempts {
+			return err
+		}
+
+		backoff := policy.backoff(attempt)
+		if onRetry != nil {
+			onRetry(attempt, err, backoff)
+		}
+		if sleepContext(ctx, backoff) != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "no error",
+			err:  nil,
+			want: false,
+		},
+		{
+			name: "API server not reachable",
+			err:  errors.New("The connection to the server 10.0.0.1:6443 was refused - did you specify the right host or port?: dial tcp 10.0.0.1:6443: connect: connection refused"),
+			want: true,
+		},
+		{
+			name: "API server overloaded",
+			err:  errors.New("Error from server (ServiceUnavailable): the server is currently unable to handle the request"),
+			want: true,
+		},
+		{
+			name: "webhook not ready",
+			err:  errors.New(`Internal error occurred: failed calling webhook "compositeresourcedefinitions.apiextensions.crossplane.io"`),
+			want: true,
+		},
+		{
+			name: "object not found",
+			err:  errors.New(`Error from server (NotFound): secrets "cluster-details" not found`),
+			want: false,
+		},
+		{
+			name: "invalid manifest",
+			err:  errors.New(`error validating data: ValidationError(Cluster.spec): unknown field "size"`),
+			want: false,
+		},
+		{
+			name: "forbidden",
+			err:  errors.New(`Error from server (Forbidden): clusters is forbidden: User "system:serviceaccount:keptn:crossplane-service" cannot list resource "clusters"`),
+			want: false,
+		},
+		{
+			name: "cancelled operation",
+			err:  fmt.Errorf("%w: context deadline exceeded", ErrOperationCancelled),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransientError(tt.err); got != tt.want {
+				t.Errorf("IsTransientError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{Attempts: 6, InitialBackoff: 2 * time.Second, MaxBackoff: 10 * time.Second}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for attempt, backoff := range want {
+		if got := policy.backoff(attempt + 1); got != backoff {
+			t.Errorf("backoff(%d) = %s, want %s", attempt+1, got, backoff)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	transient := errors.New("dial tcp 10.0.0.1:6443: i/o timeout")
+	permanent := errors.New(`Error from server (Forbidden): secrets is forbidden`)
+	policy := RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	tests := []struct {
+		name         string
+		errors       []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{
+			name:         "succeeds after transient errors",
+			errors:       []error{transient, transient, nil},
+			wantErr:      nil,
+			wantAttempts: 3,
+		},
+		{
+			name:         "permanent error is not retried",
+			errors:       []error{permanent},
+			wantErr:      permanent,
+			wantAttempts: 1,
+		},
+		{
+			name:         "attempts are exhausted",
+			errors:       []error{transient, transient, transient, nil},
+			wantErr:      transient,
+			wantAttempts: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			var retries []int
+			err := Retry(context.Background(), policy, func() error {
+				attempts++
+				return tt.errors[attempts-1]
+			}, func(attempt int, err error, backoff time.Duration) {
+				retries = append(retries, attempt)
+			})
+			if err != tt.wantErr {
+				t.Errorf("Retry() error = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("Retry() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if len(retries) != tt.wantAttempts-1 {
+				t.Errorf("Retry() reported %d retries, want %d", len(retries), tt.wantAttempts-1)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	transient := errors.New("etcdserver: request timed out")
+	policy := RetryPolicy{Attempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+
+	attempts := 0
+	err := Retry(ctx, policy, func() error {
+		attempts++
+		return transient
+	}, func(attempt int, err error, backoff time.Duration) {
+		cancel()
+	})
+	if err != transient || attempts != 1 {
+		t.Errorf("Retry() = %v after %d attempts, want %v after 1 attempt", err, attempts, transient)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// On-failure policies of the environment-setup task for the objects created by a failed attempt
+const (
+	// OnFailureKeep keeps the created objects, e.g., to investigate the failure (default)
+	OnFailureKeep = "keep"
+	// OnFailureDelete deletes the created objects, so that a failed attempt does not leave environments running
+	OnFailureDelete = "delete"
+)
+
+// OnFailurePolicy returns the on-failure policy of the task, falling back to the policy of the stage
+func OnFailurePolicy(task string, stage StageConfig) (string, error) {
+	policy := task
+	if policy == "" {
+		policy = stage.OnFailure
+	}
+	switch policy {
+	case "":
+		return OnFailureKeep, nil
+	case OnFailureKeep, OnFailureDelete:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown on-failure policy %s, supported policies are %s and %s", policy, OnFailureKeep, OnFailureDelete)
+}
+
+// RollbackDetails report what happened to the objects created by a failed environment-setup
+type RollbackDetails struct {
+	// Policy is the on-failure policy that has been applied
+	Policy string `json:"policy"`
+	// Created are the objects that did not exist before the failed attempt
+	Created []string `json:"created,omitempty"`
+	// Deleted are the created objects that have been deleted
+	Deleted []string `json:"deleted,omitempty"`
+	// Error describes why not all created objects could be deleted
+	Error string `json:"error,omitempty"`
+}
+
+// String describes the outcome of the rollback
+func (d *RollbackDetails) String() string {
+	switch {
+	case len(d.Created) == 0:
+		return "no objects have been created"
+	case d.Error != "":
+		return fmt.Sprintf("rollback failed, deleted %d of %d created objects: %s", len(d.Deleted), len(d.Created), d.Error)
+	case d.Policy == OnFailureDelete:
+		return fmt.Sprintf("rolled back by deleting the created objects %s", strings.Join(d.Deleted, ", "))
+	}
+	return fmt.Sprintf("kept the created objects %s", strings.Join(d.Created, ", "))
+}
+
+// setupRollback removes the objects created by an environment-setup if the setup fails, depending on the on-failure
+// policy. Objects that existed before are never deleted, e.g., adopted environments or environments of a pool.
+type setupRollback struct {
+	policy  string
+	created []manifestObject
+}
+
+// newSetupRollback determines the objects of the manifest that do not exist yet, it has to be called right before
+// the manifest is applied
+func newSetupRollback(ctx context.Context, policy string, manifest []manifestObject) *setupRollback {
+	rollback := &setupRollback{policy: policy}
+	for _, object := range manifest {
+		_, err := GetObject(ctx, object.resource(), object.name(), object.namespace())
+		if err == nil {
+			continue
+		}
+		if !IsNotFoundError(err) {
+			// objects that might exist are never deleted
+			log.Printf("Could not check whether %s exists, it will not be rolled back: %s", object, err.Error())
+			continue
+		}
+		rollback.created = append(rollback.created, object)
+	}
+	return rollback
+}
+
+// run applies the on-failure policy to the created objects, which are deleted in the reverse order of the manifest
+func (r *setupRollback) run(ctx context.Context) *RollbackDetails {
+	details := &RollbackDetails{Policy: r.policy}
+	for _, object := range r.created {
+		details.Created = append(details.Created, object.String())
+	}
+	if r.policy != OnFailureDelete {
+		return details
+	}
+
+	for index := len(r.created) - 1; index >= 0; index-- {
+		object := r.created[index]
+		log.Printf("Rolling back %s", object)
+		if err := DeleteObject(ctx, object.resource(), object.name(), object.namespace()); err != nil {
+			details.Error = fmt.Sprintf("could not delete %s: %s", object, err.Error())
+			return details
+		}
+		details.Deleted = append(details.Deleted, object.String())
+	}
+	return details
+}
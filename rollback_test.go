@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOnFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    string
+		stage   StageConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "keep by default",
+			want: OnFailureKeep,
+		},
+		{
+			name:  "policy of the stage",
+			stage: StageConfig{OnFailure: OnFailureDelete},
+			want:  OnFailureDelete,
+		},
+		{
+			name:  "task overrides stage",
+			task:  OnFailureKeep,
+			stage: StageConfig{OnFailure: OnFailureDelete},
+			want:  OnFailureKeep,
+		},
+		{
+			name:    "unknown policy",
+			task:    "destroy",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OnFailurePolicy(tt.task, tt.stage)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OnFailurePolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("OnFailurePolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testRollbackManifest returns the demo cluster with a secret, in the order they are applied
+func testRollbackManifest(t *testing.T) []manifestObject {
+	return append(loadTestManifest(t, "demo/cluster.yaml"), testSecret("connection", "team-a", ApplySetID("sockshop", "dev")))
+}
+
+func TestSetupRollbackKeepsCreatedObjects(t *testing.T) {
+	memory := useMemoryCluster(t)
+	manifest := testRollbackManifest(t)
+	rollback := newSetupRollback(context.Background(), OnFailureKeep, manifest)
+	if err := ApplyObjects(context.Background(), manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	details := rollback.run(context.Background())
+	want := &RollbackDetails{Policy: OnFailureKeep, Created: []string{manifest[0].String(), manifest[1].String()}}
+	if !reflect.DeepEqual(details, want) {
+		t.Errorf("run() = %+v, want %+v", details, want)
+	}
+	if len(memory.deleted) > 0 {
+		t.Errorf("run() deleted %v", memory.deleted)
+	}
+}
+
+func TestSetupRollbackNeverDeletesExistingObjects(t *testing.T) {
+	manifest := testRollbackManifest(t)
+	// the environment exists already, e.g., it has been adopted or claimed from a pool
+	memory := useMemoryCluster(t, manifest[0])
+
+	rollback := newSetupRollback(context.Background(), OnFailureDelete, manifest)
+	if err := ApplyObjects(context.Background(), manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	details := rollback.run(context.Background())
+	want := &RollbackDetails{Policy: OnFailureDelete, Created: []string{manifest[1].String()}, Deleted: []string{manifest[1].String()}}
+	if !reflect.DeepEqual(details, want) {
+		t.Errorf("run() = %+v, want %+v", details, want)
+	}
+	if memory.object(manifest[0].resource(), manifest[0].name(), "") == nil {
+		t.Errorf("run() deleted the existing %s", manifest[0])
+	}
+}
+
+func TestSetupRollbackDeletesInReverseOrder(t *testing.T) {
+	memory := useMemoryCluster(t)
+	manifest := testRollbackManifest(t)
+	rollback := newSetupRollback(context.Background(), OnFailureDelete, manifest)
+	if err := ApplyObjects(context.Background(), manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	details := rollback.run(context.Background())
+	wantDeleted := []string{manifest[1].String(), manifest[0].String()}
+	if !reflect.DeepEqual(memory.deleted, wantDeleted) {
+		t.Errorf("run() deleted %v, want %v", memory.deleted, wantDeleted)
+	}
+	want := &RollbackDetails{Policy: OnFailureDelete, Created: []string{manifest[0].String(), manifest[1].String()}, Deleted: wantDeleted}
+	if !reflect.DeepEqual(details, want) {
+		t.Errorf("run() = %+v, want %+v", details, want)
+	}
+}
+
+func TestSetupRollbackStopsAtFailedDeletion(t *testing.T) {
+	memory := useMemoryCluster(t)
+	manifest := append(testRollbackManifest(t), testSecret("kubeconfig", "team-a", ApplySetID("sockshop", "dev")))
+	rollback := newSetupRollback(context.Background(), OnFailureDelete, manifest)
+	if err := ApplyObjects(context.Background(), manifest); err != nil {
+		t.Fatal(err)
+	}
+	memory.failDeletes["connection"] = true
+
+	details := rollback.run(context.Background())
+	if want := []string{manifest[2].String()}; !reflect.DeepEqual(details.Deleted, want) {
+		t.Errorf("run() deleted %v, want %v", details.Deleted, want)
+	}
+	if details.Error == "" || !strings.Contains(details.Error, manifest[1].String()) {
+		t.Errorf("run() error = %q, want it to name %s", details.Error, manifest[1])
+	}
+	if memory.object(manifest[0].resource(), manifest[0].name(), "") == nil {
+		t.Errorf("run() deleted %s after the failed deletion", manifest[0])
+	}
+}
+
+func TestRollbackDetailsString(t *testing.T) {
+	tests := []struct {
+		name    string
+		details RollbackDetails
+		want    string
+	}{
+		{
+			name:    "nothing created",
+			details: RollbackDetails{Policy: OnFailureDelete},
+			want:    "no objects have been created",
+		},
+		{
+			name:    "kept",
+			details: RollbackDetails{Policy: OnFailureKeep, Created: []string{"a", "b"}},
+			want:    "kept the created objects a, b",
+		},
+		{
+			name:    "deleted",
+			details: RollbackDetails{Policy: OnFailureDelete, Created: []string{"a", "b"}, Deleted: []string{"b", "a"}},
+			want:    "rolled back by deleting the created objects b, a",
+		},
+		{
+			name:    "failed",
+			details: RollbackDetails{Policy: OnFailureDelete, Created: []string{"a", "b"}, Deleted: []string{"b"}, Error: "could not delete a"},
+			want:    "rollback failed, deleted 1 of 2 created objects: could not delete a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.details.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
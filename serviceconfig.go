@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+	"gopkg.in/yaml.v2"
+)
+
+// ServiceConfigFilename is the path of the configuration of the crossplane-service in the Keptn git repo
+const ServiceConfigFilename = "crossplane-service/config.yaml"
+
+// ServiceConfig is the per project configuration of the crossplane-service, e.g.:
+//
+//	stages:
+//	  dev:
+//	    composition: cluster-kind
+//	  perf-test:
+//	    compositionSelector:
+//	      provider: civo
+//	    pool:
+//	      size: 2
+//	      teardownPolicy: recycle
+//	    onFailure: delete
+//	  production:
+//	    protected: true
+//	    drift:
+//	      policy: event
+type ServiceConfig struct {
+	Stages map[string]StageConfig `yaml:"stages"`
+}
+
+// StageConfig is the configuration of the crossplane-service for a single stage
+type StageConfig struct {
+	// Composition is the name of the composition all composites and claims of the stage are created with
+	Composition string `yaml:"composition,omitempty"`
+	// CompositionSelector are the labels of the composition all composites and claims of the stage are created with
+	CompositionSelector map[string]string `yaml:"compositionSelector,omitempty"`
+	// Pool keeps ready environments of the stage so that setup does not have to wait for a new one
+	Pool PoolConfig `yaml:"pool,omitempty"`
+	// OnFailure is the policy for the objects created by a failed environment setup of the stage: keep or delete
+	OnFailure string `yaml:"onFailure,omitempty"`
+	// Protected stages are only torn down if the environment-teardown task overrides the protection explicitly
+	Protected bool `yaml:"protected,omitempty"`
+	// Drift decides what happens if the live environment of the stage differs from the crossplane files
+	Drift DriftConfig `yaml:"drift,omitempty"`
+}
+
+// GetServiceConfig loads the configuration of the crossplane-service from the Keptn git repo. The most specific file
+// wins: a file on service level overrides the file on stage level, which overrides the file on project level.
+// Protection can only be added though: a stage is protected if it is protected in the file of any level.
+// If there is no configuration, an empty configuration is returned.
+func GetServiceConfig(myKeptn *keptnv2.Keptn) (*ServiceConfig, error) {
+	var levels [][]byte
+	err := forEachResourceLevel(myKeptn, ServiceConfigFilename, func(content []byte) bool {
+		levels = append(levels, content)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeServiceConfigs(levels)
+}
+
+// mergeServiceConfigs returns the first, i.e., most specific, of the configurations, with the stages protected by any
+// of the other configurations protected as well
+func mergeServiceConfigs(levels [][]byte) (*ServiceConfig, error) {
+	var config *ServiceConfig
+	for _, content := range levels {
+		level := &ServiceConfig{}
+		if err := yaml.Unmarshal(content, level); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", ServiceConfigFilename, err.Error())
+		}
+		if config == nil {
+			config = level
+			continue
+		}
+		for stage, stageConfig := range level.Stages {
+			if !stageConfig.Protected || config.Stages[stage].Protected {
+				continue
+			}
+			if config.Stages == nil {
+				config.Stages = map[string]StageConfig{}
+			}
+			protected := config.Stages[stage]
+			protected.Protected = true
+			config.Stages[stage] = protected
+		}
+	}
+	if config == nil {
+		return &ServiceConfig{}, nil
+	}
+	return config, nil
+}
+
+// Stage returns the configuration of the stage
+func (c *ServiceConfig) Stage(stage string) StageConfig {
+	if c == nil {
+		return StageConfig{}
+	}
+	return c.Stages[stage]
+}
+
+// getMostSpecificResource returns the resource of the service, stage or project level, in this order.
+// nil is returned if the resource does not exist on any level.
+func getMostSpecificResource(myKeptn *keptnv2.Keptn, uri string) ([]byte, error) {
+	var content []byte
+	err := forEachResourceLevel(myKeptn, uri, func(levelContent []byte) bool {
+		content = levelContent
+		return false
+	})
+	return content, err
+}
+
+// forEachResourceLevel passes the resource of the service, stage and project level, in this order, to the function
+// until it returns false. Levels the resource does not exist on are skipped.
+func forEachResourceLevel(myKeptn *keptnv2.Keptn, uri string, next func(content []byte) bool) error {
+	if myKeptn.UseLocalFileSystem {
+		content, err := ioutil.ReadFile(uri)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		next(content)
+		return nil
+	}
+
+	project := myKeptn.Event.GetProject()
+	stage := myKeptn.Event.GetStage()
+	service := myKeptn.Event.GetService()
+	handler := myKeptn.ResourceHandler
+
+	if stage != "" && service != "" {
+		if resource, err := handler.GetServiceResource(project, stage, service, uri); err == nil {
+			if !next([]byte(resource.ResourceContent)) {
+				return nil
+			}
+		} else if !isResourceNotFoundError(err) {
+			return fmt.Errorf("could not get resource %s of service %s: %s", uri, service, err.Error())
+		}
+	}
+	if stage != "" {
+		if resource, err := handler.GetStageResource(project, stage, uri); err == nil {
+			if !next([]byte(resource.ResourceContent)) {
+				return nil
+			}
+		} else if !isResourceNotFoundError(err) {
+			return fmt.Errorf("could not get resource %s of stage %s: %s", uri, stage, err.Error())
+		}
+	}
+	if resource, err := handler.GetProjectResource(project, uri); err == nil {
+		next([]byte(resource.ResourceContent))
+	} else if !isResourceNotFoundError(err) {
+		return fmt.Errorf("could not get resource %s of project %s: %s", uri, project, err.Error())
+	}
+	return nil
+}
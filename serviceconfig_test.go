@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestMergeServiceConfigs(t *testing.T) {
+	service := []byte(`
+stages:
+  production:
+    onFailure: delete
+`)
+	project := []byte(`
+stages:
+  production:
+    protected: true
+    onFailure: keep
+  staging:
+    protected: true
+`)
+
+	config, err := mergeServiceConfigs([][]byte{service, project})
+	if err != nil {
+		t.Fatalf("mergeServiceConfigs() error = %v", err)
+	}
+	// the most specific configuration wins, but can not remove the protection of a stage
+	if got := config.Stage("production"); got.OnFailure != OnFailureDelete || !got.Protected {
+		t.Errorf("mergeServiceConfigs() stage production = %+v, want onFailure delete and protected", got)
+	}
+	if got := config.Stage("staging"); !got.Protected {
+		t.Errorf("mergeServiceConfigs() stage staging = %+v, want protected", got)
+	}
+
+	config, err = mergeServiceConfigs(nil)
+	if err != nil || config == nil || len(config.Stages) > 0 {
+		t.Errorf("mergeServiceConfigs() without configuration = %+v, %v, want an empty configuration", config, err)
+	}
+	if _, err := mergeServiceConfigs([][]byte{[]byte("stages: [")}); err == nil {
+		t.Errorf("mergeServiceConfigs() of an invalid configuration succeeded, want error")
+	}
+}
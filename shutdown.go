@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
+	"github.com/keptn/go-utils/pkg/lib/keptn"
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+)
+
+// shutdownAbortPeriod is the time operations interrupted at the end of the grace period of a shutdown get to report
+// their interruption in a finished event
+const shutdownAbortPeriod = 5 * time.Second
+
+// eventHandler handles a CloudEvent received by the service
+type eventHandler func(ctx context.Context, event cloudevents.Event) error
+
+// handlers tracks the event handlers running in this replica
+var handlers = newHandlerTracker()
+
+// handlerTracker tracks the running event handlers, so that a shutdown can stop accepting new events and wait for the
+// running ones
+type handlerTracker struct {
+	mutex    sync.Mutex
+	stopping bool
+	next     int
+	// running are the events whose handlers are still running
+	running map[int]cloudevents.Event
+	// finished are the IDs of triggered events whose finished event has been sent by their handler or, if reported,
+	// by the shutdown
+	finished map[string]finishedBy
+	// idle is closed once no handler is running anymore while stopping
+	idle chan struct{}
+}
+
+func newHandlerTracker() *handlerTracker {
+	return &handlerTracker{
+		running:  map[int]cloudevents.Event{},
+		finished: map[string]finishedBy{},
+		idle:     make(chan struct{}),
+	}
+}
+
+// Track wraps the handler, so that it rejects events once the service is shutting down and the shutdown waits for it.
+// A panicking handler is turned into an error, so that one broken event does not stop all other handlers, and its
+// triggered event is reported by an errored finished event unless the handler sent one already.
+func (t *handlerTracker) Track(handler eventHandler) eventHandler {
+	return func(ctx context.Context, event cloudevents.Event) (err error) {
+		t.mutex.Lock()
+		if t.stopping {
+			t.mutex.Unlock()
+			log.Printf("Rejecting %s event %s, the service is shutting down", event.Type(), event.ID())
+			return fmt.Errorf("rejected %s event %s: %w", event.Type(), event.ID(), ErrServiceShutdown)
+		}
+		id := t.next
+		t.next++
+		t.running[id] = event
+		t.mutex.Unlock()
+
+		defer t.done(id)
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Printf("Handler of %s event %s panicked: %v\n%s", event.Type(), event.ID(), recovered, debug.Stack())
+				err = fmt.Errorf("handler of %s event %s panicked: %v", event.Type(), event.ID(), recovered)
+				t.reportPanicked(event, recovered)
+			}
+		}()
+		return handler(ctx, event)
+	}
+}
+
+// reportPanicked reports the triggered event of a panicked handler as failed, unless its finished event has been sent
+// already by the handler or the shutdown
+func (t *handlerTracker) reportPanicked(event cloudevents.Event, recovered interface{}) {
+	t.mutex.Lock()
+	if t.finished[event.ID()] != 0 {
+		t.mutex.Unlock()
+		return
+	}
+	// the shutdown must not report the event again while the finished event is sent
+	t.finished[event.ID()] = finishedByHandler
+	t.mutex.Unlock()
+
+	if err := reportFailedEvent(event, fmt.Sprintf("failed because its handler in the %s panicked: %v", ServiceName, recovered)); err != nil {
+		log.Printf("Could not report failed %s event %s: %s", event.Type(), event.ID(), err.Error())
+	}
+}
+
+func (t *handlerTracker) done(id int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.finished, t.running[id].ID())
+	delete(t.running, id)
+	if t.stopping && len(t.running) == 0 {
+		t.closeIdle()
+	}
+}
+
+func (t *handlerTracker) closeIdle() {
+	select {
+	case <-t.idle:
+	default:
+		close(t.idle)
+	}
+}
+
+// wait waits until no handler is running anymore or the timeout elapsed, it returns true if all handlers are done
+func (t *handlerTracker) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-t.idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Shutdown stops accepting new events and waits for the running handlers for the grace period. Operations on
+// environments that are still running afterwards are interrupted and get a short time to report their interruption.
+// A handler that is still running then is reported by an errored finished event for its triggered event, so that no
+// sequence waits for a task that will never finish. The finished event its handler may still send is dropped then.
+func (t *handlerTracker) Shutdown(gracePeriod time.Duration) {
+	t.mutex.Lock()
+	t.stopping = true
+	if len(t.running) == 0 {
+		t.closeIdle()
+	}
+	log.Printf("Shutting down, waiting up to %s for %d running event handlers", gracePeriod, len(t.running))
+	t.mutex.Unlock()
+
+	if t.wait(gracePeriod) {
+		log.Printf("All event handlers finished")
+		return
+	}
+
+	log.Printf("Grace period of %s elapsed, interrupting running operations", gracePeriod)
+	InterruptEnvironmentOperations()
+	if t.wait(shutdownAbortPeriod) {
+		log.Printf("All event handlers finished")
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, event := range t.running {
+		if t.finished[event.ID()] == finishedByHandler {
+			continue
+		}
+		// the handler may still send its finished event, which is dropped from now on
+		t.finished[event.ID()] = finishedByShutdown
+		if err := reportInterruptedEvent(event); err != nil {
+			log.Printf("Could not report interrupted %s event %s: %s", event.Type(), event.ID(), err.Error())
+		}
+	}
+}
+
+// finishedBy tells who sent the finished event of a triggered event
+type finishedBy int
+
+const (
+	finishedByHandler finishedBy = iota + 1
+	finishedByShutdown
+)
+
+// Sender wraps the event sender of a handler, so that it does not send a finished event for a triggered event the
+// shutdown already reported as interrupted
+func (t *handlerTracker) Sender(sender keptn.EventSender) keptn.EventSender {
+	return trackedEventSender{tracker: t, sender: sender}
+}
+
+// trackedEventSender is the event sender of a tracked handler
+type trackedEventSender struct {
+	tracker *handlerTracker
+	sender  keptn.EventSender
+}
+
+// SendEvent sends the event unless it finishes a task reported by the shutdown
+func (s trackedEventSender) SendEvent(event cloudevents.Event) error {
+	return s.Send(context.Background(), event)
+}
+
+// Send sends the event unless it finishes a task reported by the shutdown
+func (s trackedEventSender) Send(ctx context.Context, event cloudevents.Event) error {
+	if strings.HasSuffix(event.Type(), ".finished") {
+		triggeredID, _ := event.Extensions()["triggeredid"].(string)
+		if !s.tracker.finish(triggeredID) {
+			log.Printf("Dropping %s event for %s, the shutdown already reported the task as interrupted", event.Type(), triggeredID)
+			return nil
+		}
+	}
+	return s.sender.Send(ctx, event)
+}
+
+// finish records that the handler sends the finished event of the triggered event, it returns false if the shutdown
+// already reported it
+func (t *handlerTracker) finish(triggeredID string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.finished[triggeredID] == finishedByShutdown {
+		return false
+	}
+	t.finished[triggeredID] = finishedByHandler
+	return true
+}
+
+// reportInterruptedEvent sends an errored finished event for a triggered event whose handler did not finish before
+// the service shut down
+func reportInterruptedEvent(event cloudevents.Event) error {
+	return reportFailedEvent(event, fmt.Sprintf("has been interrupted because the %s shut down before it finished", ServiceName))
+}
+
+// reportFailedEvent sends an errored finished event for a triggered event whose handler did not report the outcome of
+// the task itself, the reason tells what happened to the task
+func reportFailedEvent(event cloudevents.Event, reason string) error {
+	if !strings.HasSuffix(event.Type(), ".triggered") {
+		return nil
+	}
+	myKeptn, err := keptnv2.NewKeptn(&event, keptnOptions)
+	if err != nil {
+		return err
+	}
+
+	task := strings.TrimSuffix(strings.TrimPrefix(event.Type(), "sh.keptn.event."), ".triggered")
+	logMessage := fmt.Sprintf("The %s task %s, please check the environment of stage %s in project %s and trigger the task again", task, reason, myKeptn.Event.GetStage(), myKeptn.Event.GetProject())
+	log.Printf(logMessage)
+
+	_, err = myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{
+		Status:  keptnv2.StatusErrored,
+		Result:  keptnv2.ResultFailed,
+		Message: logMessage,
+	}, ServiceName)
+	return err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+	"github.com/keptn/go-utils/pkg/lib/v0_2_0/fake"
+)
+
+// resetInterruption allows to lock environments again after the test interrupted all operations
+func resetInterruption(t *testing.T) {
+	t.Cleanup(func() {
+		environmentLocks.Lock()
+		environmentLocks.interrupted = make(chan struct{})
+		environmentLocks.Unlock()
+	})
+}
+
+func loadTestEvent(t *testing.T, filename string) cloudevents.Event {
+	eventFile, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := cloudevents.Event{}
+	if err := json.Unmarshal(eventFile, &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestHandlerTrackerRejectsEventsWhileShuttingDown(t *testing.T) {
+	tracker := newHandlerTracker()
+	called := false
+	handler := tracker.Track(func(ctx context.Context, event cloudevents.Event) error {
+		called = true
+		return nil
+	})
+
+	tracker.Shutdown(time.Second)
+
+	err := handler(context.Background(), loadTestEvent(t, "test-events/action.triggered.json"))
+	if !errors.Is(err, ErrServiceShutdown) {
+		t.Errorf("handler error = %v, want %v", err, ErrServiceShutdown)
+	}
+	if called {
+		t.Errorf("handler has been called while shutting down")
+	}
+}
+
+func TestHandlerTrackerReportsPanickedHandlers(t *testing.T) {
+	sender := &fake.EventSender{}
+	previousSender := keptnOptions.EventSender
+	defer func() {
+		keptnOptions.EventSender = previousSender
+	}()
+	keptnOptions.EventSender = sender
+
+	tracker := newHandlerTracker()
+	handler := tracker.Track(func(ctx context.Context, event cloudevents.Event) error {
+		panic("broken event")
+	})
+	if err := handler(context.Background(), loadTestEvent(t, "test-events/action.triggered.json")); err == nil {
+		t.Errorf("handler error = nil, want the panic as error")
+	}
+	if len(sender.SentEvents) != 1 || sender.SentEvents[0].Type() != keptnv2.GetFinishedEventType(keptnv2.ActionTaskName) {
+		t.Fatalf("sent %d events for a panicked handler, want the finished event", len(sender.SentEvents))
+	}
+	data := &keptnv2.EventData{}
+	if err := sender.SentEvents[0].DataAs(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Status != keptnv2.StatusErrored || data.Result != keptnv2.ResultFailed {
+		t.Errorf("finished event of a panicked handler has status %s and result %s, want errored and fail", data.Status, data.Result)
+	}
+
+	// a handler that panics after sending its finished event is not reported again
+	sender.SentEvents = nil
+	handler = tracker.Track(func(ctx context.Context, event cloudevents.Event) error {
+		myKeptn, err := keptnv2.NewKeptn(&event, keptnOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		myKeptn.EventSender = tracker.Sender(sender)
+		if _, err := myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{Status: keptnv2.StatusSucceeded, Result: keptnv2.ResultPass}, ServiceName); err != nil {
+			t.Fatal(err)
+		}
+		panic("broken cleanup")
+	})
+	handler(context.Background(), loadTestEvent(t, "test-events/action.triggered.json"))
+	if len(sender.SentEvents) != 1 {
+		t.Errorf("sent %d events for a handler that panicked after finishing, want only its finished event", len(sender.SentEvents))
+	}
+}
+
+func TestHandlerTrackerWaitsForRunningHandlers(t *testing.T) {
+	tracker := newHandlerTracker()
+	started := make(chan bool)
+	release := make(chan bool)
+	finished := make(chan bool, 1)
+	handler := tracker.Track(func(ctx context.Context, event cloudevents.Event) error {
+		close(started)
+		<-release
+		finished <- true
+		return nil
+	})
+	go handler(context.Background(), loadTestEvent(t, "test-events/action.triggered.json"))
+	<-started
+
+	stopped := make(chan bool)
+	go func() {
+		tracker.Shutdown(5 * time.Second)
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown() returned while a handler is running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() did not return after the handler finished")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Errorf("Shutdown() returned before the handler finished")
+	}
+}
+
+func TestShutdownInterruptsEnvironmentOperations(t *testing.T) {
+	useMemoryLeases(t)
+	resetInterruption(t)
+
+	tracker := newHandlerTracker()
+	locked := make(chan bool)
+	result := make(chan error, 1)
+	handler := tracker.Track(func(ctx context.Context, event cloudevents.Event) error {
+		lock, err := LockEnvironment(context.Background(), "sockshop.dev", UpdateOperation, nil)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		close(locked)
+
+		<-lock.Context().Done()
+		result <- lock.Err()
+		return nil
+	})
+	go handler(context.Background(), loadTestEvent(t, "test-events/action.triggered.json"))
+	<-locked
+
+	tracker.Shutdown(10 * time.Millisecond)
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrServiceShutdown) || !errors.Is(err, ErrOperationCancelled) {
+			t.Errorf("Err() = %v, want %v", err, ErrServiceShutdown)
+		}
+	default:
+		t.Fatal("operation has not been interrupted")
+	}
+
+	// operations cannot lock an environment anymore
+	if _, err := LockEnvironment(context.Background(), "sockshop.production", SetupOperation, nil); !errors.Is(err, ErrServiceShutdown) {
+		t.Errorf("LockEnvironment() after shutdown error = %v, want %v", err, ErrServiceShutdown)
+	}
+}
+
+func TestReportInterruptedEvent(t *testing.T) {
+	sender := &fake.EventSender{}
+	previousSender := keptnOptions.EventSender
+	defer func() {
+		keptnOptions.EventSender = previousSender
+	}()
+	keptnOptions.EventSender = sender
+
+	if err := reportInterruptedEvent(loadTestEvent(t, "test-events/action.triggered.json")); err != nil {
+		t.Fatalf("reportInterruptedEvent() error = %v", err)
+	}
+	if len(sender.SentEvents) != 1 {
+		t.Fatalf("reportInterruptedEvent() sent %d events, want 1", len(sender.SentEvents))
+	}
+
+	finished := sender.SentEvents[0]
+	if finished.Type() != keptnv2.GetFinishedEventType(keptnv2.ActionTaskName) {
+		t.Errorf("reportInterruptedEvent() sent %s, want %s", finished.Type(), keptnv2.GetFinishedEventType(keptnv2.ActionTaskName))
+	}
+	data := &keptnv2.EventData{}
+	if err := finished.DataAs(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Status != keptnv2.StatusErrored || data.Result != keptnv2.ResultFailed {
+		t.Errorf("reportInterruptedEvent() sent status %s and result %s, want errored and fail", data.Status, data.Result)
+	}
+}
+
+func TestTrackedEventSenderDropsReportedFinishedEvents(t *testing.T) {
+	tracker := newHandlerTracker()
+	sender := &fake.EventSender{}
+
+	sendFinished := func(event cloudevents.Event) {
+		myKeptn, err := keptnv2.NewKeptn(&event, keptnOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		myKeptn.EventSender = tracker.Sender(sender)
+		if _, err := myKeptn.SendTaskStartedEvent(&keptnv2.EventData{}, ServiceName); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := myKeptn.SendTaskFinishedEvent(&keptnv2.EventData{Status: keptnv2.StatusSucceeded, Result: keptnv2.ResultPass}, ServiceName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reported := loadTestEvent(t, "test-events/action.triggered.json")
+	tracker.finished[reported.ID()] = finishedByShutdown
+	sendFinished(reported)
+	if len(sender.SentEvents) != 1 || sender.SentEvents[0].Type() != keptnv2.GetStartedEventType(keptnv2.ActionTaskName) {
+		t.Errorf("sent %d events for a reported task, want only the started event", len(sender.SentEvents))
+	}
+
+	sender.SentEvents = nil
+	finished := loadTestEvent(t, "test-events/action.triggered.json")
+	finished.SetID("finished-by-handler")
+	sendFinished(finished)
+	if len(sender.SentEvents) != 2 {
+		t.Errorf("sent %d events for a running task, want the started and finished event", len(sender.SentEvents))
+	}
+	// the shutdown does not report a task its handler already finished
+	if tracker.finished[finished.ID()] != finishedByHandler {
+		t.Errorf("finished event of the handler has not been recorded")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+)
+
+// Infrastructure SLIs provided by the service for get-sli.triggered events with sliProvider crossplane-service.
+// All durations are reported in seconds.
+const (
+	// ProvisioningTimeSLI is the time from the creation of the environment until its connection secret was written
+	ProvisioningTimeSLI = "provisioning_time"
+	// TimeToReadySLI is the time from the creation of the environment until it became Ready
+	TimeToReadySLI = "time_to_ready"
+	// NodeCountSLI is the number of nodes of the environment
+	NodeCountSLI = "node_count"
+	// FailedReconciliationsSLI is the number of Warning events Crossplane recorded for the environment
+	FailedReconciliationsSLI = "failed_reconciliations"
+	// EnvironmentAgeSLI is the time since the creation of the environment
+	EnvironmentAgeSLI = "environment_age"
+)
+
+// FindContextEnvironment returns the composite resource or claim that has been applied for the Keptn context, or for
+// the apply set (i.e., project and stage) if the context did not apply an environment itself, e.g., for evaluations
+// triggered in a separate sequence
+func FindContextEnvironment(ctx context.Context, xrds []manifestObject, keptnContext string, applySetID string) (*environmentResource, error) {
+	for _, selector := range []string{KeptnContextLabel + "=" + labelValue(keptnContext), ApplySetLabel + "=" + applySetID} {
+		environment, err := findLabelledEnvironment(ctx, xrds, selector)
+		if err != nil || environment != nil {
+			return environment, err
+		}
+	}
+	return nil, fmt.Errorf("no environment has been applied for Keptn context %s or apply set %s", keptnContext, applySetID)
+}
+
+// findLabelledEnvironment returns the first claim or composite resource of the XRDs matching the label selector, or
+// nil if there is none. Claims are preferred, as the composite resource of a claim is labelled as well.
+func findLabelledEnvironment(ctx context.Context, xrds []manifestObject, selector string) (*environmentResource, error) {
+	for _, xrd := range xrds {
+		group := nestedString(xrd, "spec", "group")
+		for _, kind := range []string{nestedString(xrd, "spec", "claimNames", "kind"), nestedString(xrd, "spec", "names", "kind")} {
+			if kind == "" {
+				continue
+			}
+			objects, err := ListObjects(ctx, kind+"."+group, "", selector)
+			if err != nil {
+				return nil, fmt.Errorf("could not list %s.%s: %s", kind, group, err.Error())
+			}
+			if len(objects) > 0 {
+				return &environmentResource{
+					object: objects[0],
+					claim:  kind == nestedString(xrd, "spec", "claimNames", "kind"),
+				}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// GetSLIValues retrieves the values of the indicators for the environment. Indicators that can not be retrieved are
+// reported as unsuccessful with the reason as message.
+func GetSLIValues(ctx context.Context, environment *environmentResource, indicators []string, now time.Time) []*keptnv2.SLIResult {
+	results := make([]*keptnv2.SLIResult, 0, len(indicators))
+	for _, indicator := range indicators {
+		value, err := getSLIValue(ctx, environment, indicator, now)
+		if err != nil {
+			results = append(results, &keptnv2.SLIResult{Metric: indicator, Success: false, Message: err.Error()})
+			continue
+		}
+		results = append(results, &keptnv2.SLIResult{Metric: indicator, Value: value, Success: true})
+	}
+	return results
+}
+
+func getSLIValue(ctx context.Context, environment *environmentResource, indicator string, now time.Time) (float64, error) {
+	switch indicator {
+	case EnvironmentAgeSLI:
+		created, err := creationTime(environment.object)
+		if err != nil {
+			return 0, err
+		}
+		return now.Sub(created).Seconds(), nil
+	case TimeToReadySLI:
+		return timeToReady(environment.object)
+	case ProvisioningTimeSLI:
+		secret, err := getConnectionSecret(ctx, environment)
+		if err != nil {
+			return 0, err
+		}
+		return provisioningTime(environment.object, secret)
+	case NodeCountSLI:
+		secret, err := getConnectionSecret(ctx, environment)
+		if err != nil {
+			return 0, err
+		}
+		kubeconfig, err := base64.StdEncoding.DecodeString(nestedString(secret, "data", "kubeconfig"))
+		if err != nil || len(kubeconfig) == 0 {
+			return 0, fmt.Errorf("the connection secret of the %s does not contain a kubeconfig", environment)
+		}
+		nodes, err := CountNodes(ctx, kubeconfig)
+		if err != nil {
+			return 0, fmt.Errorf("could not get nodes of the %s: %s", environment, err.Error())
+		}
+		return float64(nodes), nil
+	case FailedReconciliationsSLI:
+		events, err := ListWarningEvents(ctx, environment.object)
+		if err != nil {
+			return 0, fmt.Errorf("could not get events of the %s: %s", environment, err.Error())
+		}
+		return countEvents(events), nil
+	}
+	return 0, fmt.Errorf("unsupported indicator %s, supported indicators are %s, %s, %s, %s and %s", indicator,
+		ProvisioningTimeSLI, TimeToReadySLI, NodeCountSLI, FailedReconciliationsSLI, EnvironmentAgeSLI)
+}
+
+// getConnectionSecret fetches the secret the connection details of the environment are written to
+func getConnectionSecret(ctx context.Context, environment *environmentResource) (manifestObject, error) {
+	name, namespace := environment.ConnectionSecret()
+	secret, err := GetObject(ctx, "secret", name, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("could not get connection secret %s of the %s: %s", name, environment, err.Error())
+	}
+	return secret, nil
+}
+
+// timeToReady returns the seconds from the creation of the object until its Ready condition became True
+func timeToReady(object manifestObject) (float64, error) {
+	if !IsReady(object) {
+		return 0, fmt.Errorf("the environment %s is not Ready", object)
+	}
+	created, err := creationTime(object)
+	if err != nil {
+		return 0, err
+	}
+
+	conditions, _ := nestedValue(object, "status", "conditions").([]interface{})
+	for _, item := range conditions {
+		condition, _ := item.(map[string]interface{})
+		if nestedString(condition, "type") != "Ready" {
+			continue
+		}
+		ready, err := time.Parse(time.RFC3339, nestedString(condition, "lastTransitionTime"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid lastTransitionTime of the Ready condition of %s: %s", object, err.Error())
+		}
+		return ready.Sub(created).Seconds(), nil
+	}
+	return 0, fmt.Errorf("the environment %s is not Ready", object)
+}
+
+// provisioningTime returns the seconds from the creation of the object until its connection secret was created
+func provisioningTime(object manifestObject, secret manifestObject) (float64, error) {
+	created, err := creationTime(object)
+	if err != nil {
+		return 0, err
+	}
+	provisioned, err := creationTime(secret)
+	if err != nil {
+		return 0, err
+	}
+	return provisioned.Sub(created).Seconds(), nil
+}
+
+// countEvents sums up the events, taking the count of aggregated events into account
+func countEvents(events []manifestObject) float64 {
+	var count float64
+	for _, event := range events {
+		if value, ok := toFloat(event["count"]); ok && value > 0 {
+			count += value
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+func creationTime(object manifestObject) (time.Time, error) {
+	created, err := time.Parse(time.RFC3339, nestedString(object, "metadata", "creationTimestamp"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid creationTimestamp of %s: %s", object, err.Error())
+	}
+	return created, nil
+}
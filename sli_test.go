@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testEnvironment(created string, readySince string) *environmentResource {
+	object := manifestObject{
+		"apiVersion": "devopstoolkitseries.com/v1alpha1",
+		"kind":       "CompositeCluster",
+	}
+	setNestedValue(object, "keptn-crossplane", "metadata", "name")
+	setNestedValue(object, created, "metadata", "creationTimestamp")
+	if readySince != "" {
+		setNestedValue(object, []interface{}{
+			map[string]interface{}{"type": "Ready", "status": "True", "lastTransitionTime": readySince},
+		}, "status", "conditions")
+	}
+	return &environmentResource{object: object}
+}
+
+func TestGetSLIValues(t *testing.T) {
+	environment := testEnvironment("2021-01-15T15:00:00Z", "2021-01-15T15:04:30Z")
+	now, _ := time.Parse(time.RFC3339, "2021-01-15T16:00:00Z")
+
+	results := GetSLIValues(context.Background(), environment, []string{EnvironmentAgeSLI, TimeToReadySLI, "response_time_p95"}, now)
+
+	if len(results) != 3 {
+		t.Fatalf("GetSLIValues() returned %d results, want 3", len(results))
+	}
+	if results[0].Metric != EnvironmentAgeSLI || !results[0].Success || results[0].Value != 3600 {
+		t.Errorf("GetSLIValues() %s = %+v, want 3600", EnvironmentAgeSLI, results[0])
+	}
+	if results[1].Metric != TimeToReadySLI || !results[1].Success || results[1].Value != 270 {
+		t.Errorf("GetSLIValues() %s = %+v, want 270", TimeToReadySLI, results[1])
+	}
+	if results[2].Success || results[2].Message == "" {
+		t.Errorf("GetSLIValues() response_time_p95 = %+v, want unsuccessful with message", results[2])
+	}
+}
+
+func TestTimeToReadyNotReady(t *testing.T) {
+	if _, err := timeToReady(testEnvironment("2021-01-15T15:00:00Z", "").object); err == nil {
+		t.Errorf("timeToReady() error = nil, want not Ready")
+	}
+}
+
+func TestProvisioningTime(t *testing.T) {
+	environment := testEnvironment("2021-01-15T15:00:00Z", "")
+	secret := manifestObject{}
+	setNestedValue(secret, "2021-01-15T15:07:00Z", "metadata", "creationTimestamp")
+
+	got, err := provisioningTime(environment.object, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 420 {
+		t.Errorf("provisioningTime() = %v, want 420", got)
+	}
+}
+
+func TestCountEvents(t *testing.T) {
+	events := []manifestObject{
+		{"count": float64(3)},
+		{},
+		{"count": float64(0)},
+	}
+	if got := countEvents(events); got != 5 {
+		t.Errorf("countEvents() = %v, want 5", got)
+	}
+}
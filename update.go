@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// MergeParameters returns the spec.parameters of the live environment before and after merging the parameters of
+// the task. As for a JSON merge patch, nested maps are merged and null values remove a parameter.
+func MergeParameters(live manifestObject, parameters map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	before, _ := convertYAMLValue(nestedMap(live, "spec", "parameters")).(map[string]interface{})
+	if before == nil {
+		before = map[string]interface{}{}
+	}
+	after := mergePatch(convertYAMLValue(before).(map[string]interface{}), parameters)
+	return before, after
+}
+
+// mergePatch applies the patch to the target following the semantics of a JSON merge patch (RFC 7386)
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		if patchMap, ok := value.(map[string]interface{}); ok {
+			targetMap, _ := target[key].(map[string]interface{})
+			if targetMap == nil {
+				targetMap = map[string]interface{}{}
+			}
+			target[key] = mergePatch(targetMap, patchMap)
+			continue
+		}
+		target[key] = value
+	}
+	return target
+}
+
+// UpdateEnvironment patches the parameters of the live environment and links it to the Keptn sequence that updated it
+func UpdateEnvironment(ctx context.Context, environment *environmentResource, parameters map[string]interface{}, owner ownership) error {
+	labels := map[string]interface{}{}
+	for key, value := range owner.labels() {
+		if value != "" && key != ManifestHashLabel {
+			labels[key] = value
+		}
+	}
+	annotations := map[string]interface{}{}
+	for key, value := range owner.annotations() {
+		if value != "" && key != ManifestHashLabel {
+			annotations[key] = value
+		}
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+		"spec": map[string]interface{}{
+			"parameters": parameters,
+		},
+	}
+
+	object := environment.object
+	if err := PatchObject(ctx, object.resource(), object.name(), object.namespace(), patch); err != nil {
+		return fmt.Errorf("could not update %s: %s", environment, err.Error())
+	}
+	return nil
+}
+
+// IsReconciled returns true if the Crossplane resource is Ready and Crossplane has reconciled the change made at the
+// given time. If the resource reports the observed generation (in its Ready condition or its status), it has to be the
+// latest generation of the object. Otherwise, the Ready or Synced condition has to have changed since the change.
+func IsReconciled(object manifestObject, changed time.Time) bool {
+	if !IsReady(object) {
+		return false
+	}
+
+	observedGeneration := nestedValue(object, "status", "observedGeneration")
+	var lastTransition time.Time
+	conditions, _ := nestedValue(object, "status", "conditions").([]interface{})
+	for _, item := range conditions {
+		condition, _ := item.(map[string]interface{})
+		switch nestedString(condition, "type") {
+		case "Ready":
+			if value, ok := condition["observedGeneration"]; ok {
+				observedGeneration = value
+			}
+		case "Synced":
+		default:
+			continue
+		}
+		if transition, err := time.Parse(time.RFC3339, nestedString(condition, "lastTransitionTime")); err == nil && transition.After(lastTransition) {
+			lastTransition = transition
+		}
+	}
+
+	generation, hasGeneration := toFloat(nestedValue(object, "metadata", "generation"))
+	if observed, ok := toFloat(observedGeneration); ok && hasGeneration {
+		return observed >= generation
+	}
+	// condition timestamps have a resolution of seconds
+	return !lastTransition.Before(changed.Truncate(time.Second))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeParameters(t *testing.T) {
+	live := loadTestManifest(t, "demo/cluster.yaml")[0]
+
+	before, after := MergeParameters(live, map[string]interface{}{
+		"nodeSize":     "large",
+		"minNodeCount": nil,
+		"labels":       map[string]interface{}{"team": "sockshop"},
+	})
+
+	wantBefore := map[string]interface{}{"nodeSize": "small", "minNodeCount": 1}
+	if !reflect.DeepEqual(before, wantBefore) {
+		t.Errorf("MergeParameters() before = %v, want %v", before, wantBefore)
+	}
+	wantAfter := map[string]interface{}{"nodeSize": "large", "labels": map[string]interface{}{"team": "sockshop"}}
+	if !reflect.DeepEqual(after, wantAfter) {
+		t.Errorf("MergeParameters() after = %v, want %v", after, wantAfter)
+	}
+	if got := nestedString(live, "spec", "parameters", "nodeSize"); got != "small" {
+		t.Errorf("MergeParameters() modified the live object, nodeSize = %s", got)
+	}
+}
+
+func TestIsReconciled(t *testing.T) {
+	changed := time.Date(2022, 3, 1, 12, 0, 0, 500, time.UTC)
+
+	tests := []struct {
+		name               string
+		ready              string
+		generation         interface{}
+		observedGeneration interface{}
+		statusGeneration   interface{}
+		lastTransitionTime string
+		synced             string
+		want               bool
+	}{
+		{
+			name:  "ready without generations and transition times",
+			ready: "True",
+		},
+		{
+			name:               "ready before the change",
+			ready:              "True",
+			generation:         float64(3),
+			lastTransitionTime: "2022-03-01T11:00:00Z",
+		},
+		{
+			name:               "ready since the change",
+			ready:              "True",
+			generation:         float64(3),
+			lastTransitionTime: "2022-03-01T12:00:00Z",
+			want:               true,
+		},
+		{
+			name:               "synced since the change",
+			ready:              "True",
+			generation:         float64(3),
+			lastTransitionTime: "2022-03-01T11:00:00Z",
+			synced:             "2022-03-01T12:00:10Z",
+			want:               true,
+		},
+		{
+			name:               "not ready",
+			ready:              "False",
+			lastTransitionTime: "2022-03-01T12:00:10Z",
+		},
+		{
+			name:               "status reports the previous generation",
+			ready:              "True",
+			generation:         float64(3),
+			statusGeneration:   float64(2),
+			lastTransitionTime: "2022-03-01T12:00:10Z",
+		},
+		{
+			name:               "status reports the current generation",
+			ready:              "True",
+			generation:         float64(3),
+			statusGeneration:   float64(3),
+			lastTransitionTime: "2022-03-01T11:00:00Z",
+			want:               true,
+		},
+		{
+			name:               "ready for the previous generation",
+			ready:              "True",
+			generation:         float64(3),
+			observedGeneration: float64(2),
+		},
+		{
+			name:               "ready for the current generation",
+			ready:              "True",
+			generation:         float64(3),
+			observedGeneration: float64(3),
+			want:               true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := map[string]interface{}{"type": "Ready", "status": tt.ready}
+			if tt.observedGeneration != nil {
+				condition["observedGeneration"] = tt.observedGeneration
+			}
+			if tt.lastTransitionTime != "" {
+				condition["lastTransitionTime"] = tt.lastTransitionTime
+			}
+			conditions := []interface{}{condition}
+			if tt.synced != "" {
+				conditions = append(conditions, map[string]interface{}{"type": "Synced", "status": "True", "lastTransitionTime": tt.synced})
+			}
+			object := manifestObject{}
+			setNestedValue(object, conditions, "status", "conditions")
+			if tt.statusGeneration != nil {
+				setNestedValue(object, tt.statusGeneration, "status", "observedGeneration")
+			}
+			if tt.generation != nil {
+				setNestedValue(object, tt.generation, "metadata", "generation")
+			}
+
+			if got := IsReconciled(object, changed); got != tt.want {
+				t.Errorf("IsReconciled() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CompositeResourceDefinitionResource is the kubectl resource name of Crossplane XRDs
+const CompositeResourceDefinitionResource = "compositeresourcedefinitions.apiextensions.crossplane.io"
+
+// CompositionResource is the kubectl resource name of Crossplane compositions
+const CompositionResource = "compositions.apiextensions.crossplane.io"
+
+// crossplaneManagedSpecFields are injected into the schema of every XR and claim by Crossplane
+// and are therefore not part of the openAPIV3Schema of the XRD
+var crossplaneManagedSpecFields = map[string]bool{
+	"compositionRef":              true,
+	"compositionSelector":         true,
+	"compositionRevisionRef":      true,
+	"compositionRevisionSelector": true,
+	"compositionUpdatePolicy":     true,
+	"compositeDeletePolicy":       true,
+	"claimRef":                    true,
+	"resourceRef":                 true,
+	"resourceRefs":                true,
+	"writeConnectionSecretToRef":  true,
+	"publishConnectionDetailsTo":  true,
+}
+
+// ValidateManifest validates all composite resources and claims of the manifest against the openAPIV3Schema of their
+// CompositeResourceDefinition and checks that referenced compositions exist in the management cluster.
+// Objects that are not defined by an XRD are not validated.
+func ValidateManifest(ctx context.Context, objects []manifestObject, xrds []manifestObject) error {
+	var problems []string
+	for _, object := range objects {
+		xrd := findCompositeResourceDefinition(xrds, object)
+		if xrd == nil {
+			continue
+		}
+
+		for _, problem := range validateCompositeObject(xrd, object) {
+			problems = append(problems, fmt.Sprintf("%s: %s", object, problem))
+		}
+
+		if matchLabels := nestedMap(object, "spec", "compositionSelector", "matchLabels"); len(matchLabels) > 0 {
+			problem, err := validateCompositionSelector(ctx, xrd, matchLabels)
+			if err != nil {
+				return err
+			}
+			if problem != "" {
+				problems = append(problems, fmt.Sprintf("%s: %s", object, problem))
+			}
+		}
+
+		compositionName := nestedString(object, "spec", "compositionRef", "name")
+		if compositionName == "" {
+			continue
+		}
+		if _, err := GetObject(ctx, CompositionResource, compositionName, ""); err != nil {
+			if IsNotFoundError(err) {
+				problems = append(problems, fmt.Sprintf("%s: spec.compositionRef.name: Not found: composition %q does not exist", object, compositionName))
+				continue
+			}
+			return fmt.Errorf("could not look up composition %s: %s", compositionName, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("manifest is invalid:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// validateCompositionSelector checks that at least one composition for the kind of the XRD matches the labels
+func validateCompositionSelector(ctx context.Context, xrd manifestObject, matchLabels map[string]interface{}) (string, error) {
+	labels := make(map[string]string, len(matchLabels))
+	for key, value := range matchLabels {
+		labels[key] = fmt.Sprint(value)
+	}
+	selector := labelSelector(labels)
+
+	compositions, err := ListObjects(ctx, CompositionResource, "", selector)
+	if err != nil {
+		return "", fmt.Errorf("could not list compositions matching %s: %s", selector, err.Error())
+	}
+	for _, composition := range compositions {
+		if nestedString(composition, "spec", "compositeTypeRef", "kind") == nestedString(xrd, "spec", "names", "kind") {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("spec.compositionSelector.matchLabels: Not found: no composition for %s matches %q", nestedString(xrd, "spec", "names", "kind"), selector), nil
+}
+
+// findCompositeResourceDefinition returns the XRD that defines the kind of the object, either as composite or as claim
+func findCompositeResourceDefinition(xrds []manifestObject, object manifestObject) manifestObject {
+	for _, xrd := range xrds {
+		if nestedString(xrd, "spec", "group") != object.group() {
+			continue
+		}
+		if nestedString(xrd, "spec", "names", "kind") == object.kind() || nestedString(xrd, "spec", "claimNames", "kind") == object.kind() {
+			return xrd
+		}
+	}
+	return nil
+}
+
+// validateCompositeObject validates the spec of the object against the schema of the matching XRD version
+func validateCompositeObject(xrd manifestObject, object manifestObject) []string {
+	versions, _ := nestedValue(xrd, "spec", "versions").([]interface{})
+	for _, item := range versions {
+		version, _ := item.(map[string]interface{})
+		if nestedString(version, "name") != object.version() {
+			continue
+		}
+		if served, ok := version["served"].(bool); ok && !served {
+			return []string{fmt.Sprintf("apiVersion: Unsupported value: %q: version is not served", object.apiVersion())}
+		}
+
+		schema := nestedMap(version, "schema", "openAPIV3Schema")
+		specSchema := nestedMap(schema, "properties", "spec")
+		if specSchema == nil {
+			return nil
+		}
+
+		spec, _ := object["spec"].(map[string]interface{})
+		if spec == nil {
+			return []string{"spec: Required value"}
+		}
+
+		// the fields managed by Crossplane are validated by Crossplane itself, hence we only validate the user defined ones
+		userSpec := make(map[string]interface{}, len(spec))
+		for key, value := range spec {
+			if !crossplaneManagedSpecFields[key] {
+				userSpec[key] = value
+			}
+		}
+		return validateAgainstSchema("spec", userSpec, specSchema)
+	}
+
+	return []string{fmt.Sprintf("apiVersion: Unsupported value: %q: version is not defined by %s", object.apiVersion(), xrd.name())}
+}
+
+// validateAgainstSchema validates the value against the (structural) openAPIV3Schema and returns all problems found,
+// each prefixed with the path of the offending field
+func validateAgainstSchema(path string, value interface{}, schema map[string]interface{}) []string {
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: Invalid value: null: must not be null", path)}
+	}
+
+	var problems []string
+	if enum, ok := schema["enum"].([]interface{}); ok && !containsValue(enum, value) {
+		supported := make([]string, len(enum))
+		for index, item := range enum {
+			supported[index] = fmt.Sprintf("%q", fmt.Sprint(item))
+		}
+		problems = append(problems, fmt.Sprintf("%s: Unsupported value: %q: supported values: %s", path, fmt.Sprint(value), strings.Join(supported, ", ")))
+	}
+
+	schemaType, _ := schema["type"].(string)
+	switch schemaType {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(problems, typeProblem(path, value, schemaType))
+		}
+		problems = append(problems, validateObjectAgainstSchema(path, object, schema)...)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return append(problems, typeProblem(path, value, schemaType))
+		}
+		if minItems, ok := toFloat(schema["minItems"]); ok && float64(len(array)) < minItems {
+			problems = append(problems, fmt.Sprintf("%s: Invalid value: must have at least %v items", path, minItems))
+		}
+		if maxItems, ok := toFloat(schema["maxItems"]); ok && float64(len(array)) > maxItems {
+			problems = append(problems, fmt.Sprintf("%s: Too many: %d: must have at most %v items", path, len(array), maxItems))
+		}
+		if itemSchema, ok := schema["items"].(map[string]interface{}); ok {
+			for index, item := range array {
+				problems = append(problems, validateAgainstSchema(fmt.Sprintf("%s[%d]", path, index), item, itemSchema)...)
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return append(problems, typeProblem(path, value, schemaType))
+		}
+		if minLength, ok := toFloat(schema["minLength"]); ok && float64(len(str)) < minLength {
+			problems = append(problems, fmt.Sprintf("%s: Invalid value: %q: should be at least %v chars long", path, str, minLength))
+		}
+		if maxLength, ok := toFloat(schema["maxLength"]); ok && float64(len(str)) > maxLength {
+			problems = append(problems, fmt.Sprintf("%s: Too long: may not be longer than %v", path, maxLength))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if matched, err := regexp.MatchString(pattern, str); err == nil && !matched {
+				problems = append(problems, fmt.Sprintf("%s: Invalid value: %q: should match '%s'", path, str, pattern))
+			}
+		}
+	case "integer", "number":
+		number, ok := toFloat(value)
+		if !ok || (schemaType == "integer" && number != math.Trunc(number)) {
+			return append(problems, typeProblem(path, value, schemaType))
+		}
+		if minimum, ok := toFloat(schema["minimum"]); ok && number < minimum {
+			problems = append(problems, fmt.Sprintf("%s: Invalid value: %v: should be greater than or equal to %v", path, value, minimum))
+		}
+		if maximum, ok := toFloat(schema["maximum"]); ok && number > maximum {
+			problems = append(problems, fmt.Sprintf("%s: Invalid value: %v: should be less than or equal to %v", path, value, maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return append(problems, typeProblem(path, value, schemaType))
+		}
+	}
+
+	return problems
+}
+
+// validateObjectAgainstSchema validates required, known and additional properties of an object
+func validateObjectAgainstSchema(path string, object map[string]interface{}, schema map[string]interface{}) []string {
+	var problems []string
+
+	required, _ := schema["required"].([]interface{})
+	for _, item := range required {
+		field := fmt.Sprint(item)
+		if _, ok := object[field]; !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s: Required value", path, field))
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	preserveUnknownFields, _ := schema["x-kubernetes-preserve-unknown-fields"].(bool)
+	additionalProperties := schema["additionalProperties"]
+
+	// iterate in a stable order to produce deterministic error messages
+	fields := make([]string, 0, len(object))
+	for field := range object {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		fieldPath := path + "." + field
+		if propertySchema, ok := properties[field].(map[string]interface{}); ok {
+			problems = append(problems, validateAgainstSchema(fieldPath, object[field], propertySchema)...)
+			continue
+		}
+
+		switch additional := additionalProperties.(type) {
+		case map[string]interface{}:
+			problems = append(problems, validateAgainstSchema(fieldPath, object[field], additional)...)
+		case bool:
+			if !additional {
+				problems = append(problems, fmt.Sprintf("%s: Forbidden: unknown field", fieldPath))
+			}
+		default:
+			if properties != nil && !preserveUnknownFields {
+				problems = append(problems, fmt.Sprintf("%s: Forbidden: unknown field", fieldPath))
+			}
+		}
+	}
+
+	return problems
+}
+
+func typeProblem(path string, value interface{}, expected string) string {
+	return fmt.Sprintf("%s: Invalid value: %q: must be of type %s", path, fmt.Sprint(value), expected)
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, item := range values {
+		if fmt.Sprint(item) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// toFloat converts the numeric types produced by the YAML and JSON decoders to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
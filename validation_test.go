@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func loadTestManifest(t *testing.T, fileName string) []manifestObject {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Cant load %s: %s", fileName, err.Error())
+	}
+	objects, err := parseManifest(content)
+	if err != nil {
+		t.Fatalf("Cant parse %s: %s", fileName, err.Error())
+	}
+	return objects
+}
+
+func TestValidateCompositeObject(t *testing.T) {
+	xrds := loadTestManifest(t, "demo/crossplane-resources/definition.yaml")
+
+	tests := []struct {
+		name     string
+		manifest string
+		problems []string
+	}{
+		{
+			name: "valid composite",
+			manifest: `
+apiVersion: devopstoolkitseries.com/v1alpha1
+kind: CompositeCluster
+metadata:
+  name: keptn-crossplane
+spec:
+  id: keptn-crossplane
+  compositionRef:
+    name: cluster-civo
+  parameters:
+    nodeSize: small
+    minNodeCount: 1`,
+		},
+		{
+			name: "typo in node size",
+			manifest: `
+apiVersion: devopstoolkitseries.com/v1alpha1
+kind: ClusterClaim
+metadata:
+  name: keptn-crossplane
+spec:
+  id: keptn-crossplane
+  parameters:
+    nodeSize: medum`,
+			problems: []string{`spec.parameters.nodeSize: Unsupported value: "medum": supported values: "small", "medium", "large"`},
+		},
+		{
+			name: "missing and unknown fields",
+			manifest: `
+apiVersion: devopstoolkitseries.com/v1alpha1
+kind: CompositeCluster
+metadata:
+  name: keptn-crossplane
+spec:
+  parameters:
+    nodeSize: small
+    minNodeCount: "1"
+    nodeCount: 3`,
+			problems: []string{
+				"spec.id: Required value",
+				`spec.parameters.minNodeCount: Invalid value: "1": must be of type integer`,
+				"spec.parameters.nodeCount: Forbidden: unknown field",
+			},
+		},
+		{
+			name: "unknown version",
+			manifest: `
+apiVersion: devopstoolkitseries.com/v1
+kind: CompositeCluster
+metadata:
+  name: keptn-crossplane
+spec:
+  id: keptn-crossplane`,
+			problems: []string{`apiVersion: Unsupported value: "devopstoolkitseries.com/v1": version is not defined by compositeclusters.devopstoolkitseries.com`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := parseManifest([]byte(tt.manifest))
+			if err != nil {
+				t.Fatalf("Cant parse manifest: %s", err.Error())
+			}
+
+			xrd := findCompositeResourceDefinition(xrds, objects[0])
+			if xrd == nil {
+				t.Fatalf("No XRD found for %s", objects[0])
+			}
+
+			problems := validateCompositeObject(xrd, objects[0])
+			if strings.Join(problems, "\n") != strings.Join(tt.problems, "\n") {
+				t.Errorf("validateCompositeObject() = %v, want %v", problems, tt.problems)
+			}
+		})
+	}
+}